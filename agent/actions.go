@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"weekend-chart/agent/browser"
+)
+
+// maxStepWait is the longest a run_actions step may wait afterwards
+const maxStepWait = 5 * time.Second
+
+// defaultStepWaits is how long a step waits for the page when the server
+// doesn't say, the same as the single commands
+var defaultStepWaits = map[string]time.Duration{
+	"click_xy":      500 * time.Millisecond,
+	"key":           300 * time.Millisecond,
+	"select_option": 300 * time.Millisecond,
+	"click_ref":     500 * time.Millisecond,
+	"select_ref":    300 * time.Millisecond,
+}
+
+// actionStepResult is the outcome of one run_actions step
+type actionStepResult struct {
+	Index   int    `json:"index"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runActions runs the steps in order, stops at the first one that fails,
+// and answers with the result of each step and one screenshot
+func runActions(requestID string, steps []Message) {
+	results := make([]actionStepResult, 0, len(steps))
+	for i, step := range steps {
+		if err := runStep(step); err != nil {
+			// Errors may quote the text typed, which can hold a secret
+			reason := vault.Redact(err.Error())
+			log.Printf("步驟 %d (%s) 失敗: %s", i+1, step.Type, reason)
+			results = append(results, actionStepResult{Index: i, Error: reason})
+			break
+		}
+		results = append(results, actionStepResult{Index: i, Success: true})
+
+		wait := defaultStepWaits[step.Type]
+		if step.WaitMs > 0 {
+			wait = time.Duration(step.WaitMs) * time.Millisecond
+		}
+		if wait > maxStepWait {
+			wait = maxStepWait
+		}
+		time.Sleep(wait)
+	}
+
+	reply := map[string]interface{}{
+		"type":       "actions_result",
+		"request_id": requestID,
+		"results":    results,
+	}
+	if ss, err := chrome.GetScreenshot(); err != nil {
+		log.Printf("截圖失敗: %v", err)
+	} else {
+		reply["image"] = ss.Image
+		reply["url"] = ss.URL
+		reply["title"] = ss.Title
+		reply["width"] = ss.Width
+		reply["height"] = ss.Height
+	}
+	msg, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("JSON 序列化失敗: %v", err)
+		return
+	}
+	if err := sendToDevices(msg); err != nil {
+		log.Printf("回報步驟結果失敗: %v", err)
+	}
+}
+
+// runStep runs one run_actions step like the single command of its type
+func runStep(step Message) error {
+	switch step.Type {
+	case "click_xy":
+		log.Printf("點擊座標: (%d, %d)", step.X, step.Y)
+		if step.Button != "" || step.ClickCount > 1 {
+			return chrome.MouseClick(step.X, step.Y, step.Button, step.ClickCount)
+		}
+		return chrome.ClickXY(step.X, step.Y)
+
+	case "input":
+		log.Printf("輸入: %s", vault.LogText(step.Value))
+		value, err := vault.Resolve(step.Value)
+		if err != nil {
+			return err
+		}
+		if step.Selector != "" {
+			return chrome.Input(step.Selector, value)
+		}
+		return chrome.InputToFocused(value)
+
+	case "key":
+		log.Printf("按鍵: %s", step.Key)
+		return chrome.PressKey(step.Key)
+
+	case "select_option":
+		log.Printf("選擇選項: selector=%s value=%s text=%s", step.Selector, step.OptionValue, step.OptionText)
+		return chrome.SelectOption(step.Selector, step.OptionValue, step.OptionText)
+
+	case "click_ref":
+		log.Printf("點擊元素: %s", step.Ref)
+		return refError(step.Ref, chrome.ClickRef(step.Ref))
+
+	case "input_ref":
+		log.Printf("輸入到元素 %s: %s", step.Ref, vault.LogText(step.Value))
+		value, err := vault.Resolve(step.Value)
+		if err != nil {
+			return err
+		}
+		return refError(step.Ref, chrome.TypeRef(step.Ref, value))
+
+	case "select_ref":
+		log.Printf("選擇選項: ref=%s value=%s text=%s", step.Ref, step.OptionValue, step.OptionText)
+		return refError(step.Ref, chrome.SelectRef(step.Ref, step.OptionValue, step.OptionText))
+	}
+	return fmt.Errorf("不支援的步驟: %s", step.Type)
+}
+
+// refError explains a stale element ref so the model knows to read the
+// page state again instead of retrying the same ref
+func refError(ref string, err error) error {
+	if errors.Is(err, browser.ErrStaleRef) {
+		return fmt.Errorf("元素 %s 已不在頁面上（頁面已變更或已換頁），請重新呼叫 get_page_state 取得新的 ref", ref)
+	}
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,6 +21,10 @@ type Browser struct {
 	cancel     context.CancelFunc
 	mu         sync.Mutex
 	currentURL string
+
+	// refSeq is the last element ref handed out, so refs are never reused,
+	// not even on the next page
+	refSeq int
 }
 
 type PageState struct {
@@ -50,6 +55,7 @@ type InputInfo struct {
 	Value       string `json:"value,omitempty"`
 	Label       string `json:"label,omitempty"`
 	Focused     bool   `json:"focused,omitempty"`
+	Ref         string `json:"ref,omitempty"`
 	X           int    `json:"x"`
 	Y           int    `json:"y"`
 }
@@ -57,6 +63,7 @@ type InputInfo struct {
 type ButtonInfo struct {
 	Text string `json:"text"`
 	Type string `json:"type,omitempty"`
+	Ref  string `json:"ref,omitempty"`
 	X    int    `json:"x"`
 	Y    int    `json:"y"`
 }
@@ -64,6 +71,7 @@ type ButtonInfo struct {
 type LinkInfo struct {
 	Text string `json:"text"`
 	Href string `json:"href,omitempty"`
+	Ref  string `json:"ref,omitempty"`
 	X    int    `json:"x"`
 	Y    int    `json:"y"`
 }
@@ -75,6 +83,7 @@ type SelectInfo struct {
 	SelectedValue string      `json:"selected_value,omitempty"`
 	SelectedText  string      `json:"selected_text,omitempty"`
 	Options      []OptionInfo `json:"options"`
+	Ref          string       `json:"ref,omitempty"`
 	X            int          `json:"x"`
 	Y            int          `json:"y"`
 }
@@ -87,6 +96,7 @@ type OptionInfo struct {
 
 type Screenshot struct {
 	URL    string `json:"url"`
+	Title  string `json:"title"`
 	Image  string `json:"image"` // base64
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
@@ -163,6 +173,66 @@ func (b *Browser) ClickXY(x, y int) error {
 	)
 }
 
+// keyModifiers maps the modifier names of key combinations to CDP modifiers
+var keyModifiers = map[string]input.Modifier{
+	"ctrl":  input.ModifierCtrl,
+	"shift": input.ModifierShift,
+	"alt":   input.ModifierAlt,
+	"meta":  input.ModifierMeta,
+}
+
+// MouseClick clicks with the given button ("left", "right" or "middle")
+// count times in a row, e.g. 2 for a double click
+func (b *Browser) MouseClick(x, y int, button string, count int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	if button == "" {
+		button = "left"
+	}
+	if count < 1 {
+		count = 1
+	}
+	return chromedp.Run(ctx,
+		chromedp.MouseClickXY(float64(x), float64(y),
+			chromedp.ButtonType(input.MouseButton(button)),
+			chromedp.ClickCount(count),
+		),
+	)
+}
+
+// MouseMove moves the mouse without clicking, e.g. to open hover menus
+func (b *Browser) MouseMove(x, y int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
+	defer cancel()
+
+	return chromedp.Run(ctx,
+		chromedp.MouseEvent(input.MouseMoved, float64(x), float64(y)),
+	)
+}
+
+// Drag presses the left button at (x, y), moves to (toX, toY) and releases
+func (b *Browser) Drag(x, y, toX, toY int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	return chromedp.Run(ctx,
+		chromedp.MouseEvent(input.MouseMoved, float64(x), float64(y)),
+		chromedp.MouseEvent(input.MousePressed, float64(x), float64(y), chromedp.ButtonLeft, chromedp.ClickCount(1)),
+		chromedp.MouseEvent(input.MouseMoved, float64(toX), float64(toY), chromedp.ButtonLeft),
+		chromedp.MouseEvent(input.MouseReleased, float64(toX), float64(toY), chromedp.ButtonLeft, chromedp.ClickCount(1)),
+	)
+}
+
 func (b *Browser) Input(selector, value string) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -222,6 +292,30 @@ func (b *Browser) PressKey(key string) error {
 		"ArrowDown": kb.ArrowDown,
 		"ArrowLeft": kb.ArrowLeft,
 		"ArrowRight": kb.ArrowRight,
+		"PageUp":    kb.PageUp,
+		"PageDown":  kb.PageDown,
+		"Home":      kb.Home,
+		"End":       kb.End,
+	}
+
+	// Combinations such as "ctrl+c" hold the modifiers while pressing the key
+	if parts := strings.Split(key, "+"); len(parts) > 1 && parts[len(parts)-1] != "" {
+		var modifiers []input.Modifier
+		for _, name := range parts[:len(parts)-1] {
+			modifier, ok := keyModifiers[strings.ToLower(name)]
+			if !ok {
+				return fmt.Errorf("unknown modifier %q", name)
+			}
+			modifiers = append(modifiers, modifier)
+		}
+		key = parts[len(parts)-1]
+		if mappedKey, ok := keyMap[key]; ok {
+			key = mappedKey
+		}
+		log.Printf("PressKey: %q with modifiers %v", key, modifiers)
+		return chromedp.Run(ctx,
+			chromedp.KeyEvent(key, chromedp.KeyModifiers(modifiers...)),
+		)
 	}
 
 	if mappedKey, ok := keyMap[key]; ok {
@@ -267,15 +361,20 @@ func (b *Browser) Scroll(direction string, amount int) error {
 	ctx, cancel := context.WithTimeout(b.ctx, 5*time.Second)
 	defer cancel()
 
-	// Calculate scroll delta (negative for up, positive for down)
-	deltaY := amount
-	if direction == "up" {
+	// Calculate scroll delta (negative for up and left)
+	deltaX, deltaY := 0, amount
+	switch direction {
+	case "up":
 		deltaY = -amount
+	case "left":
+		deltaX, deltaY = -amount, 0
+	case "right":
+		deltaX, deltaY = amount, 0
 	}
 
 	// Use JavaScript to scroll
 	return chromedp.Run(ctx,
-		chromedp.Evaluate(fmt.Sprintf(`window.scrollBy(0, %d)`, deltaY), nil),
+		chromedp.Evaluate(fmt.Sprintf(`window.scrollBy(%d, %d)`, deltaX, deltaY), nil),
 	)
 }
 
@@ -367,7 +466,9 @@ func (b *Browser) GetDOM() (*PageState, error) {
 	}, nil
 }
 
-// GetSimplifiedPageState extracts essential page info for AI understanding
+// GetSimplifiedPageState extracts essential page info for AI understanding.
+// Every element it lists gets a ref such as "e12" in its data-wc-ref
+// attribute, which ClickRef, TypeRef and SelectRef act on.
 func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -378,8 +479,15 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 	var url, title string
 	var result map[string]interface{}
 
-	jsCode := `
+	jsCode := fmt.Sprintf(`
 	(function() {
+		// Refs stay with their element; a new page continues the numbering
+		if (typeof window.__wcRefSeq !== 'number') window.__wcRefSeq = %d;
+		function refOf(el) {
+			if (!el.dataset.wcRef) el.dataset.wcRef = 'e' + (++window.__wcRefSeq);
+			return el.dataset.wcRef;
+		}
+
 		function getRect(el) {
 			const r = el.getBoundingClientRect();
 			return { x: Math.round(r.x + r.width/2), y: Math.round(r.y + r.height/2) };
@@ -418,6 +526,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				value: el.type === 'password' ? '***' : (el.value || ''),
 				label: getLabel(el),
 				focused: el === focused,
+				ref: refOf(el),
 				x: rect.x,
 				y: rect.y
 			});
@@ -445,6 +554,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				selected_value: selectedOpt ? selectedOpt.value : '',
 				selected_text: selectedOpt ? selectedOpt.text : '',
 				options: options,
+				ref: refOf(el),
 				x: rect.x,
 				y: rect.y
 			});
@@ -458,6 +568,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 			buttons.push({
 				text: el.textContent.trim() || el.value || '',
 				type: el.type || '',
+				ref: refOf(el),
 				x: rect.x,
 				y: rect.y
 			});
@@ -475,6 +586,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				links.push({
 					text: text.substring(0, 50),
 					href: el.getAttribute('href'),
+					ref: refOf(el),
 					x: rect.x,
 					y: rect.y
 				});
@@ -490,10 +602,11 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 			selects: selects,
 			buttons: buttons,
 			links: links,
-			text: bodyText
+			text: bodyText,
+			ref_seq: window.__wcRefSeq
 		};
 	})()
-	`
+	`, b.refSeq)
 
 	err := chromedp.Run(ctx,
 		chromedp.Location(&url),
@@ -516,6 +629,9 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 	if text, ok := result["text"].(string); ok {
 		state.Text = text
 	}
+	if seq, ok := result["ref_seq"].(float64); ok && int(seq) > b.refSeq {
+		b.refSeq = int(seq)
+	}
 
 	// Parse inputs
 	if inputsRaw, ok := result["inputs"].([]interface{}); ok {
@@ -529,6 +645,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				if s, ok := m["value"].(string); ok { input.Value = s }
 				if s, ok := m["label"].(string); ok { input.Label = s }
 				if b, ok := m["focused"].(bool); ok { input.Focused = b }
+				if s, ok := m["ref"].(string); ok { input.Ref = s }
 				if f, ok := m["x"].(float64); ok { input.X = int(f) }
 				if f, ok := m["y"].(float64); ok { input.Y = int(f) }
 				state.Inputs = append(state.Inputs, input)
@@ -546,6 +663,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				if s, ok := m["label"].(string); ok { sel.Label = s }
 				if s, ok := m["selected_value"].(string); ok { sel.SelectedValue = s }
 				if s, ok := m["selected_text"].(string); ok { sel.SelectedText = s }
+				if s, ok := m["ref"].(string); ok { sel.Ref = s }
 				if f, ok := m["x"].(float64); ok { sel.X = int(f) }
 				if f, ok := m["y"].(float64); ok { sel.Y = int(f) }
 				// Parse options
@@ -572,6 +690,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				btn := ButtonInfo{}
 				if s, ok := m["text"].(string); ok { btn.Text = s }
 				if s, ok := m["type"].(string); ok { btn.Type = s }
+				if s, ok := m["ref"].(string); ok { btn.Ref = s }
 				if f, ok := m["x"].(float64); ok { btn.X = int(f) }
 				if f, ok := m["y"].(float64); ok { btn.Y = int(f) }
 				state.Buttons = append(state.Buttons, btn)
@@ -586,6 +705,7 @@ func (b *Browser) GetSimplifiedPageState() (*SimplifiedPageState, error) {
 				link := LinkInfo{}
 				if s, ok := m["text"].(string); ok { link.Text = s }
 				if s, ok := m["href"].(string); ok { link.Href = s }
+				if s, ok := m["ref"].(string); ok { link.Ref = s }
 				if f, ok := m["x"].(float64); ok { link.X = int(f) }
 				if f, ok := m["y"].(float64); ok { link.Y = int(f) }
 				state.Links = append(state.Links, link)
@@ -603,7 +723,7 @@ func (b *Browser) GetScreenshot() (*Screenshot, error) {
 	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
 	defer cancel()
 
-	var url string
+	var url, title string
 	var buf []byte
 
 	// Use clip to ensure exact viewport dimensions
@@ -617,6 +737,7 @@ func (b *Browser) GetScreenshot() (*Screenshot, error) {
 
 	err := chromedp.Run(ctx,
 		chromedp.Location(&url),
+		chromedp.Title(&title),
 		chromedp.ActionFunc(func(ctx context.Context) error {
 			var err error
 			buf, err = page.CaptureScreenshot().
@@ -633,6 +754,7 @@ func (b *Browser) GetScreenshot() (*Screenshot, error) {
 
 	return &Screenshot{
 		URL:    url,
+		Title:  title,
 		Image:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf),
 		Width:  1920,
 		Height: 1080,
@@ -659,3 +781,30 @@ func (b *Browser) WatchDOMChanges(callback func(*PageState)) {
 		}
 	}()
 }
+
+// WatchNavigations calls callback with the URL of every page the main frame
+// opens, including ones opened by links, forms and scripts. The callback
+// runs on its own goroutine so it may use the browser.
+func (b *Browser) WatchNavigations(callback func(url string)) {
+	chromedp.ListenTarget(b.ctx, func(ev interface{}) {
+		if e, ok := ev.(*page.EventFrameNavigated); ok && e.Frame.ParentID == "" {
+			go callback(e.Frame.URL + e.Frame.URLFragment)
+		}
+	})
+}
+
+// LeavePage goes back in history, or to a blank page if there is nothing
+// to go back to
+func (b *Browser) LeavePage() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	if err := chromedp.Run(ctx, chromedp.NavigateBack()); err == nil {
+		return nil
+	}
+	b.currentURL = "about:blank"
+	return chromedp.Run(ctx, chromedp.Navigate("about:blank"))
+}
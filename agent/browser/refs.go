@@ -0,0 +1,181 @@
+package browser
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/chromedp/cdproto/input"
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/kb"
+)
+
+// ErrStaleRef means an element ref no longer matches an element on the
+// page, because the page changed or navigated since the refs were taken
+var ErrStaleRef = errors.New("stale element ref")
+
+// refPattern is the form of the refs GetSimplifiedPageState hands out
+var refPattern = regexp.MustCompile(`^e[0-9]+$`)
+
+// jsString returns s as a JavaScript string literal. Go's %q isn't one: it
+// writes escapes like \a and \U000e0001 that JavaScript reads differently.
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// refTarget is where resolveRef found an element
+type refTarget struct {
+	X     int    `json:"x"`
+	Y     int    `json:"y"`
+	Error string `json:"error"`
+}
+
+// resolveRef finds the element with the given ref and scrolls it into view.
+// With focus set it also focuses the element and selects its content, so
+// typed text replaces it. Must be called with b.mu held.
+func (b *Browser) resolveRef(ctx context.Context, ref string, focus bool) (*refTarget, error) {
+	if !refPattern.MatchString(ref) {
+		return nil, fmt.Errorf("invalid element ref %q", ref)
+	}
+
+	jsCode := fmt.Sprintf(`
+		(function() {
+			var el = document.querySelector('[data-wc-ref="' + %s + '"]');
+			if (!el || !el.isConnected) return { error: 'stale' };
+
+			el.scrollIntoView({ block: 'center', inline: 'center', behavior: 'instant' });
+			var r = el.getBoundingClientRect();
+			if (r.width === 0 && r.height === 0) return { error: 'hidden' };
+			if (el.disabled) return { error: 'disabled' };
+
+			if (%t) {
+				var editable = el.tagName === 'TEXTAREA' || el.isContentEditable ||
+					(el.tagName === 'INPUT' && typeof el.select === 'function');
+				if (!editable) return { error: 'not_editable' };
+				el.focus();
+				if (el.isContentEditable) {
+					var range = document.createRange();
+					range.selectNodeContents(el);
+					var sel = window.getSelection();
+					sel.removeAllRanges();
+					sel.addRange(range);
+				} else {
+					el.select();
+				}
+			}
+			return { x: Math.round(r.x + r.width/2), y: Math.round(r.y + r.height/2) };
+		})()
+	`, jsString(ref), focus)
+
+	var target refTarget
+	if err := chromedp.Run(ctx, chromedp.Evaluate(jsCode, &target)); err != nil {
+		return nil, err
+	}
+	switch target.Error {
+	case "":
+		return &target, nil
+	case "stale":
+		return nil, fmt.Errorf("%w: %s", ErrStaleRef, ref)
+	case "hidden":
+		return nil, fmt.Errorf("element %s is not visible", ref)
+	case "disabled":
+		return nil, fmt.Errorf("element %s is disabled", ref)
+	case "not_editable":
+		return nil, fmt.Errorf("element %s does not accept text", ref)
+	}
+	return nil, fmt.Errorf("element %s: %s", ref, target.Error)
+}
+
+// ClickRef scrolls the element with the given ref into view and clicks its
+// center
+func (b *Browser) ClickRef(ref string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	target, err := b.resolveRef(ctx, ref, false)
+	if err != nil {
+		return err
+	}
+	return chromedp.Run(ctx,
+		chromedp.MouseClickXY(float64(target.X), float64(target.Y)),
+	)
+}
+
+// TypeRef replaces the content of the input with the given ref by value,
+// typed like InputToFocused
+func (b *Browser) TypeRef(ref, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := b.resolveRef(ctx, ref, true); err != nil {
+		return err
+	}
+	if value == "" {
+		// Nothing to type over the selection, so delete it
+		return chromedp.Run(ctx, chromedp.KeyEvent(kb.Backspace))
+	}
+	return chromedp.Run(ctx,
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			return input.InsertText(value).Do(ctx)
+		}),
+	)
+}
+
+// SelectRef selects the option with the given value, or else the given
+// text, in the dropdown with the given ref
+func (b *Browser) SelectRef(ref, value, text string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := b.resolveRef(ctx, ref, false); err != nil {
+		return err
+	}
+
+	jsCode := fmt.Sprintf(`
+		(function() {
+			var select = document.querySelector('[data-wc-ref="' + %s + '"]');
+			var optValue = %s;
+			var optText = %s;
+			if (!select) return 'stale';
+			if (select.tagName !== 'SELECT') return 'not_select';
+
+			for (var i = 0; i < select.options.length; i++) {
+				var opt = select.options[i];
+				if ((optValue && opt.value === optValue) || (optText && opt.text === optText)) {
+					select.selectedIndex = i;
+					select.dispatchEvent(new Event('input', { bubbles: true }));
+					select.dispatchEvent(new Event('change', { bubbles: true }));
+					return '';
+				}
+			}
+			return 'no_option';
+		})()
+	`, jsString(ref), jsString(value), jsString(text))
+
+	var result string
+	if err := chromedp.Run(ctx, chromedp.Evaluate(jsCode, &result)); err != nil {
+		return err
+	}
+	switch result {
+	case "":
+		return nil
+	case "stale":
+		return fmt.Errorf("%w: %s", ErrStaleRef, ref)
+	case "not_select":
+		return fmt.Errorf("element %s is not a dropdown", ref)
+	}
+	return fmt.Errorf("option not found in %s: value=%s text=%s", ref, value, text)
+}
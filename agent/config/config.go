@@ -10,6 +10,11 @@ type Config struct {
 	ServerURL  string `json:"server_url"`
 	AgentToken string `json:"agent_token"`
 	AgentName  string `json:"agent_name"`
+
+	// End-to-end encryption with paired user devices
+	E2EEnabled    bool              `json:"e2e_enabled,omitempty"`
+	E2EPrivateKey string            `json:"e2e_private_key,omitempty"`
+	E2EDevices    map[string]string `json:"e2e_devices,omitempty"` // device ID -> public key
 }
 
 func GetConfigPath() string {
@@ -0,0 +1,202 @@
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// End-to-end encryption between the agent and paired user devices.
+//
+// Each side has a P-256 key pair. The AES-256-GCM session key is derived
+// with HKDF-SHA256 from the ECDH shared secret, so the relay server only
+// ever sees public keys and ciphertext. The scheme matches what the browser
+// implements with WebCrypto in static/js/e2e.js.
+
+const hkdfInfo = "weekend-chart e2e v1"
+
+// Directions used as additional authenticated data, so a message can't be
+// reflected back to its sender
+const (
+	ToAgent  = "to-agent"
+	ToDevice = "to-device"
+)
+
+// Envelope is the unencrypted routing wrapper around an encrypted message
+type Envelope struct {
+	Type       string `json:"type"`
+	DeviceID   string `json:"device_id"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// GenerateKey creates a new private key, returned base64 encoded
+func GenerateKey() (string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), nil
+}
+
+// PublicKey returns the base64 encoded uncompressed public key for a private key
+func PublicKey(privateKey string) (string, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// Fingerprint returns a short human-comparable fingerprint of a public key
+func Fingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(publicKey))
+	h := hex.EncodeToString(sum[:8])
+	return h[0:4] + "-" + h[4:8] + "-" + h[8:12] + "-" + h[12:16]
+}
+
+// SessionKey derives the shared AES key between our private key and a peer's public key
+func SessionKey(privateKey, peerPublicKey string) ([]byte, error) {
+	priv, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(peerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %w", err)
+	}
+	pub, err := ecdh.P256().NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, secret, nil, hkdfInfo, 32)
+}
+
+// Seal encrypts plaintext for the given device and direction
+func Seal(key []byte, deviceID, direction string, plaintext []byte) (*Envelope, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nil, nonce, plaintext, []byte(direction+":"+deviceID))
+	return &Envelope{
+		Type:       "e2e",
+		DeviceID:   deviceID,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}, nil
+}
+
+// Open decrypts an envelope sent in the given direction
+func Open(key []byte, env *Envelope, direction string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(env.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext encoding")
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, []byte(direction+":"+env.DeviceID))
+}
+
+// MaxMessageAge is how far the send time of a message a ReplayGuard opens
+// may be from the receiver's clock
+const MaxMessageAge = 5 * time.Minute
+
+// ReplayGuard opens each envelope at most once, so the relay can't resend a
+// command it has seen. Messages carry their send time in a sent_at field
+// (Unix milliseconds), so nonces only need to be kept for MaxMessageAge.
+type ReplayGuard struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // Device ID and nonce -> send time
+	now  func() time.Time
+}
+
+// NewReplayGuard creates a guard that has seen no messages
+func NewReplayGuard() *ReplayGuard {
+	return &ReplayGuard{seen: make(map[string]time.Time), now: time.Now}
+}
+
+// Open decrypts an envelope like Open, and rejects it if it was opened
+// before or was sent too long ago
+func (g *ReplayGuard) Open(key []byte, env *Envelope, direction string) ([]byte, error) {
+	plaintext, err := Open(key, env, direction)
+	if err != nil {
+		return nil, err
+	}
+
+	var stamp struct {
+		SentAt int64 `json:"sent_at"`
+	}
+	if json.Unmarshal(plaintext, &stamp) != nil || stamp.SentAt == 0 {
+		return nil, fmt.Errorf("message has no send time")
+	}
+	sentAt := time.UnixMilli(stamp.SentAt)
+	now := g.now()
+	if age := now.Sub(sentAt); age > MaxMessageAge || age < -MaxMessageAge {
+		return nil, fmt.Errorf("message sent at %s is outside the accepted window", sentAt.Format(time.RFC3339))
+	}
+
+	// Open already checked the nonce decodes. The raw bytes are the key, as
+	// the decoder accepts more than one encoding of them (it skips newlines).
+	nonce, _ := base64.StdEncoding.DecodeString(env.Nonce)
+	id := env.DeviceID + ":" + string(nonce)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for seenID, seenAt := range g.seen {
+		// Too old to pass the check above anyway
+		if now.Sub(seenAt) > MaxMessageAge {
+			delete(g.seen, seenID)
+		}
+	}
+	if _, ok := g.seen[id]; ok {
+		return nil, fmt.Errorf("message was already received")
+	}
+	g.seen[id] = sentAt
+	return plaintext, nil
+}
+
+func parsePrivateKey(privateKey string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key encoding: %w", err)
+	}
+	return ecdh.P256().NewPrivateKey(raw)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,209 @@
+package e2e
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pair returns the session keys an agent and a device derive from each
+// other's public keys
+func pair(t *testing.T) (agentKey, deviceKey []byte) {
+	t.Helper()
+	agentPriv, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generate agent key: %v", err)
+	}
+	devicePriv, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("generate device key: %v", err)
+	}
+	agentPub, _ := PublicKey(agentPriv)
+	devicePub, _ := PublicKey(devicePriv)
+
+	agentKey, err = SessionKey(agentPriv, devicePub)
+	if err != nil {
+		t.Fatalf("agent session key: %v", err)
+	}
+	deviceKey, err = SessionKey(devicePriv, agentPub)
+	if err != nil {
+		t.Fatalf("device session key: %v", err)
+	}
+	return agentKey, deviceKey
+}
+
+// command returns a command as the browser sends it, stamped with sentAt
+func command(sentAt time.Time) []byte {
+	return []byte(fmt.Sprintf(`{"type":"navigate","url":"https://example.com/","sent_at":%d}`, sentAt.UnixMilli()))
+}
+
+func TestRoundTrip(t *testing.T) {
+	agentKey, deviceKey := pair(t)
+	if !bytes.Equal(agentKey, deviceKey) {
+		t.Fatal("agent and device derived different session keys")
+	}
+
+	for _, direction := range []string{ToAgent, ToDevice} {
+		plaintext := []byte(`{"type":"screenshot","image":"aW1hZ2U="}`)
+		env, err := Seal(deviceKey, "device-1", direction, plaintext)
+		if err != nil {
+			t.Fatalf("seal %s: %v", direction, err)
+		}
+		if env.Type != "e2e" || env.DeviceID != "device-1" || strings.Contains(env.Ciphertext, "screenshot") {
+			t.Errorf("envelope = %+v", env)
+		}
+		got, err := Open(agentKey, env, direction)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("open %s = %q, %v", direction, got, err)
+		}
+	}
+
+	// Every message has its own nonce
+	a, _ := Seal(deviceKey, "device-1", ToAgent, []byte("same"))
+	b, _ := Seal(deviceKey, "device-1", ToAgent, []byte("same"))
+	if a.Nonce == b.Nonce || a.Ciphertext == b.Ciphertext {
+		t.Error("two messages share a nonce")
+	}
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	_, deviceKey := pair(t)
+	otherKey, _ := pair(t)
+
+	env, _ := Seal(deviceKey, "device-1", ToAgent, []byte("secret"))
+	if _, err := Open(otherKey, env, ToAgent); err == nil {
+		t.Error("opened with another pair's key")
+	}
+	if _, err := Open(nil, env, ToAgent); err == nil {
+		t.Error("opened with no key")
+	}
+}
+
+func TestSessionKeyRejectsInvalidPublicKeys(t *testing.T) {
+	priv, _ := GenerateKey()
+	for _, pub := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("short")),
+		base64.StdEncoding.EncodeToString(make([]byte, 65))} {
+		if _, err := SessionKey(priv, pub); err == nil {
+			t.Errorf("SessionKey accepted public key %q", pub)
+		}
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	agentKey, deviceKey := pair(t)
+	env, err := Seal(deviceKey, "device-1", ToAgent, []byte(`{"type":"click_xy","x":10,"y":20}`))
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	flip := func(s string, i int) string {
+		raw, _ := base64.StdEncoding.DecodeString(s)
+		raw[i] ^= 1
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	tests := []struct {
+		name   string
+		tamper func(e Envelope) Envelope
+	}{
+		{"ciphertext", func(e Envelope) Envelope { e.Ciphertext = flip(e.Ciphertext, 0); return e }},
+		{"tag", func(e Envelope) Envelope {
+			raw, _ := base64.StdEncoding.DecodeString(e.Ciphertext)
+			e.Ciphertext = flip(e.Ciphertext, len(raw)-1)
+			return e
+		}},
+		{"nonce", func(e Envelope) Envelope { e.Nonce = flip(e.Nonce, 0); return e }},
+		{"truncated", func(e Envelope) Envelope {
+			raw, _ := base64.StdEncoding.DecodeString(e.Ciphertext)
+			e.Ciphertext = base64.StdEncoding.EncodeToString(raw[:len(raw)-1])
+			return e
+		}},
+		{"device ID", func(e Envelope) Envelope { e.DeviceID = "device-2"; return e }},
+		{"short nonce", func(e Envelope) Envelope { e.Nonce = base64.StdEncoding.EncodeToString([]byte("short")); return e }},
+		{"bad encoding", func(e Envelope) Envelope { e.Ciphertext = "%%%"; return e }},
+	}
+	for _, tt := range tests {
+		tampered := tt.tamper(*env)
+		if _, err := Open(agentKey, &tampered, ToAgent); err == nil {
+			t.Errorf("opened envelope with tampered %s", tt.name)
+		}
+	}
+
+	// A message can't be reflected back in the other direction
+	if _, err := Open(agentKey, env, ToDevice); err == nil {
+		t.Error("opened a message sent to the agent as one sent to the device")
+	}
+}
+
+func TestReplayGuard(t *testing.T) {
+	agentKey, deviceKey := pair(t)
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	g := NewReplayGuard()
+	g.now = func() time.Time { return now }
+
+	env, _ := Seal(deviceKey, "device-1", ToAgent, command(now))
+	if _, err := g.Open(agentKey, env, ToAgent); err != nil {
+		t.Fatalf("first open: %v", err)
+	}
+	if _, err := g.Open(agentKey, env, ToAgent); err == nil {
+		t.Error("opened the same envelope twice")
+	}
+
+	// The same nonce encoded differently is still the same message
+	reencoded := *env
+	reencoded.Nonce = env.Nonce[:8] + "\n" + env.Nonce[8:]
+	if _, err := g.Open(agentKey, &reencoded, ToAgent); err == nil {
+		t.Error("opened a replay with a re-encoded nonce")
+	}
+
+	// A new message with the same content is fine
+	again, _ := Seal(deviceKey, "device-1", ToAgent, command(now))
+	if _, err := g.Open(agentKey, again, ToAgent); err != nil {
+		t.Errorf("second message: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{"no send time", []byte(`{"type":"navigate","url":"https://example.com/"}`)},
+		{"not JSON", []byte("navigate")},
+		{"too old", command(now.Add(-MaxMessageAge - time.Second))},
+		{"too far ahead", command(now.Add(MaxMessageAge + time.Second))},
+	}
+	for _, tt := range tests {
+		env, _ := Seal(deviceKey, "device-1", ToAgent, tt.plaintext)
+		if _, err := g.Open(agentKey, env, ToAgent); err == nil {
+			t.Errorf("opened message with %s", tt.name)
+		}
+	}
+
+	// Once a message is too old to pass, its nonce is forgotten
+	now = now.Add(MaxMessageAge + time.Minute)
+	fresh, _ := Seal(deviceKey, "device-1", ToAgent, command(now))
+	if _, err := g.Open(agentKey, fresh, ToAgent); err != nil {
+		t.Fatalf("fresh message: %v", err)
+	}
+	if len(g.seen) != 1 {
+		t.Errorf("guard keeps %d nonces, want 1", len(g.seen))
+	}
+	if _, err := g.Open(agentKey, env, ToAgent); err == nil {
+		t.Error("opened the first envelope after its nonce was forgotten")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	priv, _ := GenerateKey()
+	pub, _ := PublicKey(priv)
+	fp := Fingerprint(pub)
+	if len(fp) != 19 || strings.Count(fp, "-") != 3 || fp != Fingerprint(pub) {
+		t.Errorf("fingerprint = %q", fp)
+	}
+	other, _ := GenerateKey()
+	otherPub, _ := PublicKey(other)
+	if Fingerprint(otherPub) == fp {
+		t.Error("two keys have the same fingerprint")
+	}
+}
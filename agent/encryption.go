@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"weekend-chart/agent/config"
+	"weekend-chart/agent/e2e"
+	"weekend-chart/agent/tray"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// sessionKeys caches the derived AES key for each paired device
+	sessionKeys   = make(map[string][]byte)
+	sessionKeysMu sync.Mutex
+
+	// pendingDevices are device keys waiting for the user to confirm them
+	pendingDevices   = make(map[string]string)
+	pendingDevicesMu sync.Mutex
+
+	// replayGuard rejects commands the relay resends
+	replayGuard = e2e.NewReplayGuard()
+
+	// confirmInput is where the user answers; confirmMu asks one at a time
+	confirmInput = bufio.NewReader(os.Stdin)
+	confirmMu    sync.Mutex
+)
+
+// actionTypes change browser state; in E2E mode they are only accepted encrypted,
+// so the relay server can't inject commands
+var actionTypes = map[string]bool{
+	"navigate":      true,
+	"click":         true,
+	"click_xy":      true,
+	"input":         true,
+	"key":           true,
+	"select_all":    true,
+	"scroll":        true,
+	"select_option": true,
+	"mouse_move":    true,
+	"drag":          true,
+	"run_actions":   true,
+}
+
+// ensureE2EKey creates the agent's key pair on first use and returns its public key
+func ensureE2EKey() string {
+	if cfg.E2EPrivateKey == "" {
+		key, err := e2e.GenerateKey()
+		if err != nil {
+			log.Printf("無法產生加密金鑰: %v", err)
+			return ""
+		}
+		cfg.E2EPrivateKey = key
+		config.Save(cfg)
+	}
+
+	pub, err := e2e.PublicKey(cfg.E2EPrivateKey)
+	if err != nil {
+		log.Printf("加密金鑰無效: %v", err)
+		return ""
+	}
+	return pub
+}
+
+// requestE2EDevice asks the user to trust a device's public key. The key
+// reaches the agent through the relay server, which could have swapped in
+// its own, so it is only trusted once the user confirms that its fingerprint
+// matches the one the device shows. A device ID keeps the key it was first
+// trusted with.
+func requestE2EDevice(deviceID, publicKey string) {
+	if deviceID == "" || publicKey == "" {
+		return
+	}
+	ensureE2EKey()
+	if _, err := e2e.SessionKey(cfg.E2EPrivateKey, publicKey); err != nil {
+		log.Printf("已拒絕裝置 %s 的無效金鑰: %v", deviceID, err)
+		return
+	}
+
+	sessionKeysMu.Lock()
+	_, trusted := cfg.E2EDevices[deviceID]
+	sessionKeysMu.Unlock()
+	if trusted {
+		log.Printf("裝置 %s 已有金鑰，不會替換", deviceID)
+		return
+	}
+
+	pendingDevicesMu.Lock()
+	_, waiting := pendingDevices[deviceID]
+	if !waiting {
+		pendingDevices[deviceID] = publicKey
+	}
+	pendingDevicesMu.Unlock()
+	if !waiting {
+		go confirmE2EDevice(deviceID, publicKey)
+	}
+}
+
+// confirmE2EDevice shows the fingerprints in the console and trusts the
+// device if the user confirms them. Requests are asked one at a time.
+func confirmE2EDevice(deviceID, publicKey string) {
+	confirmMu.Lock()
+	defer confirmMu.Unlock()
+	defer func() {
+		pendingDevicesMu.Lock()
+		delete(pendingDevices, deviceID)
+		pendingDevicesMu.Unlock()
+	}()
+
+	tray.ShowConsole()
+	fmt.Println()
+	fmt.Println("新的裝置要求加密連線")
+	fmt.Printf("  裝置指紋: %s\n", e2e.Fingerprint(publicKey))
+	fmt.Printf("  本機指紋: %s\n", e2e.Fingerprint(ensureE2EKey()))
+	fmt.Println("  請確認與手機上顯示的指紋相同")
+	fmt.Print("指紋相同請輸入 y 並按 Enter，否則直接按 Enter 拒絕: ")
+
+	answer, err := confirmInput.ReadString('\n')
+	if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+		fmt.Println("已拒絕此裝置")
+		fmt.Println()
+		return
+	}
+	if err := trustE2EDevice(deviceID, publicKey); err != nil {
+		fmt.Printf("無法信任此裝置: %v\n", err)
+		fmt.Println()
+		return
+	}
+	fmt.Println("✓ 已信任此裝置")
+	fmt.Println()
+}
+
+// trustE2EDevice stores a confirmed device key and enables E2E mode
+func trustE2EDevice(deviceID, publicKey string) error {
+	sessionKeysMu.Lock()
+	if cfg.E2EDevices == nil {
+		cfg.E2EDevices = make(map[string]string)
+	}
+	if _, ok := cfg.E2EDevices[deviceID]; ok {
+		sessionKeysMu.Unlock()
+		return fmt.Errorf("裝置 %s 已有金鑰", deviceID)
+	}
+	cfg.E2EDevices[deviceID] = publicKey
+	cfg.E2EEnabled = true
+	delete(sessionKeys, deviceID)
+	sessionKeysMu.Unlock()
+
+	return config.Save(cfg)
+}
+
+func deviceSessionKey(deviceID string) ([]byte, error) {
+	sessionKeysMu.Lock()
+	defer sessionKeysMu.Unlock()
+
+	if key, ok := sessionKeys[deviceID]; ok {
+		return key, nil
+	}
+
+	publicKey, ok := cfg.E2EDevices[deviceID]
+	if !ok {
+		return nil, fmt.Errorf("unknown device %s", deviceID)
+	}
+
+	key, err := e2e.SessionKey(cfg.E2EPrivateKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sessionKeys[deviceID] = key
+	return key, nil
+}
+
+// openEnvelope decrypts a message sent by a user device
+func openEnvelope(msg Message) (*Message, error) {
+	key, err := deviceSessionKey(msg.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := replayGuard.Open(key, &e2e.Envelope{
+		DeviceID:   msg.DeviceID,
+		Nonce:      msg.Nonce,
+		Ciphertext: msg.Ciphertext,
+	}, e2e.ToAgent)
+	if err != nil {
+		return nil, err
+	}
+
+	var inner Message
+	if err := json.Unmarshal(plaintext, &inner); err != nil {
+		return nil, err
+	}
+	inner.encrypted = true
+	return &inner, nil
+}
+
+// sendToDevices sends page content to the user. In E2E mode it is encrypted
+// separately for every paired device instead of being sent in plaintext.
+func sendToDevices(payload []byte) error {
+	if !cfg.E2EEnabled {
+		return safeWriteMessage(websocket.TextMessage, payload)
+	}
+
+	sessionKeysMu.Lock()
+	deviceIDs := make([]string, 0, len(cfg.E2EDevices))
+	for id := range cfg.E2EDevices {
+		deviceIDs = append(deviceIDs, id)
+	}
+	sessionKeysMu.Unlock()
+
+	for _, id := range deviceIDs {
+		key, err := deviceSessionKey(id)
+		if err != nil {
+			log.Printf("無法建立裝置 %s 的加密金鑰: %v", id, err)
+			continue
+		}
+		env, err := e2e.Seal(key, id, e2e.ToDevice, payload)
+		if err != nil {
+			return err
+		}
+		msg, _ := json.Marshal(env)
+		if err := safeWriteMessage(websocket.TextMessage, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
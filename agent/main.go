@@ -16,6 +16,8 @@ import (
 
 	"weekend-chart/agent/browser"
 	"weekend-chart/agent/config"
+	"weekend-chart/agent/policy"
+	"weekend-chart/agent/secrets"
 	"weekend-chart/agent/tray"
 
 	"github.com/gorilla/websocket"
@@ -35,8 +37,32 @@ func init() {
 
 const (
 	ServerURL = "wss://wake.loader.land/ws/agent"
+
+	// ProtocolVersion is the agent/server protocol version this agent speaks
+	ProtocolVersion = 1
+	AgentVersion    = "1.1.0"
 )
 
+// capabilities lists the message types this agent knows how to handle
+var capabilities = []string{
+	"navigate",
+	"click",
+	"click_xy",
+	"input",
+	"key",
+	"scroll",
+	"request_screenshot",
+	"select_all",
+	"get_page_state",
+	"select_option",
+	"e2e",
+	"url_policy",
+	"secrets",
+	"computer_use",
+	"run_actions",
+	"element_refs",
+}
+
 type Message struct {
 	Type string `json:"type"`
 	// Flat fields for different message types
@@ -50,12 +76,34 @@ type Message struct {
 	Amount      int    `json:"amount,omitempty"`
 	OptionValue string `json:"option_value,omitempty"`
 	OptionText  string `json:"option_text,omitempty"`
+	Button      string `json:"button,omitempty"`
+	ClickCount  int    `json:"click_count,omitempty"`
+	ToX         int    `json:"to_x,omitempty"`
+	ToY         int    `json:"to_y,omitempty"`
+	// Element ref from get_page_state, for click_ref, input_ref and select_ref
+	Ref string `json:"ref,omitempty"`
+	// For run_actions; each step is a command of its own
+	RequestID string    `json:"request_id,omitempty"`
+	Steps     []Message `json:"steps,omitempty"`
+	WaitMs    int       `json:"wait_ms,omitempty"`
+	// For end-to-end encryption
+	E2E             bool   `json:"e2e,omitempty"`
+	DeviceID        string `json:"device_id,omitempty"`
+	DevicePublicKey string `json:"device_public_key,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	Ciphertext      string `json:"ciphertext,omitempty"`
 	// For responses from server
 	Data json.RawMessage `json:"data,omitempty"`
+
+	// Set when the message arrived inside an E2E envelope
+	encrypted bool
 }
 
 type AuthData struct {
-	Token string `json:"token"`
+	Token           string   `json:"token"`
+	ProtocolVersion int      `json:"protocol_version"`
+	AgentVersion    string   `json:"agent_version"`
+	Capabilities    []string `json:"capabilities"`
 }
 
 var (
@@ -64,6 +112,15 @@ var (
 	connMu   sync.Mutex // Protects WebSocket writes
 	chrome   *browser.Browser
 	paired   bool
+
+	// urlPolicy limits which pages the browser may open, set by the server
+	urlPolicy policy.URLPolicy
+
+	// vault fills in {{secret:name}} placeholders, set by the server
+	vault secrets.Store
+
+	// reconnectDelay is set when the server announces a restart
+	reconnectDelay time.Duration
 )
 
 func main() {
@@ -134,6 +191,9 @@ func main() {
 	fmt.Println("瀏覽器已啟動")
 	fmt.Println()
 
+	// Navigations the server didn't ask for, like link clicks, are checked here
+	chrome.WatchNavigations(enforceURLPolicy)
+
 	// Handle shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -189,8 +249,14 @@ func runAgent() {
 		}
 		handleMessages()
 		tray.SetStatus("狀態: 已斷線")
-		fmt.Println("連線中斷，重新連線...")
-		time.Sleep(3 * time.Second)
+
+		delay := 3 * time.Second
+		if reconnectDelay > 0 {
+			delay = reconnectDelay
+			reconnectDelay = 0
+		}
+		fmt.Printf("連線中斷，%d 秒後重新連線...\n", int(delay.Seconds()))
+		time.Sleep(delay)
 	}
 }
 
@@ -202,7 +268,12 @@ func connect() error {
 	}
 
 	// Send auth
-	authData, _ := json.Marshal(AuthData{Token: cfg.AgentToken})
+	authData, _ := json.Marshal(AuthData{
+		Token:           cfg.AgentToken,
+		ProtocolVersion: ProtocolVersion,
+		AgentVersion:    AgentVersion,
+		Capabilities:    capabilities,
+	})
 	authMsg, _ := json.Marshal(Message{
 		Type: "auth",
 		Data: authData,
@@ -229,7 +300,9 @@ func connect() error {
 }
 
 func requestPairingCode() {
-	msg, _ := json.Marshal(Message{Type: "request_pairing_code"})
+	// Offer our public key so the user can opt into end-to-end encryption
+	data, _ := json.Marshal(map[string]string{"e2e_public_key": ensureE2EKey()})
+	msg, _ := json.Marshal(Message{Type: "request_pairing_code", Data: data})
 	safeWriteMessage(websocket.TextMessage, msg)
 }
 
@@ -255,7 +328,38 @@ func handleMessages() {
 }
 
 func handleMessage(msg Message) {
+	// In E2E mode, state-changing commands must come from a paired device
+	if cfg.E2EEnabled && actionTypes[msg.Type] && !msg.encrypted {
+		log.Printf("已拒絕未加密的指令: %s", msg.Type)
+		return
+	}
+
 	switch msg.Type {
+	case "e2e":
+		inner, err := openEnvelope(msg)
+		if err != nil {
+			log.Printf("無法解密訊息: %v", err)
+			return
+		}
+		handleMessage(*inner)
+
+	case "e2e_add_device":
+		if !cfg.E2EEnabled {
+			return
+		}
+		requestE2EDevice(msg.DeviceID, msg.DevicePublicKey)
+
+	case "auth_ok":
+		var info struct {
+			ProtocolVersion         int `json:"protocol_version"`
+			MinAgentProtocolVersion int `json:"min_agent_protocol_version"`
+		}
+		json.Unmarshal(msg.Data, &info)
+		log.Printf("伺服器協定版本: %d (本機: %d)", info.ProtocolVersion, ProtocolVersion)
+		if ProtocolVersion < info.MinAgentProtocolVersion {
+			fmt.Println("警告: Agent 版本過舊，請下載最新版本")
+		}
+
 	case "pairing_code":
 		var code struct {
 			Code      string `json:"code"`
@@ -273,11 +377,50 @@ func handleMessage(msg Message) {
 		fmt.Println("╚═══════════════════════════════════════════╝")
 		fmt.Println()
 
+	case "server_shutdown":
+		var notice struct {
+			ReconnectAfter int `json:"reconnect_after"`
+		}
+		json.Unmarshal(msg.Data, &notice)
+		reconnectDelay = time.Duration(notice.ReconnectAfter) * time.Second
+		log.Printf("伺服器即將重新啟動，%d 秒後重新連線", notice.ReconnectAfter)
+
+	case "set_policy":
+		var p struct {
+			AllowedURLs []string `json:"allowed_urls"`
+			BlockedURLs []string `json:"blocked_urls"`
+		}
+		if err := json.Unmarshal(msg.Data, &p); err != nil {
+			log.Printf("無法讀取網址政策: %v", err)
+			return
+		}
+		urlPolicy.Set(p.AllowedURLs, p.BlockedURLs)
+		log.Printf("網址政策已更新: 允許 %d 項, 封鎖 %d 項", len(p.AllowedURLs), len(p.BlockedURLs))
+
+	case "set_secrets":
+		var data struct {
+			Secrets map[string]string `json:"secrets"`
+		}
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			log.Printf("無法讀取密碼: %v", err)
+			return
+		}
+		vault.Set(data.Secrets)
+		log.Printf("已更新 %d 組密碼", vault.Len())
+
 	case "paired":
 		paired = true
 		config.Save(cfg)
 		fmt.Println("✓ 配對成功！")
 		fmt.Println()
+		if msg.E2E {
+			// Plaintext commands are refused from now on, but the device
+			// can only send encrypted ones once the user confirms its key
+			cfg.E2EEnabled = true
+			config.Save(cfg)
+			fmt.Println("✓ 已啟用端對端加密")
+			requestE2EDevice(msg.DeviceID, msg.DevicePublicKey)
+		}
 
 	case "navigate":
 		log.Printf("導航至: %s", msg.URL)
@@ -285,6 +428,11 @@ func handleMessage(msg Message) {
 			log.Printf("導航失敗: URL 為空")
 			return
 		}
+		if ok, reason := urlPolicy.Check(msg.URL); !ok {
+			log.Printf("導航已阻止: %s (%s)", msg.URL, reason)
+			reportPolicyViolation(msg.URL, reason)
+			return
+		}
 		if err := chrome.Navigate(msg.URL); err != nil {
 			log.Printf("導航失敗: %v", err)
 		} else {
@@ -303,19 +451,43 @@ func handleMessage(msg Message) {
 
 	case "click_xy":
 		log.Printf("點擊座標: (%d, %d)", msg.X, msg.Y)
-		if err := chrome.ClickXY(msg.X, msg.Y); err != nil {
+		var err error
+		if msg.Button != "" || msg.ClickCount > 1 {
+			err = chrome.MouseClick(msg.X, msg.Y, msg.Button, msg.ClickCount)
+		} else {
+			err = chrome.ClickXY(msg.X, msg.Y)
+		}
+		if err != nil {
 			log.Printf("點擊失敗: %v", err)
 		}
 		time.Sleep(500 * time.Millisecond)
 		sendCurrentState()
 
+	case "mouse_move":
+		log.Printf("移動滑鼠: (%d, %d)", msg.X, msg.Y)
+		if err := chrome.MouseMove(msg.X, msg.Y); err != nil {
+			log.Printf("移動滑鼠失敗: %v", err)
+		}
+		sendCurrentState()
+
+	case "drag":
+		log.Printf("拖曳: (%d, %d) -> (%d, %d)", msg.X, msg.Y, msg.ToX, msg.ToY)
+		if err := chrome.Drag(msg.X, msg.Y, msg.ToX, msg.ToY); err != nil {
+			log.Printf("拖曳失敗: %v", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+		sendCurrentState()
+
 	case "input":
-		log.Printf("輸入: %s", msg.Value)
-		var err error
-		if msg.Selector != "" {
-			err = chrome.Input(msg.Selector, msg.Value)
-		} else {
-			err = chrome.InputToFocused(msg.Value)
+		// Log the placeholders, never the values they stand for
+		log.Printf("輸入: %s", vault.LogText(msg.Value))
+		value, err := vault.Resolve(msg.Value)
+		if err == nil {
+			if msg.Selector != "" {
+				err = chrome.Input(msg.Selector, value)
+			} else {
+				err = chrome.InputToFocused(value)
+			}
 		}
 		if err != nil {
 			log.Printf("輸入失敗: %v", err)
@@ -357,6 +529,10 @@ func handleMessage(msg Message) {
 		time.Sleep(300 * time.Millisecond)
 		sendCurrentState()
 
+	case "run_actions":
+		log.Printf("執行 %d 個步驟", len(msg.Steps))
+		runActions(msg.RequestID, msg.Steps)
+
 	case "select_option":
 		log.Printf("選擇選項: selector=%s value=%s text=%s", msg.Selector, msg.OptionValue, msg.OptionText)
 		if err := chrome.SelectOption(msg.Selector, msg.OptionValue, msg.OptionText); err != nil {
@@ -377,10 +553,10 @@ func sendDOMUpdate(state *browser.PageState) {
 		"type":  "dom_update",
 		"url":   state.URL,
 		"title": state.Title,
-		"html":  state.HTML,
+		"html":  vault.Redact(state.HTML),
 	})
 
-	safeWriteMessage(websocket.TextMessage, msg)
+	sendToDevices(msg)
 }
 
 func sendScreenshot() {
@@ -407,6 +583,7 @@ func sendScreenshot() {
 	msg, err := json.Marshal(map[string]interface{}{
 		"type":   "screenshot",
 		"url":    ss.URL,
+		"title":  ss.Title,
 		"image":  ss.Image,
 		"width":  ss.Width,
 		"height": ss.Height,
@@ -417,7 +594,7 @@ func sendScreenshot() {
 	}
 
 	log.Printf("sendScreenshot: 發送中... (size=%d)", len(msg))
-	if err := safeWriteMessage(websocket.TextMessage, msg); err != nil {
+	if err := sendToDevices(msg); err != nil {
 		log.Printf("sendScreenshot: 發送失敗: %v", err)
 	} else {
 		log.Printf("sendScreenshot: 發送成功")
@@ -456,6 +633,7 @@ func sendPageState() {
 		return
 	}
 
+	redactPageState(state)
 	msg, err := json.Marshal(map[string]interface{}{
 		"type":  "page_state",
 		"state": state,
@@ -466,13 +644,50 @@ func sendPageState() {
 	}
 
 	log.Printf("sendPageState: 發送中... (size=%d)", len(msg))
-	if err := safeWriteMessage(websocket.TextMessage, msg); err != nil {
+	if err := sendToDevices(msg); err != nil {
 		log.Printf("sendPageState: 發送失敗: %v", err)
 	} else {
 		log.Printf("sendPageState: 發送成功")
 	}
 }
 
+// redactPageState replaces secret values typed into the page with their
+// placeholders, so they don't reach the server or the AI
+func redactPageState(state *browser.SimplifiedPageState) {
+	state.FocusedElement = vault.Redact(state.FocusedElement)
+	state.Text = vault.Redact(state.Text)
+	for i := range state.Inputs {
+		state.Inputs[i].Value = vault.Redact(state.Inputs[i].Value)
+	}
+}
+
+// enforceURLPolicy leaves a page the URL policy doesn't allow and reports it
+func enforceURLPolicy(url string) {
+	ok, reason := urlPolicy.Check(url)
+	if ok {
+		return
+	}
+	log.Printf("已離開不允許的頁面: %s (%s)", url, reason)
+	if err := chrome.LeavePage(); err != nil {
+		log.Printf("離開頁面失敗: %v", err)
+	}
+	reportPolicyViolation(url, reason)
+	sendCurrentState()
+}
+
+// reportPolicyViolation tells the server a navigation was stopped. It goes
+// to the server itself, so it is never end-to-end encrypted.
+func reportPolicyViolation(url, reason string) {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":   "policy_violation",
+		"url":    url,
+		"reason": reason,
+	})
+	if err := safeWriteMessage(websocket.TextMessage, msg); err != nil {
+		log.Printf("回報政策違規失敗: %v", err)
+	}
+}
+
 func generateToken() string {
 	b := make([]byte, 16)
 	rand.Read(b)
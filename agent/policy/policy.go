@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"weekend-chart/internal/urlpattern"
+)
+
+// URLPolicy holds the URL patterns the server set for this agent. They are
+// matched with urlpattern, the same way the server matches them.
+type URLPolicy struct {
+	mu      sync.RWMutex
+	allowed []string
+	blocked []string
+}
+
+// Set replaces the patterns; empty lists allow every URL
+func (p *URLPolicy) Set(allowed, blocked []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allowed = allowed
+	p.blocked = blocked
+}
+
+// Check reports whether the browser may open rawURL, and why not. Only web
+// pages are checked; about:blank and the browser's own pages always pass.
+func (p *URLPolicy) Check(rawURL string) (bool, string) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return true, ""
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, pattern := range p.blocked {
+		if urlpattern.Match(pattern, rawURL) {
+			return false, "網址已被封鎖"
+		}
+	}
+	if len(p.allowed) == 0 {
+		return true, ""
+	}
+	for _, pattern := range p.allowed {
+		if urlpattern.Match(pattern, rawURL) {
+			return true, ""
+		}
+	}
+	return false, "網址不在允許的網站清單中"
+}
@@ -0,0 +1,70 @@
+// Package secrets holds the credentials the server sent for this agent and
+// fills them into the {{secret:name}} placeholders the model types.
+package secrets
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"weekend-chart/internal/secretref"
+)
+
+// Store holds the secret values the server sent for this agent. They only
+// live in memory and are never logged.
+type Store struct {
+	mu       sync.RWMutex
+	values   map[string]string
+	redactor *secretref.Redactor
+}
+
+// Set replaces all secrets
+func (s *Store) Set(values map[string]string) {
+	redactor := secretref.NewRedactor(values)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = values
+	s.redactor = redactor
+}
+
+// Len returns how many secrets are stored
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values)
+}
+
+// Resolve replaces the placeholders in text with their values. It fails
+// if a placeholder names an unknown secret.
+func (s *Store) Resolve(text string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	resolved, missing := secretref.Replace(text, func(name string) (string, bool) {
+		value, ok := s.values[name]
+		return value, ok
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("找不到密碼: %s", strings.Join(missing, ", "))
+	}
+	return resolved, nil
+}
+
+// Redact replaces secret values in text with their placeholders
+func (s *Store) Redact(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.redactor.Redact(text)
+}
+
+// LogText returns what may be logged of text that is about to be typed.
+// Text with placeholders is logged with its values redacted. Other text may
+// be a password the user typed that isn't stored, so only its length is.
+func (s *Store) LogText(text string) string {
+	if secretref.Contains(text) {
+		return s.Redact(text)
+	}
+	return fmt.Sprintf("(%d 個字元)", utf8.RuneCountInString(text))
+}
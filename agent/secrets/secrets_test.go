@@ -0,0 +1,37 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	var s Store
+	s.Set(map[string]string{"user": "alice", "pw": "alice-secret", "pin": "12"})
+
+	resolved, err := s.Resolve("{{secret:user}} / {{secret:pw}}")
+	if err != nil || resolved != "alice / alice-secret" {
+		t.Errorf("Resolve = %q, %v", resolved, err)
+	}
+	if _, err := s.Resolve("{{secret:missing}}"); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Resolve of an unknown secret: err = %v", err)
+	}
+
+	// The longer value is replaced whole; values that are too short are kept
+	if got := s.Redact("login alice with alice-secret, pin 12"); got != "login {{secret:user}} with {{secret:pw}}, pin 12" {
+		t.Errorf("Redact = %q", got)
+	}
+}
+
+func TestLogText(t *testing.T) {
+	var s Store
+	s.Set(map[string]string{"pw": "hunter22"})
+
+	if got := s.LogText("{{secret:pw}}\n"); got != "{{secret:pw}}\n" {
+		t.Errorf("LogText with a placeholder = %q", got)
+	}
+	// Text without placeholders may be an unstored password
+	if got := s.LogText("密碼hunter"); strings.Contains(got, "hunter") || !strings.Contains(got, "8") {
+		t.Errorf("LogText without placeholders = %q, want only the length", got)
+	}
+}
@@ -0,0 +1,92 @@
+// Package secretref defines the {{secret:name}} placeholders the model types
+// instead of stored credentials. The agent fills them in just before typing;
+// the server uses the same definitions to check and redact what the model
+// sees, so both sides agree on the format.
+package secretref
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// refPattern matches a placeholder such as {{secret:bank_pw}}
+var refPattern = regexp.MustCompile(`\{\{secret:([A-Za-z0-9_.-]+)\}\}`)
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// minRedactLength is the shortest value that is redacted from text; shorter
+// ones would match too much ordinary text
+const minRedactLength = 3
+
+// ValidName reports whether name can be used in a placeholder
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Placeholder returns the placeholder that stands for a secret
+func Placeholder(name string) string {
+	return "{{secret:" + name + "}}"
+}
+
+// Refs returns the names of the secrets text refers to
+func Refs(text string) []string {
+	var names []string
+	for _, m := range refPattern.FindAllStringSubmatch(text, -1) {
+		names = append(names, m[1])
+	}
+	return names
+}
+
+// Contains reports whether text has a placeholder
+func Contains(text string) bool {
+	return refPattern.MatchString(text)
+}
+
+// Replace replaces each placeholder in text with value(name). Placeholders
+// value has no value for are kept and their names returned as missing.
+func Replace(text string, value func(name string) (string, bool)) (replaced string, missing []string) {
+	replaced = refPattern.ReplaceAllStringFunc(text, func(ref string) string {
+		name := refPattern.FindStringSubmatch(ref)[1]
+		v, ok := value(name)
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return v
+	})
+	return replaced, missing
+}
+
+// Redactor replaces secret values in text with their placeholders
+type Redactor struct {
+	replacer *strings.Replacer
+}
+
+// NewRedactor creates a redactor for values, a map from name to value
+func NewRedactor(values map[string]string) *Redactor {
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		if len(value) >= minRedactLength {
+			names = append(names, name)
+		}
+	}
+	// Longer values first, so a value containing another is replaced whole
+	sort.Slice(names, func(i, j int) bool {
+		return len(values[names[i]]) > len(values[names[j]])
+	})
+
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, values[name], Placeholder(name))
+	}
+	return &Redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+// Redact replaces every secret value in text with its placeholder
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+	return r.replacer.Replace(text)
+}
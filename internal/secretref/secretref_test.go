@@ -0,0 +1,42 @@
+package secretref
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	got := Refs("{{secret:bank_user}} and {{secret:bank.pw}} but not {{secret:}} or {secret:x}")
+	if strings.Join(got, ",") != "bank_user,bank.pw" {
+		t.Errorf("Refs = %v", got)
+	}
+	if !ValidName("bank_pw-2") || ValidName("bank pw") || ValidName("") {
+		t.Errorf("ValidName accepts or rejects the wrong names")
+	}
+	if Placeholder("bank_pw") != "{{secret:bank_pw}}" || !Contains(Placeholder("bank_pw")) || Contains("{secret:x}") {
+		t.Errorf("placeholders don't round-trip")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	values := map[string]string{"user": "alice"}
+	got, missing := Replace("{{secret:user}} / {{secret:pw}}", func(name string) (string, bool) {
+		v, ok := values[name]
+		return v, ok
+	})
+	if got != "alice / {{secret:pw}}" || strings.Join(missing, ",") != "pw" {
+		t.Errorf("Replace = %q, missing %v", got, missing)
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	r := NewRedactor(map[string]string{"user": "alice", "pw": "alice-secret", "pin": "12"})
+	// The longer value is replaced whole; values that are too short are kept
+	if got := r.Redact("login alice with alice-secret, pin 12"); got != "login {{secret:user}} with {{secret:pw}}, pin 12" {
+		t.Errorf("Redact = %q", got)
+	}
+	var none *Redactor
+	if got := none.Redact("alice"); got != "alice" {
+		t.Errorf("nil Redact = %q", got)
+	}
+}
@@ -0,0 +1,86 @@
+// Package urlpattern matches URLs against the patterns of an agent's URL
+// policy. The server checks the navigations it sends and the agent checks
+// the ones it sees, so both use this one matcher.
+//
+// A pattern with a scheme ("https://bank.example/*") is matched part by
+// part: the scheme and port must be the same, the host must match the host
+// pattern, and the path and query must match the rest, where * matches
+// anything. Without a path, only the root path matches. A pattern without a
+// scheme is matched against the host name alone, on any port. Host patterns
+// like "*.example.com" match example.com and all of its subdomains; other
+// *s match any part of a host name. Matching ignores case.
+package urlpattern
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// defaultPorts are the ports a URL of a scheme has when it names none
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Match reports whether rawURL matches pattern. Only http and https URLs
+// with a host match; "example.com/login" or "javascript:..." match nothing.
+func Match(pattern, rawURL string) bool {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" || defaultPorts[strings.ToLower(u.Scheme)] == "" {
+		return false
+	}
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "" {
+		return false
+	}
+	// User info ("https://bank.example@evil.com") is never compared, so it
+	// can't pass for the host
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+
+	scheme, rest, hasScheme := strings.Cut(pattern, "://")
+	if !hasScheme {
+		return matchHost(pattern, host)
+	}
+	if !glob(scheme, strings.ToLower(u.Scheme)) {
+		return false
+	}
+
+	hostPattern, pathPattern, hasPath := strings.Cut(rest, "/")
+	portPattern := ""
+	if h, p, err := net.SplitHostPort(hostPattern); err == nil {
+		hostPattern, portPattern = h, p
+	}
+	port := u.Port()
+	if port == defaultPorts[strings.ToLower(u.Scheme)] {
+		port = ""
+	}
+	if port != portPattern || !matchHost(hostPattern, host) {
+		return false
+	}
+
+	path := u.EscapedPath()
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	if !hasPath {
+		return path == "" || path == "/"
+	}
+	return glob("/"+pathPattern, strings.ToLower(path))
+}
+
+// matchHost reports whether a host name matches a host pattern
+func matchHost(pattern, host string) bool {
+	if base, ok := strings.CutPrefix(pattern, "*."); ok && !strings.Contains(base, "*") {
+		return host == base || strings.HasSuffix(host, "."+base)
+	}
+	return glob(pattern, host)
+}
+
+// glob reports whether s matches pattern, where * matches anything
+func glob(pattern, s string) bool {
+	expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+	matched, _ := regexp.MatchString(expr, s)
+	return matched
+}
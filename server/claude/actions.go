@@ -0,0 +1,272 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RunActionsToolName is the name of the tool that runs a batch of steps
+const RunActionsToolName = "run_actions"
+
+// maxBatchSteps is the most steps one run_actions call may have
+const maxBatchSteps = 20
+
+// maxStepWait is the longest wait_ms a step may ask for
+const maxStepWait = 5000
+
+// runActionsTool describes the run_actions tool
+var runActionsTool = Tool{
+	Name:        RunActionsToolName,
+	Description: "在一次操作中依序執行多個步驟（點擊、輸入、按鍵、選擇選項），適合填寫表單。遇到第一個失敗的步驟就會停止，並回報每個步驟的結果和最後的截圖",
+	InputSchema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"steps": {
+				"type": "array",
+				"description": "要依序執行的步驟 (最多 20 個)",
+				"items": {
+					"type": "object",
+					"properties": {
+						"action": {
+							"type": "string",
+							"enum": ["click", "type", "key", "select"],
+							"description": "click 點擊座標、type 輸入文字、key 按下按鍵、select 選擇下拉選單選項"
+						},
+						"ref": {"type": "string", "description": "click、type、select 的目標元素 ref (get_page_state 返回的 ref，例如 e12)，有 ref 時不需要座標或 selector"},
+						"x": {"type": "integer", "description": "click 的 X 座標"},
+						"y": {"type": "integer", "description": "click 的 Y 座標"},
+						"description": {"type": "string", "description": "click 目標的描述"},
+						"text": {"type": "string", "description": "type 要輸入的文字，或 select 要選擇的選項顯示文字"},
+						"key": {"type": "string", "description": "key 的按鍵名稱 (Enter, Tab, Escape 等)"},
+						"selector": {"type": "string", "description": "select 的下拉選單 name 或 id (例如: name=country)"},
+						"value": {"type": "string", "description": "select 要選擇的選項 value 值"},
+						"wait_ms": {"type": "integer", "description": "這個步驟之後等待的毫秒數 (最多 5000)"}
+					},
+					"required": ["action"]
+				}
+			}
+		},
+		"required": ["steps"]
+	}`),
+}
+
+// RunActionsInput is the input of a run_actions call
+type RunActionsInput struct {
+	Steps []ActionStep `json:"steps"`
+}
+
+// ActionStep is one step of a run_actions call
+type ActionStep struct {
+	Action      string `json:"action"`
+	Ref         string `json:"ref"`
+	X           int    `json:"x"`
+	Y           int    `json:"y"`
+	Description string `json:"description"`
+	Text        string `json:"text"`
+	Key         string `json:"key"`
+	Selector    string `json:"selector"`
+	Value       string `json:"value"`
+	WaitMs      int    `json:"wait_ms"`
+}
+
+// ActionsResult is what the agent reports after running a batch
+type ActionsResult struct {
+	Steps      []ActionStepResult
+	Screenshot string // Taken after the last step that ran
+}
+
+// ActionStepResult is the outcome of one step. Steps after the first
+// failure are not run and have no result.
+type ActionStepResult struct {
+	Index   int    `json:"index"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReturnsScreenshot reports whether a tool call returns a screenshot of the
+// page after it ran, so no new one needs to be taken
+func ReturnsScreenshot(tc ToolCall) bool {
+	return tc.Name == RunActionsToolName || refTools[tc.Name] || IsScreenshotCall(tc)
+}
+
+// normalized returns the step as it runs. Like type_text, a type step whose
+// text is only a key name presses that key.
+func (s ActionStep) normalized() ActionStep {
+	if s.Action == "type" && s.Ref == "" {
+		if key, ok := typedKeyName(s.Text); ok {
+			s.Action, s.Key, s.Text = "key", key, ""
+		}
+	}
+	return s
+}
+
+// toolCall returns the single tool call the step is equivalent to, so
+// policies, secret checks and approvals treat both the same way
+func (s ActionStep) toolCall(id string) (ToolCall, error) {
+	var name string
+	var input interface{}
+	if s.Ref != "" && s.Action != "key" {
+		return s.refToolCall(id)
+	}
+	switch s.Action {
+	case "click":
+		if s.X == 0 && s.Y == 0 {
+			return ToolCall{}, fmt.Errorf("click 步驟需要 ref 或座標")
+		}
+		name, input = "click", ClickInput{X: s.X, Y: s.Y, Description: s.Description}
+	case "type":
+		name, input = "type_text", TypeTextInput{Text: s.Text}
+	case "key":
+		name, input = "press_key", PressKeyInput{Key: s.Key}
+	case "select":
+		name, input = "select_option", SelectOptionInput{Selector: s.Selector, Value: s.Value, Text: s.Text}
+	default:
+		return ToolCall{}, fmt.Errorf("不支援的步驟動作: %q", s.Action)
+	}
+	data, _ := json.Marshal(input)
+	return ToolCall{ID: id, Name: name, Input: data}, nil
+}
+
+// browserAction returns the agent action that runs the step
+func (s ActionStep) browserAction() BrowserAction {
+	wait := s.WaitMs
+	if wait > maxStepWait {
+		wait = maxStepWait
+	}
+	if s.Ref != "" {
+		switch s.Action {
+		case "click":
+			return BrowserAction{Type: "click_ref", Ref: s.Ref, Description: s.Description, WaitMs: wait}
+		case "type":
+			return BrowserAction{Type: "input_ref", Ref: s.Ref, Value: s.Text, WaitMs: wait}
+		case "select":
+			return BrowserAction{Type: "select_ref", Ref: s.Ref, OptionValue: s.Value, OptionText: s.Text, WaitMs: wait}
+		}
+	}
+	switch s.Action {
+	case "click":
+		return BrowserAction{Type: "click_xy", X: s.X, Y: s.Y, Description: s.Description, WaitMs: wait}
+	case "type":
+		return BrowserAction{Type: "input", Value: s.Text, WaitMs: wait}
+	case "key":
+		return BrowserAction{Type: "key", Key: s.Key, WaitMs: wait}
+	default:
+		return BrowserAction{Type: "select_option", Selector: s.Selector, OptionValue: s.Value, OptionText: s.Text, WaitMs: wait}
+	}
+}
+
+// describe returns what the step does, for the result shown to the model
+func (s ActionStep) describe() string {
+	switch s.Action {
+	case "click":
+		if s.Ref != "" {
+			return strings.TrimSpace(fmt.Sprintf("點擊 %s %s", s.Ref, s.Description))
+		}
+		return strings.TrimSpace(fmt.Sprintf("點擊 (%d, %d) %s", s.X, s.Y, s.Description))
+	case "type":
+		if s.Ref != "" {
+			return fmt.Sprintf("在 %s 輸入 \"%s\"", s.Ref, s.Text)
+		}
+		return fmt.Sprintf("輸入 \"%s\"", s.Text)
+	case "key":
+		return fmt.Sprintf("按下 %s", s.Key)
+	default:
+		option := s.Value
+		if option == "" {
+			option = s.Text
+		}
+		target := s.Selector
+		if s.Ref != "" {
+			target = s.Ref
+		}
+		return fmt.Sprintf("在 %s 選擇 %s", target, option)
+	}
+}
+
+// runActions executes a run_actions call. Every step is checked before the
+// batch is sent, so a step the policy forbids stops the whole batch.
+func (te *ToolExecutor) runActions(ctx context.Context, tc ToolCall) (ToolResult, string, error) {
+	result := ToolResult{ToolUseID: tc.ID}
+
+	var input RunActionsInput
+	if err := json.Unmarshal(tc.Input, &input); err != nil {
+		result.Content = fmt.Sprintf("解析 run_actions 參數失敗: %v", err)
+		result.IsError = true
+		return result, "", nil
+	}
+	if len(input.Steps) == 0 || len(input.Steps) > maxBatchSteps {
+		result.Content = fmt.Sprintf("run_actions 需要 1 到 %d 個步驟", maxBatchSteps)
+		result.IsError = true
+		return result, "", nil
+	}
+	if te.toolPolicy.ToolDisabled(RunActionsToolName) {
+		result.Content = fmt.Sprintf("此 Agent 已停用工具 %s", RunActionsToolName)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	for i := range input.Steps {
+		input.Steps[i] = input.Steps[i].normalized()
+	}
+
+	// Steps only count against the action limit if the batch is sent
+	counted := te.actions
+	for i, step := range input.Steps {
+		call, err := step.toolCall(tc.ID)
+		if err != nil {
+			te.actions = counted
+			result.Content = fmt.Sprintf("步驟 %d: %v", i+1, err)
+			result.IsError = true
+			return result, "", nil
+		}
+		denied := te.checkToolPolicy(call)
+		if denied == nil {
+			denied = te.checkSecretRefs(call)
+		}
+		if denied != nil {
+			te.actions = counted
+			denied.Content = fmt.Sprintf("步驟 %d: %s（所有步驟都未執行）", i+1, denied.Content)
+			return *denied, "", nil
+		}
+	}
+	if denied := te.checkBatchApproval(ctx, tc, input.Steps); denied != nil {
+		te.actions = counted
+		return *denied, "", nil
+	}
+
+	actions := make([]BrowserAction, len(input.Steps))
+	for i, step := range input.Steps {
+		actions[i] = step.browserAction()
+	}
+	batch, err := te.agent.RunActions(ctx, actions)
+	if err != nil {
+		if ctx.Err() != nil {
+			return CancelledToolResult(tc.ID), "", nil
+		}
+		result.Content = fmt.Sprintf("執行步驟失敗: %v", err)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	results := make(map[int]ActionStepResult, len(batch.Steps))
+	for _, r := range batch.Steps {
+		results[r.Index] = r
+	}
+	var b strings.Builder
+	for i, step := range input.Steps {
+		r, ran := results[i]
+		switch {
+		case !ran:
+			fmt.Fprintf(&b, "%d. %s: 未執行\n", i+1, step.describe())
+		case r.Success:
+			fmt.Fprintf(&b, "%d. %s: 成功\n", i+1, step.describe())
+		default:
+			fmt.Fprintf(&b, "%d. %s: 失敗 - %s\n", i+1, step.describe(), r.Error)
+			result.IsError = true
+		}
+	}
+	result.Content = strings.TrimSuffix(b.String(), "\n")
+	return result, batch.Screenshot, nil
+}
@@ -0,0 +1,268 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testAgent records what the executor sends and answers page state
+// requests with pageState
+type testAgent struct {
+	pageState string
+
+	mu      sync.Mutex
+	actions []BrowserAction
+	batches [][]BrowserAction
+}
+
+func (a *testAgent) RequestScreenshot(ctx context.Context) (string, error) {
+	return "aW1hZ2U=", nil
+}
+
+func (a *testAgent) RequestPageState(ctx context.Context) (string, error) {
+	return a.pageState, nil
+}
+
+func (a *testAgent) SendAction(ctx context.Context, action BrowserAction) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.actions = append(a.actions, action)
+	return nil
+}
+
+func (a *testAgent) RunActions(ctx context.Context, actions []BrowserAction) (*ActionsResult, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.batches = append(a.batches, actions)
+	result := &ActionsResult{Screenshot: "aW1hZ2U="}
+	for i := range actions {
+		result.Steps = append(result.Steps, ActionStepResult{Index: i, Success: true})
+	}
+	return result, nil
+}
+
+// testApprover records the approval requests and answers them with approve
+type testApprover struct {
+	approve  bool
+	requests []ApprovalRequest
+}
+
+func (a *testApprover) RequestApproval(ctx context.Context, req ApprovalRequest) (bool, error) {
+	a.requests = append(a.requests, req)
+	return a.approve, nil
+}
+
+// focusedTextInput is a page state with a text input that has focus
+const focusedTextInput = `{"url":"https://example.com/","inputs":[{"type":"text","focused":true,"x":100,"y":100}],"buttons":[]}`
+
+func runActionsCall(steps string) ToolCall {
+	return ToolCall{ID: "toolu_1", Name: RunActionsToolName, Input: json.RawMessage(`{"steps":` + steps + `}`)}
+}
+
+func TestRunActionsPressesTypedKeyNames(t *testing.T) {
+	agent := &testAgent{pageState: focusedTextInput}
+	approver := &testApprover{approve: true}
+	te := NewToolExecutor(agent)
+	te.RequireApproval(NewApprovalPolicy(ApprovalSubmit), approver)
+
+	result, _, err := te.ExecuteTool(context.Background(), runActionsCall(
+		`[{"action":"type","text":"hello"},{"action":"type","text":" Enter "}]`))
+	if err != nil || result.IsError {
+		t.Fatalf("run_actions = %+v, %v", result, err)
+	}
+
+	if len(agent.batches) != 1 || len(agent.batches[0]) != 2 {
+		t.Fatalf("batches = %+v", agent.batches)
+	}
+	if typed := agent.batches[0][0]; typed.Type != "input" || typed.Value != "hello" {
+		t.Errorf("step 1 = %+v, want the text typed", typed)
+	}
+	if pressed := agent.batches[0][1]; pressed.Type != "key" || pressed.Key != "Enter" || pressed.Value != "" {
+		t.Errorf("step 2 = %+v, want Enter pressed", pressed)
+	}
+	if !strings.Contains(result.Content, "按下 Enter") {
+		t.Errorf("result = %q", result.Content)
+	}
+
+	// Enter in the input submits the form, as it does for type_text
+	if len(approver.requests) != 1 || approver.requests[0].Rule != ApprovalSubmit {
+		t.Errorf("approval requests = %+v, want one for %s", approver.requests, ApprovalSubmit)
+	}
+}
+
+func TestTypeTextPressesKeyNames(t *testing.T) {
+	agent := &testAgent{pageState: focusedTextInput}
+	approver := &testApprover{approve: true}
+	te := NewToolExecutor(agent)
+	te.RequireApproval(NewApprovalPolicy(ApprovalSubmit), approver)
+
+	result, _, err := te.ExecuteTool(context.Background(), ToolCall{
+		ID: "toolu_1", Name: "type_text", Input: json.RawMessage(`{"text":"enter"}`),
+	})
+	if err != nil || result.IsError {
+		t.Fatalf("type_text = %+v, %v", result, err)
+	}
+	if len(agent.actions) != 1 || agent.actions[0].Type != "key" || agent.actions[0].Key != "Enter" {
+		t.Errorf("actions = %+v, want Enter pressed", agent.actions)
+	}
+	if len(approver.requests) != 1 || approver.requests[0].Rule != ApprovalSubmit {
+		t.Errorf("approval requests = %+v, want one for %s", approver.requests, ApprovalSubmit)
+	}
+}
+
+func TestRunActionsRejectsClickWithoutTarget(t *testing.T) {
+	agent := &testAgent{pageState: focusedTextInput}
+	te := NewToolExecutor(agent)
+
+	result, _, err := te.ExecuteTool(context.Background(), runActionsCall(
+		`[{"action":"type","text":"hello"},{"action":"click","description":"送出"}]`))
+	if err != nil {
+		t.Fatalf("run_actions: %v", err)
+	}
+	if !result.IsError || !strings.Contains(result.Content, "步驟 2") {
+		t.Errorf("result = %+v, want step 2 rejected", result)
+	}
+	if len(agent.batches) != 0 {
+		t.Errorf("batch sent to agent: %+v", agent.batches)
+	}
+	if te.actions != 0 {
+		t.Errorf("rejected batch counted %d actions", te.actions)
+	}
+}
+
+func TestRefToolsRunAsBatches(t *testing.T) {
+	tests := []struct {
+		tool  string
+		input string
+		want  BrowserAction
+	}{
+		{"click_element", `{"ref":"e3","description":"登入"}`,
+			BrowserAction{Type: "click_ref", Ref: "e3", Description: "登入"}},
+		{"type_into", `{"ref":"e2","text":"alice"}`,
+			BrowserAction{Type: "input_ref", Ref: "e2", Value: "alice"}},
+		// Text typed into a ref is never read as a key name
+		{"type_into", `{"ref":"e2","text":"Enter"}`,
+			BrowserAction{Type: "input_ref", Ref: "e2", Value: "Enter"}},
+		{"type_into", `{"ref":"e2","text":""}`,
+			BrowserAction{Type: "input_ref", Ref: "e2"}},
+		{"select", `{"ref":"e7","value":"tw","text":"台灣"}`,
+			BrowserAction{Type: "select_ref", Ref: "e7", OptionValue: "tw", OptionText: "台灣"}},
+		{"select", `{"ref":"e7","text":"台灣"}`,
+			BrowserAction{Type: "select_ref", Ref: "e7", OptionText: "台灣"}},
+	}
+
+	for _, tt := range tests {
+		agent := &testAgent{pageState: formPage}
+		te := NewToolExecutor(agent)
+
+		result, screenshot, err := te.ExecuteTool(context.Background(), ToolCall{
+			ID: "toolu_1", Name: tt.tool, Input: json.RawMessage(tt.input),
+		})
+		if err != nil || result.IsError {
+			t.Errorf("%s %s: result %+v, %v", tt.tool, tt.input, result, err)
+			continue
+		}
+		if len(agent.batches) != 1 || len(agent.batches[0]) != 1 || len(agent.actions) != 0 {
+			t.Errorf("%s %s: batches %+v, actions %+v, want one one-step batch", tt.tool, tt.input, agent.batches, agent.actions)
+			continue
+		}
+		if got := agent.batches[0][0]; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %s: action = %+v, want %+v", tt.tool, tt.input, got, tt.want)
+		}
+		if screenshot == "" || !ReturnsScreenshot(ToolCall{Name: tt.tool}) {
+			t.Errorf("%s returned no screenshot", tt.tool)
+		}
+	}
+}
+
+func TestRunActionsStepsWithRefs(t *testing.T) {
+	agent := &testAgent{pageState: formPage}
+	te := NewToolExecutor(agent)
+
+	result, _, err := te.ExecuteTool(context.Background(), runActionsCall(`[
+		{"action":"click","ref":"e3","description":"登入","wait_ms":60000},
+		{"action":"type","ref":"e2","text":"Tab"},
+		{"action":"select","ref":"e7","value":"tw"},
+		{"action":"key","ref":"e2","key":"Tab"}
+	]`))
+	if err != nil || result.IsError {
+		t.Fatalf("run_actions: %+v, %v", result, err)
+	}
+	want := []BrowserAction{
+		{Type: "click_ref", Ref: "e3", Description: "登入", WaitMs: maxStepWait},
+		{Type: "input_ref", Ref: "e2", Value: "Tab"},
+		{Type: "select_ref", Ref: "e7", OptionValue: "tw"},
+		// A key step presses the key wherever the focus is
+		{Type: "key", Key: "Tab"},
+	}
+	if len(agent.batches) != 1 || !reflect.DeepEqual(agent.batches[0], want) {
+		t.Errorf("batches = %+v, want %+v", agent.batches, want)
+	}
+}
+
+func TestRefToolsRequireRef(t *testing.T) {
+	tests := []struct {
+		tool  string
+		input string
+		want  string
+	}{
+		{"click_element", `{"description":"登入"}`, "缺少 ref"},
+		{"type_into", `{"text":"alice"}`, "缺少 ref"},
+		{"select", `{"value":"tw"}`, "缺少 ref"},
+		{"select", `{"ref":"","text":"台灣"}`, "缺少 ref"},
+		{"click_element", `{"ref":3}`, "解析 click_element 參數失敗"},
+		{"type_into", `not json`, "解析 type_into 參數失敗"},
+		{RunActionsToolName, `{"steps":[{"action":"scroll","ref":"e1"}]}`, "不支援 ref"},
+	}
+
+	for _, tt := range tests {
+		agent := &testAgent{pageState: formPage}
+		te := NewToolExecutor(agent)
+
+		result, _, err := te.ExecuteTool(context.Background(), ToolCall{
+			ID: "toolu_1", Name: tt.tool, Input: json.RawMessage(tt.input),
+		})
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.tool, tt.input, err)
+			continue
+		}
+		if !result.IsError || !strings.Contains(result.Content, tt.want) {
+			t.Errorf("%s %s: result = %+v, want an error containing %q", tt.tool, tt.input, result, tt.want)
+		}
+		if len(agent.batches) != 0 || len(agent.actions) != 0 || te.actions != 0 {
+			t.Errorf("%s %s: rejected call ran: batches %+v, actions %+v", tt.tool, tt.input, agent.batches, agent.actions)
+		}
+	}
+}
+
+func TestRefToolCallMatchesRefStep(t *testing.T) {
+	steps := []ActionStep{
+		{Action: "click", Ref: "e3", Description: "登入"},
+		{Action: "type", Ref: "e2", Text: "{{secret:pw}}"},
+		{Action: "select", Ref: "e7", Value: "tw", Text: "台灣"},
+	}
+	names := []string{"click_element", "type_into", "select"}
+
+	for i, step := range steps {
+		tc, err := step.toolCall("toolu_1")
+		if err != nil {
+			t.Fatalf("%s: %v", step.Action, err)
+		}
+		if tc.Name != names[i] || tc.ID != "toolu_1" {
+			t.Errorf("%s step became %s", step.Action, tc.Name)
+		}
+		// Policies and approvals see the same call either way
+		back, err := refStep(tc)
+		if err != nil || back != step {
+			t.Errorf("%s: refStep = %+v, %v, want %+v", tc.Name, back, err, step)
+		}
+	}
+
+	if _, err := (ActionStep{Action: "scroll", Ref: "e1"}).refToolCall("toolu_1"); err == nil {
+		t.Error("scroll step with a ref became a ref tool call")
+	}
+}
@@ -0,0 +1,377 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Approval rules, as listed in APPROVAL_RULES
+const (
+	ApprovalNewDomain = "new_domain" // navigate to a host not visited in this task
+	ApprovalSubmit    = "submit"     // Enter in an input field or a click on a submit button
+	ApprovalPassword  = "password"   // type_text into a password field
+)
+
+// defaultApprovalRules is used when APPROVAL_RULES is not set
+var defaultApprovalRules = []string{ApprovalNewDomain, ApprovalSubmit, ApprovalPassword}
+
+// submitButtonRadius is how close (in pixels) a click must be to the center
+// of a submit button to count as clicking it
+const submitButtonRadius = 40
+
+// ErrApprovalTimeout is returned by an Approver when the user didn't answer in time
+var ErrApprovalTimeout = errors.New("approval timed out")
+
+// ApprovalPolicy decides which tool calls need the user's approval
+type ApprovalPolicy struct {
+	rules map[string]bool
+}
+
+// NewApprovalPolicy creates a policy enforcing the given rules
+func NewApprovalPolicy(rules ...string) ApprovalPolicy {
+	p := ApprovalPolicy{rules: make(map[string]bool)}
+	for _, rule := range rules {
+		p.rules[rule] = true
+	}
+	return p
+}
+
+// ApprovalPolicyFromEnv reads the rules from APPROVAL_RULES, a comma
+// separated list. "none" disables approvals; unset enables every rule.
+func ApprovalPolicyFromEnv() ApprovalPolicy {
+	value, ok := os.LookupEnv("APPROVAL_RULES")
+	if !ok {
+		return NewApprovalPolicy(defaultApprovalRules...)
+	}
+
+	var rules []string
+	for _, rule := range strings.Split(value, ",") {
+		if rule = strings.TrimSpace(rule); rule != "" && rule != "none" {
+			rules = append(rules, rule)
+		}
+	}
+	return NewApprovalPolicy(rules...)
+}
+
+// Enabled reports whether the policy has any rule
+func (p ApprovalPolicy) Enabled() bool {
+	return len(p.rules) > 0
+}
+
+// Has reports whether the policy enforces rule
+func (p ApprovalPolicy) Has(rule string) bool {
+	return p.rules[rule]
+}
+
+// ApprovalRequest describes a tool call waiting for the user's approval
+type ApprovalRequest struct {
+	ToolCall    ToolCall
+	Rule        string
+	Description string // What the call will do, shown to the user
+}
+
+// Approver asks the user whether a tool call may run. It returns
+// ErrApprovalTimeout if the user doesn't answer in time.
+type Approver interface {
+	RequestApproval(ctx context.Context, req ApprovalRequest) (bool, error)
+}
+
+// approvalPageState is the part of the agent's page state the policy needs
+type approvalPageState struct {
+	URL    string `json:"url"`
+	Inputs []struct {
+		Type    string `json:"type"`
+		Focused bool   `json:"focused"`
+		Ref     string `json:"ref"`
+		X       int    `json:"x"`
+		Y       int    `json:"y"`
+	} `json:"inputs"`
+	Buttons []approvalButton `json:"buttons"`
+}
+
+type approvalButton struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+	Ref  string `json:"ref"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+}
+
+func (s *approvalPageState) focusedInputType() string {
+	for _, input := range s.Inputs {
+		if input.Focused {
+			return input.Type
+		}
+	}
+	return ""
+}
+
+// submitButtonAt returns the submit button a click at (x, y) hits, or nil
+func (s *approvalPageState) submitButtonAt(x, y int) *approvalButton {
+	for i, b := range s.Buttons {
+		if b.Type == "submit" && math.Hypot(float64(b.X-x), float64(b.Y-y)) <= submitButtonRadius {
+			return &s.Buttons[i]
+		}
+	}
+	return nil
+}
+
+// inputTypeAt returns the type of the input a click at (x, y) focuses, or
+// "" if it hits none
+func (s *approvalPageState) inputTypeAt(x, y int) string {
+	for _, input := range s.Inputs {
+		if math.Hypot(float64(input.X-x), float64(input.Y-y)) <= submitButtonRadius {
+			return input.Type
+		}
+	}
+	return ""
+}
+
+// submitButtonRef returns the submit button with the given ref, or nil
+func (s *approvalPageState) submitButtonRef(ref string) *approvalButton {
+	for i, b := range s.Buttons {
+		if b.Type == "submit" && b.Ref == ref {
+			return &s.Buttons[i]
+		}
+	}
+	return nil
+}
+
+// inputTypeRef returns the type of the input with the given ref, or "" if
+// there is none
+func (s *approvalPageState) inputTypeRef(ref string) string {
+	for _, input := range s.Inputs {
+		if input.Ref == ref {
+			return input.Type
+		}
+	}
+	return ""
+}
+
+// hostOf returns the lower-case host name of a URL, or "" if it has none
+func hostOf(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// toolApprovalRules maps each tool the policy covers to its rule
+var toolApprovalRules = map[string]string{
+	"navigate":  ApprovalNewDomain,
+	"click":     ApprovalSubmit,
+	"press_key": ApprovalSubmit,
+	"type_text": ApprovalPassword,
+
+	// Double clicks and drags, which have no browser tool
+	ComputerToolName: ApprovalSubmit,
+}
+
+// approvalRule returns the rule that requires approval for a tool call, and
+// a description for the user. An empty rule means the call may run.
+func (te *ToolExecutor) approvalRule(ctx context.Context, tc ToolCall) (rule, description string) {
+	name := tc.Name
+	if name == "type_text" {
+		// ExecuteTool presses the key when the text is a key name
+		var input TypeTextInput
+		if json.Unmarshal(tc.Input, &input) == nil {
+			if key, ok := typedKeyName(input.Text); ok {
+				name = "press_key"
+				tc.Input, _ = json.Marshal(PressKeyInput{Key: key})
+			}
+		}
+	}
+
+	rule, ok := toolApprovalRules[name]
+	if !ok || !te.policy.Has(rule) {
+		return "", ""
+	}
+	if name == "press_key" {
+		var input PressKeyInput
+		if json.Unmarshal(tc.Input, &input) != nil || !strings.EqualFold(input.Key, "Enter") {
+			return "", ""
+		}
+	}
+	var points [][2]int
+	if name == ComputerToolName {
+		if points = te.computerClickPoints(tc); points == nil {
+			return "", ""
+		}
+	}
+
+	// The page state tells where the browser is and what has focus. If it
+	// is unavailable the call needs approval, since nothing can be ruled out.
+	var state approvalPageState
+	haveState := false
+	if data, err := te.agent.RequestPageState(ctx); err == nil && json.Unmarshal([]byte(data), &state) == nil {
+		haveState = true
+		if host := hostOf(state.URL); host != "" {
+			te.visitedHosts[host] = true
+		}
+	}
+
+	switch name {
+	case "navigate":
+		var input NavigateInput
+		if json.Unmarshal(tc.Input, &input) != nil {
+			return "", ""
+		}
+		host := hostOf(input.URL)
+		if host == "" || te.visitedHosts[host] {
+			return "", ""
+		}
+		return rule, fmt.Sprintf("前往新的網域 %s", host)
+
+	case "press_key":
+		// Enter outside an input does nothing to submit, and in a textarea
+		// it only adds a new line
+		if focused := state.focusedInputType(); haveState && (focused == "" || focused == "textarea") {
+			return "", ""
+		}
+		return rule, "在輸入框按下 Enter 送出表單"
+
+	case "click":
+		var input ClickInput
+		if json.Unmarshal(tc.Input, &input) != nil {
+			return "", ""
+		}
+		if !haveState {
+			return rule, fmt.Sprintf("點擊 %s（可能會送出表單）", input.Description)
+		}
+		if b := state.submitButtonAt(input.X, input.Y); b != nil {
+			return rule, fmt.Sprintf("點擊送出按鈕「%s」", b.Text)
+		}
+
+	case ComputerToolName:
+		if !haveState {
+			return rule, fmt.Sprintf("在 (%d, %d) 點擊（可能會送出表單）", points[0][0], points[0][1])
+		}
+		for _, p := range points {
+			if b := state.submitButtonAt(p[0], p[1]); b != nil {
+				return rule, fmt.Sprintf("點擊送出按鈕「%s」", b.Text)
+			}
+		}
+
+	case "type_text":
+		if !haveState || state.focusedInputType() == "password" {
+			return rule, "在密碼欄位輸入文字"
+		}
+	}
+	return "", ""
+}
+
+// checkApproval asks the approver for calls the policy covers. It returns
+// a non-nil result if the call must not run.
+func (te *ToolExecutor) checkApproval(ctx context.Context, tc ToolCall) *ToolResult {
+	if te.approver == nil || !te.policy.Enabled() {
+		return nil
+	}
+
+	rule, description := te.approvalRule(ctx, tc)
+	if rule == "" {
+		return nil
+	}
+	if denied := te.askApproval(ctx, tc, rule, description); denied != nil {
+		return denied
+	}
+
+	if tc.Name == "navigate" {
+		var input NavigateInput
+		if json.Unmarshal(tc.Input, &input) == nil {
+			if host := hostOf(input.URL); host != "" {
+				te.visitedHosts[host] = true
+			}
+		}
+	}
+	return nil
+}
+
+// checkBatchApproval asks once for all steps of a run_actions call, or of
+// a ref tool call, the policy covers. The page state is read before the
+// batch runs, so the field a step types into is worked out from the clicks
+// before it or from its ref.
+func (te *ToolExecutor) checkBatchApproval(ctx context.Context, tc ToolCall, steps []ActionStep) *ToolResult {
+	if te.approver == nil || !te.policy.Enabled() {
+		return nil
+	}
+
+	var state approvalPageState
+	haveState := false
+	if data, err := te.agent.RequestPageState(ctx); err == nil && json.Unmarshal([]byte(data), &state) == nil {
+		haveState = true
+	}
+	focused := state.focusedInputType()
+
+	var rule string
+	var descriptions []string
+	require := func(r, description string) {
+		if rule == "" {
+			rule = r
+		}
+		descriptions = append(descriptions, description)
+	}
+
+	for _, step := range steps {
+		switch step.Action {
+		case "click":
+			button, input := state.submitButtonAt(step.X, step.Y), state.inputTypeAt(step.X, step.Y)
+			if step.Ref != "" {
+				button, input = state.submitButtonRef(step.Ref), state.inputTypeRef(step.Ref)
+			}
+			if te.policy.Has(ApprovalSubmit) {
+				if !haveState {
+					require(ApprovalSubmit, fmt.Sprintf("點擊 %s（可能會送出表單）", step.Description))
+				} else if button != nil {
+					require(ApprovalSubmit, fmt.Sprintf("點擊送出按鈕「%s」", button.Text))
+				}
+			}
+			focused = input
+		case "type":
+			if step.Ref != "" {
+				// type_into focuses the field first
+				focused = state.inputTypeRef(step.Ref)
+			}
+			if te.policy.Has(ApprovalPassword) && (!haveState || focused == "password") {
+				require(ApprovalPassword, "在密碼欄位輸入文字")
+			}
+		case "key":
+			if te.policy.Has(ApprovalSubmit) && strings.EqualFold(step.Key, "Enter") &&
+				(!haveState || (focused != "" && focused != "textarea")) {
+				require(ApprovalSubmit, "在輸入框按下 Enter 送出表單")
+			}
+		}
+	}
+	if rule == "" {
+		return nil
+	}
+	return te.askApproval(ctx, tc, rule, strings.Join(descriptions, "、"))
+}
+
+// askApproval waits for the user's answer. It returns a non-nil result if
+// the call must not run.
+func (te *ToolExecutor) askApproval(ctx context.Context, tc ToolCall, rule, description string) *ToolResult {
+	approved, err := te.approver.RequestApproval(ctx, ApprovalRequest{
+		ToolCall:    tc,
+		Rule:        rule,
+		Description: description,
+	})
+	switch {
+	case ctx.Err() != nil:
+		result := CancelledToolResult(tc.ID)
+		return &result
+	case errors.Is(err, ErrApprovalTimeout):
+		return &ToolResult{ToolUseID: tc.ID, Content: "等待使用者核准逾時，操作未執行", IsError: true}
+	case err != nil:
+		return &ToolResult{ToolUseID: tc.ID, Content: fmt.Sprintf("無法取得使用者核准: %v", err), IsError: true}
+	case !approved:
+		return &ToolResult{ToolUseID: tc.ID, Content: "使用者拒絕了此操作，請詢問使用者下一步", IsError: true}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// formPage is a login form: a password field, a text field, a textarea and
+// a submit button, each with a ref
+const formPage = `{"url":"https://bank.example.com/login","inputs":[
+	{"type":"password","ref":"e1","x":100,"y":100},
+	{"type":"text","ref":"e2","x":100,"y":200},
+	{"type":"textarea","ref":"e4","x":100,"y":300}
+],"buttons":[{"text":"登入","type":"submit","ref":"e3","x":300,"y":400}]}`
+
+// focused returns formPage with the input of the given ref focused
+func focused(ref string) string {
+	return strings.Replace(formPage, `"ref":"`+ref+`"`, `"ref":"`+ref+`","focused":true`, 1)
+}
+
+func TestApprovalRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []string
+		pageState string
+		tool      string
+		input     string
+		wantRule  string // Empty if the call runs without asking
+		wantDesc  string
+	}{
+		{"navigate to a new domain", []string{ApprovalNewDomain}, formPage,
+			"navigate", `{"url":"https://evil.example.net/"}`, ApprovalNewDomain, "前往新的網域 evil.example.net"},
+		{"navigate on the current domain", []string{ApprovalNewDomain}, formPage,
+			"navigate", `{"url":"https://BANK.example.com/account"}`, "", ""},
+		{"new domain rule off", []string{ApprovalSubmit}, formPage,
+			"navigate", `{"url":"https://evil.example.net/"}`, "", ""},
+
+		{"click a submit button", []string{ApprovalSubmit}, formPage,
+			"click", `{"x":310,"y":395,"description":"登入"}`, ApprovalSubmit, "點擊送出按鈕「登入」"},
+		{"click elsewhere", []string{ApprovalSubmit}, formPage,
+			"click", `{"x":600,"y":50,"description":"標誌"}`, "", ""},
+		{"click without page state", []string{ApprovalSubmit}, "",
+			"click", `{"x":600,"y":50,"description":"標誌"}`, ApprovalSubmit, "點擊 標誌（可能會送出表單）"},
+
+		{"Enter in a text field", []string{ApprovalSubmit}, focused("e2"),
+			"press_key", `{"key":"Enter"}`, ApprovalSubmit, "在輸入框按下 Enter 送出表單"},
+		{"Enter typed as text", []string{ApprovalSubmit}, focused("e2"),
+			"type_text", `{"text":"Enter"}`, ApprovalSubmit, "在輸入框按下 Enter 送出表單"},
+		{"Enter in a textarea", []string{ApprovalSubmit}, focused("e4"),
+			"press_key", `{"key":"Enter"}`, "", ""},
+		{"Enter with nothing focused", []string{ApprovalSubmit}, formPage,
+			"press_key", `{"key":"Enter"}`, "", ""},
+		{"Tab in a text field", []string{ApprovalSubmit}, focused("e2"),
+			"press_key", `{"key":"Tab"}`, "", ""},
+
+		{"type into a password field", []string{ApprovalPassword}, focused("e1"),
+			"type_text", `{"text":"hunter2"}`, ApprovalPassword, "在密碼欄位輸入文字"},
+		{"type into a text field", []string{ApprovalPassword}, focused("e2"),
+			"type_text", `{"text":"alice"}`, "", ""},
+		{"type without page state", []string{ApprovalPassword}, "",
+			"type_text", `{"text":"alice"}`, ApprovalPassword, "在密碼欄位輸入文字"},
+		{"password rule off", []string{ApprovalSubmit}, focused("e1"),
+			"type_text", `{"text":"hunter2"}`, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &testAgent{pageState: tt.pageState}
+			approver := &testApprover{approve: false}
+			te := NewToolExecutor(agent)
+			te.RequireApproval(NewApprovalPolicy(tt.rules...), approver)
+
+			result, _, err := te.ExecuteTool(context.Background(), ToolCall{
+				ID: "toolu_1", Name: tt.tool, Input: json.RawMessage(tt.input),
+			})
+			if err != nil {
+				t.Fatalf("execute: %v", err)
+			}
+
+			if tt.wantRule == "" {
+				if len(approver.requests) != 0 {
+					t.Errorf("asked for approval: %+v", approver.requests)
+				}
+				return
+			}
+			if len(approver.requests) != 1 {
+				t.Fatalf("approval requests = %+v, want one", approver.requests)
+			}
+			if req := approver.requests[0]; req.Rule != tt.wantRule || req.Description != tt.wantDesc {
+				t.Errorf("approval request = %s %q, want %s %q", req.Rule, req.Description, tt.wantRule, tt.wantDesc)
+			}
+			// The user declined, so nothing reached the agent
+			if !result.IsError || len(agent.actions) != 0 {
+				t.Errorf("declined call ran: result %+v, actions %+v", result, agent.actions)
+			}
+		})
+	}
+}
+
+func TestApprovedDomainIsNotAskedAgain(t *testing.T) {
+	agent := &testAgent{pageState: formPage}
+	approver := &testApprover{approve: true}
+	te := NewToolExecutor(agent)
+	te.RequireApproval(NewApprovalPolicy(ApprovalNewDomain), approver)
+
+	for i := 0; i < 2; i++ {
+		te.ExecuteTool(context.Background(), ToolCall{
+			ID: "toolu_1", Name: "navigate", Input: json.RawMessage(`{"url":"https://shop.example.org/cart"}`),
+		})
+	}
+	if len(approver.requests) != 1 {
+		t.Errorf("asked %d times, want once", len(approver.requests))
+	}
+}
+
+func TestBatchApproval(t *testing.T) {
+	tests := []struct {
+		name      string
+		pageState string
+		steps     string
+		wantRule  string // Empty if the batch runs without asking
+		wantDesc  string
+	}{
+		{"fill in a text field", formPage,
+			`[{"action":"click","x":100,"y":200},{"action":"type","text":"alice"},{"action":"key","key":"Tab"}]`, "", ""},
+		{"type after clicking the password field", formPage,
+			`[{"action":"click","x":100,"y":200},{"action":"type","text":"alice"},
+			  {"action":"click","x":102,"y":98},{"action":"type","text":"hunter2"}]`,
+			ApprovalPassword, "在密碼欄位輸入文字"},
+		{"type into the password field by ref", formPage,
+			`[{"action":"type","ref":"e1","text":"hunter2"}]`, ApprovalPassword, "在密碼欄位輸入文字"},
+		{"type into the focused password field", focused("e1"),
+			`[{"action":"type","text":"hunter2"}]`, ApprovalPassword, "在密碼欄位輸入文字"},
+		{"Enter after typing by ref", formPage,
+			`[{"action":"type","ref":"e2","text":"alice"},{"action":"key","key":"Enter"}]`,
+			ApprovalSubmit, "在輸入框按下 Enter 送出表單"},
+		{"Enter in a textarea", formPage,
+			`[{"action":"click","x":100,"y":300},{"action":"key","key":"Enter"}]`, "", ""},
+		{"click the submit button by ref", formPage,
+			`[{"action":"click","ref":"e3","description":"登入"}]`, ApprovalSubmit, "點擊送出按鈕「登入」"},
+		{"every step that needs approval is listed", formPage,
+			`[{"action":"type","ref":"e1","text":"hunter2"},{"action":"click","x":300,"y":400}]`,
+			ApprovalPassword, "在密碼欄位輸入文字、點擊送出按鈕「登入」"},
+		{"no page state", "",
+			`[{"action":"click","x":600,"y":50,"description":"標誌"},{"action":"type","text":"alice"}]`,
+			ApprovalSubmit, "點擊 標誌（可能會送出表單）、在密碼欄位輸入文字"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &testAgent{pageState: tt.pageState}
+			approver := &testApprover{approve: false}
+			te := NewToolExecutor(agent)
+			te.RequireApproval(NewApprovalPolicy(ApprovalSubmit, ApprovalPassword), approver)
+
+			result, _, err := te.ExecuteTool(context.Background(), runActionsCall(tt.steps))
+			if err != nil {
+				t.Fatalf("run_actions: %v", err)
+			}
+
+			if tt.wantRule == "" {
+				if len(approver.requests) != 0 {
+					t.Errorf("asked for approval: %+v", approver.requests)
+				}
+				if result.IsError || len(agent.batches) != 1 {
+					t.Errorf("batch didn't run: result %+v", result)
+				}
+				return
+			}
+			// One question covers the whole batch
+			if len(approver.requests) != 1 {
+				t.Fatalf("approval requests = %+v, want one", approver.requests)
+			}
+			if req := approver.requests[0]; req.Rule != tt.wantRule || req.Description != tt.wantDesc {
+				t.Errorf("approval request = %s %q, want %s %q", req.Rule, req.Description, tt.wantRule, tt.wantDesc)
+			}
+			if !result.IsError || len(agent.batches) != 0 || te.actions != 0 {
+				t.Errorf("declined batch ran: result %+v, batches %+v, %d actions counted", result, agent.batches, te.actions)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+// Package claudetest provides a fake Anthropic Messages API for tests. It
+// replays scripted replies, including tool use, as plain JSON or as a
+// server-sent event stream, and records every request it receives.
+//
+// Point a client at it with NewClient, or set ANTHROPIC_BASE_URL to the
+// server's URL so code that builds its own client, such as the chat loop
+// behind /ws/user, talks to the fake instead of the real API.
+package claudetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"weekend-chart/server/claude"
+)
+
+// APIKey is the key the fake server expects
+const APIKey = "test-key"
+
+// Model is reported by the fake server in every reply
+const Model = "claude-fake"
+
+// Reply is one scripted response of the fake server
+type Reply struct {
+	Thinking   string // Sent as a thinking block before the text
+	Text       string
+	ToolUses   []ToolUse
+	StopReason string // Defaults to tool_use with tool uses, end_turn otherwise
+
+	InputTokens  int
+	OutputTokens int
+
+	// Status other than 0 or 200 answers with an API error instead
+	Status     int
+	ErrorType  string // Such as "overloaded_error"
+	RetryAfter time.Duration
+}
+
+// ToolUse is a tool call in a scripted reply
+type ToolUse struct {
+	ID    string // Generated if empty
+	Name  string
+	Input interface{} // Marshaled to JSON
+}
+
+// TextReply returns a reply that only has text
+func TextReply(text string) Reply {
+	return Reply{Text: text}
+}
+
+// ToolReply returns a reply that calls one tool
+func ToolReply(text, name string, input interface{}) Reply {
+	return Reply{Text: text, ToolUses: []ToolUse{{Name: name, Input: input}}}
+}
+
+// ErrorReply returns a reply that fails with the given status
+func ErrorReply(status int, errorType string) Reply {
+	return Reply{Status: status, ErrorType: errorType}
+}
+
+// Request is a request the fake server received
+type Request struct {
+	Header    http.Header                  `json:"-"`
+	Model     string                       `json:"model"`
+	MaxTokens int                          `json:"max_tokens"`
+	System    []claude.ContentBlock        `json:"system"`
+	Messages  []claude.ConversationMessage `json:"messages"`
+	Tools     []claude.Tool                `json:"tools"`
+	Stream    bool                         `json:"stream"`
+	Thinking  *struct {
+		Type         string `json:"type"`
+		BudgetTokens int    `json:"budget_tokens"`
+	} `json:"thinking"`
+}
+
+// ToolNames returns the names of the tools offered in the request
+func (r Request) ToolNames() []string {
+	names := make([]string, len(r.Tools))
+	for i, t := range r.Tools {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// Server is a fake Messages API served over HTTP
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	replies  []Reply
+	requests []Request
+	toolSeq  int
+}
+
+// NewServer starts a fake server that answers with replies in order. Close
+// it when done.
+func NewServer(replies ...Reply) *Server {
+	s := &Server{replies: replies}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/messages", s.handleMessages)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Script appends more replies
+func (s *Server) Script(replies ...Reply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = append(s.replies, replies...)
+}
+
+// Pending returns how many scripted replies have not been sent yet
+func (s *Server) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.replies)
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Config returns a client configuration for the fake server. Failed
+// requests are not retried, so error replies reach the caller at once.
+func (s *Server) Config() claude.ClientConfig {
+	return claude.ClientConfig{
+		APIKey:  APIKey,
+		BaseURL: s.URL,
+		Retry:   &claude.RetryPolicy{MaxAttempts: 1},
+	}
+}
+
+// NewClient returns a client talking to the fake server
+func (s *Server) NewClient() *claude.Client {
+	return claude.NewClientWithConfig(s.Config())
+}
+
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_request_error", "method not allowed")
+		return
+	}
+	if r.Header.Get("x-api-key") != APIKey {
+		writeError(w, http.StatusUnauthorized, "authentication_error", "invalid x-api-key")
+		return
+	}
+	if r.Header.Get("anthropic-version") == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", "anthropic-version header is required")
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	req.Header = r.Header.Clone()
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	if len(s.replies) == 0 {
+		s.mu.Unlock()
+		writeError(w, http.StatusInternalServerError, "api_error", "claudetest: no scripted reply left")
+		return
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	blocks := s.contentBlocks(reply)
+	s.mu.Unlock()
+
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		if reply.RetryAfter > 0 {
+			w.Header().Set("retry-after", strconv.Itoa(int(reply.RetryAfter.Seconds())))
+		}
+		errorType := reply.ErrorType
+		if errorType == "" {
+			errorType = "api_error"
+		}
+		writeError(w, reply.Status, errorType, "scripted error")
+		return
+	}
+
+	stopReason := reply.StopReason
+	if stopReason == "" {
+		stopReason = "end_turn"
+		if len(reply.ToolUses) > 0 {
+			stopReason = "tool_use"
+		}
+	}
+	usage := map[string]int{"input_tokens": reply.InputTokens, "output_tokens": reply.OutputTokens}
+
+	if req.Stream {
+		writeStream(w, blocks, stopReason, usage)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":          "msg_fake",
+		"type":        "message",
+		"role":        "assistant",
+		"model":       Model,
+		"content":     blocks,
+		"stop_reason": stopReason,
+		"usage":       usage,
+	})
+}
+
+// contentBlocks builds the content of a reply. Must be called with s.mu held.
+func (s *Server) contentBlocks(reply Reply) []map[string]interface{} {
+	var blocks []map[string]interface{}
+	if reply.Thinking != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":      "thinking",
+			"thinking":  reply.Thinking,
+			"signature": "fake-signature",
+		})
+	}
+	if reply.Text != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": reply.Text})
+	}
+	for _, tu := range reply.ToolUses {
+		id := tu.ID
+		if id == "" {
+			s.toolSeq++
+			id = fmt.Sprintf("toolu_fake_%d", s.toolSeq)
+		}
+		input := tu.Input
+		if input == nil {
+			input = map[string]interface{}{}
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type":  "tool_use",
+			"id":    id,
+			"name":  tu.Name,
+			"input": input,
+		})
+	}
+	return blocks
+}
+
+// writeStream sends a reply as the event stream of a streamed request,
+// with each block opened empty and filled in by one delta
+func writeStream(w http.ResponseWriter, blocks []map[string]interface{}, stopReason string, usage map[string]int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(event string, data interface{}) {
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	send("message_start", map[string]interface{}{
+		"type": "message_start",
+		"message": map[string]interface{}{
+			"id":    "msg_fake",
+			"type":  "message",
+			"role":  "assistant",
+			"model": Model,
+			"usage": map[string]int{"input_tokens": usage["input_tokens"], "output_tokens": 0},
+		},
+	})
+
+	for i, block := range blocks {
+		start := map[string]interface{}{"type": block["type"]}
+		var delta map[string]interface{}
+		switch block["type"] {
+		case "thinking":
+			start["thinking"] = ""
+			delta = map[string]interface{}{"type": "thinking_delta", "thinking": block["thinking"]}
+		case "text":
+			start["text"] = ""
+			delta = map[string]interface{}{"type": "text_delta", "text": block["text"]}
+		case "tool_use":
+			start["id"], start["name"], start["input"] = block["id"], block["name"], map[string]interface{}{}
+			input, _ := json.Marshal(block["input"])
+			delta = map[string]interface{}{"type": "input_json_delta", "partial_json": string(input)}
+		}
+		send("content_block_start", map[string]interface{}{"type": "content_block_start", "index": i, "content_block": start})
+		send("content_block_delta", map[string]interface{}{"type": "content_block_delta", "index": i, "delta": delta})
+		if block["type"] == "thinking" {
+			send("content_block_delta", map[string]interface{}{
+				"type":  "content_block_delta",
+				"index": i,
+				"delta": map[string]interface{}{"type": "signature_delta", "signature": block["signature"]},
+			})
+		}
+		send("content_block_stop", map[string]interface{}{"type": "content_block_stop", "index": i})
+	}
+
+	send("message_delta", map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason},
+		"usage": map[string]int{"output_tokens": usage["output_tokens"]},
+	})
+	send("message_stop", map[string]interface{}{"type": "message_stop"})
+}
+
+// writeError answers with an error in the Messages API's format
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":  "error",
+		"error": map[string]string{"type": errorType, "message": message},
+	})
+}
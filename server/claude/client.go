@@ -2,45 +2,134 @@ package claude
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"weekend-chart/server/metrics"
 )
 
 const (
-	apiEndpoint     = "https://api.anthropic.com/v1/messages"
-	defaultModel    = "claude-sonnet-4-20250514"
-	anthropicVersion = "2023-06-01"
-	maxTokens       = 4096
+	defaultBaseURL   = "https://api.anthropic.com"
+	messagesPath     = "/v1/messages"
+	defaultModel     = "claude-sonnet-4-20250514"
+	defaultVersion   = "2023-06-01"
+	defaultMaxTokens = 4096
+
+	// minThinkingBudget is the smallest thinking budget the API accepts
+	minThinkingBudget = 1024
+
+	// responseHeaderTimeout bounds the wait for the API to start answering.
+	// There is no limit on reading the body, which a long stream may take;
+	// the request context stops it instead.
+	responseHeaderTimeout = 120 * time.Second
 )
 
 // Client is the Claude API client
 type Client struct {
-	apiKey     string
-	model      string
-	httpClient *http.Client
+	apiKey         string
+	model          string
+	endpoint       string
+	version        string
+	maxTokens      int
+	retry          RetryPolicy
+	thinkingBudget int // Extended thinking tokens per response, 0 if disabled
+	httpClient     *http.Client
 }
 
-// NewClient creates a new Claude API client
-func NewClient() *Client {
+// ClientConfig configures a Client. Zero fields take their defaults.
+type ClientConfig struct {
+	APIKey         string
+	Model          string
+	BaseURL        string // The Messages API is served under BaseURL + "/v1/messages"
+	Version        string // Sent as the anthropic-version header
+	MaxTokens      int    // Per response, not counting the thinking budget
+	ThinkingBudget int    // 0 disables extended thinking
+	Retry          *RetryPolicy
+	HTTPClient     *http.Client
+}
+
+// ThinkingBudget returns the extended thinking budget from
+// THINKING_BUDGET_TOKENS. Unset or 0 disables extended thinking; smaller
+// budgets are raised to the API's minimum.
+func ThinkingBudget() int {
+	budget, err := strconv.Atoi(os.Getenv("THINKING_BUDGET_TOKENS"))
+	if err != nil || budget <= 0 {
+		return 0
+	}
+	if budget < minThinkingBudget {
+		return minThinkingBudget
+	}
+	return budget
+}
+
+// ClientConfigFromEnv reads the configuration from ANTHROPIC_API_KEY (or
+// CLAUDE_API_KEY), ANTHROPIC_MODEL, ANTHROPIC_BASE_URL, ANTHROPIC_VERSION,
+// ANTHROPIC_MAX_TOKENS and THINKING_BUDGET_TOKENS
+func ClientConfigFromEnv() ClientConfig {
 	apiKey := os.Getenv("ANTHROPIC_API_KEY")
 	if apiKey == "" {
 		apiKey = os.Getenv("CLAUDE_API_KEY") // fallback
 	}
-	model := os.Getenv("ANTHROPIC_MODEL")
-	if model == "" {
-		model = defaultModel
+	maxTokens, _ := strconv.Atoi(os.Getenv("ANTHROPIC_MAX_TOKENS"))
+	return ClientConfig{
+		APIKey:         apiKey,
+		Model:          os.Getenv("ANTHROPIC_MODEL"),
+		BaseURL:        os.Getenv("ANTHROPIC_BASE_URL"),
+		Version:        os.Getenv("ANTHROPIC_VERSION"),
+		MaxTokens:      maxTokens,
+		ThinkingBudget: ThinkingBudget(),
 	}
-	return &Client{
-		apiKey: apiKey,
-		model:  model,
-		httpClient: &http.Client{
-			Timeout: 120 * time.Second,
-		},
+}
+
+// NewClient creates a new Claude API client configured from the environment
+func NewClient() *Client {
+	return NewClientWithConfig(ClientConfigFromEnv())
+}
+
+// NewClientWithConfig creates a Claude API client, e.g. one talking to a
+// fake server in tests
+func NewClientWithConfig(cfg ClientConfig) *Client {
+	c := &Client{
+		apiKey:         cfg.APIKey,
+		model:          cfg.Model,
+		endpoint:       strings.TrimRight(cfg.BaseURL, "/") + messagesPath,
+		version:        cfg.Version,
+		maxTokens:      cfg.MaxTokens,
+		retry:          DefaultRetryPolicy,
+		thinkingBudget: cfg.ThinkingBudget,
+		httpClient:     cfg.HTTPClient,
+	}
+	if c.model == "" {
+		c.model = defaultModel
+	}
+	if cfg.BaseURL == "" {
+		c.endpoint = defaultBaseURL + messagesPath
 	}
+	if c.version == "" {
+		c.version = defaultVersion
+	}
+	if c.maxTokens <= 0 {
+		c.maxTokens = defaultMaxTokens
+	}
+	if cfg.Retry != nil {
+		c.retry = *cfg.Retry
+	}
+	if c.thinkingBudget > 0 && c.thinkingBudget < minThinkingBudget {
+		c.thinkingBudget = minThinkingBudget
+	}
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = responseHeaderTimeout
+		c.httpClient = &http.Client{Transport: transport}
+	}
+	return c
 }
 
 // ContentBlock represents a content block in a message
@@ -54,6 +143,15 @@ type ContentBlock struct {
 	ToolUseID string          `json:"tool_use_id,omitempty"`
 	Content   string          `json:"content,omitempty"`
 	IsError   bool            `json:"is_error,omitempty"`
+
+	// Page shown in an image block, used when the image is pruned
+	PageURL   string `json:"page_url,omitempty"`
+	PageTitle string `json:"page_title,omitempty"`
+
+	// For thinking and redacted_thinking blocks, sent back unchanged
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
 }
 
 // ImageSource represents the source of an image
@@ -72,8 +170,13 @@ type ConversationMessage struct {
 // Tool represents a tool definition for Anthropic API
 type Tool struct {
 	Name        string          `json:"name"`
-	Description string          `json:"description"`
-	InputSchema json.RawMessage `json:"input_schema"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+
+	// For tools defined by Anthropic, such as the computer-use tool
+	Type            string `json:"type,omitempty"`
+	DisplayWidthPx  int    `json:"display_width_px,omitempty"`
+	DisplayHeightPx int    `json:"display_height_px,omitempty"`
 }
 
 // ToolCall represents a tool call from the model
@@ -85,70 +188,54 @@ type ToolCall struct {
 
 // ChatResponse represents the response from a chat
 type ChatResponse struct {
+	Model       string // Model that generated the response, as reported by the API
 	TextContent string
 	ToolCalls   []ToolCall
+	Thinking    []ContentBlock // thinking and redacted_thinking blocks, in order
 	StopReason  string
 	Usage       struct {
-		InputTokens  int
+		InputTokens  int // Uncached input tokens
 		OutputTokens int
+
+		// Input tokens read from and written to the prompt cache
+		CacheReadInputTokens     int
+		CacheCreationInputTokens int
 	}
 }
 
-// SystemPrompt is the default system prompt for the browser automation assistant
-const SystemPrompt = `你是一個瀏覽器自動化助手。你可以看到用戶電腦上的瀏覽器截圖，並使用工具來控制瀏覽器。
-
-【絕對禁止 - 違反會導致失敗】
-type_text 的參數只能是「要顯示在畫面上的文字」！
-按鍵操作必須用 press_key！
-
-絕對錯誤的用法（會導致失敗）：
-✗ type_text("Tab") ← 錯！會打出 "Tab" 三個字
-✗ type_text("Enter") ← 錯！會打出 "Enter" 五個字
-✗ type_text("Backspace") ← 錯！會打出 "Backspace" 九個字
-✗ type_text("20152Tab0538") ← 錯！Tab 變成文字
-
-正確用法：
-✓ press_key("Tab") ← 按下 Tab 鍵切換欄位
-✓ press_key("Enter") ← 按下 Enter 鍵
-✓ press_key("Backspace") ← 按下退格鍵刪除
-
-登入範例（account=20152, password=0538）：
-  1. click 點擊帳號欄位
-  2. type_text("20152") ← 只輸入數字
-  3. press_key("Tab") ← 用 press_key 切換欄位！
-  4. type_text("0538") ← 只輸入數字
-  5. press_key("Enter")
+// Anthropic API request/response types
+type anthropicRequest struct {
+	Model     string                 `json:"model"`
+	MaxTokens int                    `json:"max_tokens"`
+	System    []anthropicSystemBlock `json:"system,omitempty"`
+	Messages  []anthropicMessage     `json:"messages"`
+	Tools     []anthropicTool        `json:"tools,omitempty"`
+	Thinking  *anthropicThinking     `json:"thinking,omitempty"`
+	Stream    bool                   `json:"stream,omitempty"`
+}
 
-可用工具：
-- get_page_state: 【推薦】取得頁面狀態（輸入框的值、座標、focus狀態），比截圖更快更準確
-- take_screenshot: 截取當前畫面（需要看視覺內容時使用）
-- click: 點擊指定座標 (x, y)
-- type_text: 輸入純文字（不含任何按鍵！）
-- press_key: 按下按鍵（Tab、Enter、Escape、Backspace 等）
-- select_all: 全選當前輸入框內容
-- navigate: 導航到網址
-- scroll: 滾動頁面
+type anthropicThinking struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens"`
+}
 
-清除輸入框：click 該欄位 → select_all → press_key("Backspace")
+// cacheControl marks the end of a cacheable prompt prefix
+type cacheControl struct {
+	Type string `json:"type"`
+}
 
-操作流程建議：
-1. 先用 get_page_state 了解頁面有哪些輸入框和按鈕
-2. 根據返回的座標執行 click 和 type_text
-3. 操作後再用 get_page_state 確認結果（檢查輸入框的 value 是否正確）
-4. 只在需要看視覺內容時才用 take_screenshot
+// ephemeralCache is the cache breakpoint used for all cached prefixes
+var ephemeralCache = &cacheControl{Type: "ephemeral"}
 
-一般規則：
-1. 執行動作前，先描述你看到了什麼以及你要做什麼
-2. 點擊時，使用 get_page_state 返回的座標
-3. 座標系統：螢幕解析度 1920x1080`
+type anthropicSystemBlock struct {
+	Type         string        `json:"type"`
+	Text         string        `json:"text"`
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
+}
 
-// Anthropic API request/response types
-type anthropicRequest struct {
-	Model     string                `json:"model"`
-	MaxTokens int                   `json:"max_tokens"`
-	System    string                `json:"system,omitempty"`
-	Messages  []anthropicMessage    `json:"messages"`
-	Tools     []Tool                `json:"tools,omitempty"`
+type anthropicTool struct {
+	Tool
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
 }
 
 type anthropicMessage struct {
@@ -164,23 +251,43 @@ type anthropicResponse struct {
 	Model        string `json:"model"`
 	StopReason   string `json:"stop_reason"`
 	StopSequence string `json:"stop_sequence"`
-	Usage        struct {
-		InputTokens  int `json:"input_tokens"`
-		OutputTokens int `json:"output_tokens"`
-	} `json:"usage"`
+	Usage        anthropicUsage `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
 }
 
 type anthropicContentBlock struct {
-	Type  string          `json:"type"`
-	Text  string          `json:"text,omitempty"`
-	ID    string          `json:"id,omitempty"`
-	Name  string          `json:"name,omitempty"`
-	Input json.RawMessage `json:"input,omitempty"`
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+	Data      string          `json:"data,omitempty"`
 }
 
-type anthropicTextContent struct {
+// Thinking blocks can't carry a cache breakpoint
+type anthropicThinkingContent struct {
+	Type      string `json:"type"`
+	Thinking  string `json:"thinking"`
+	Signature string `json:"signature"`
+}
+
+type anthropicRedactedThinkingContent struct {
 	Type string `json:"type"`
-	Text string `json:"text"`
+	Data string `json:"data"`
+}
+
+type anthropicTextContent struct {
+	Type         string        `json:"type"`
+	Text         string        `json:"text"`
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
 }
 
 type anthropicImageContent struct {
@@ -190,20 +297,23 @@ type anthropicImageContent struct {
 		MediaType string `json:"media_type"`
 		Data      string `json:"data"`
 	} `json:"source"`
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
 }
 
 type anthropicToolUseContent struct {
-	Type  string          `json:"type"`
-	ID    string          `json:"id"`
-	Name  string          `json:"name"`
-	Input json.RawMessage `json:"input"`
+	Type         string          `json:"type"`
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Input        json.RawMessage `json:"input"`
+	CacheControl *cacheControl   `json:"cache_control,omitempty"`
 }
 
 type anthropicToolResultContent struct {
-	Type      string `json:"type"`
-	ToolUseID string `json:"tool_use_id"`
-	Content   string `json:"content"`
-	IsError   bool   `json:"is_error,omitempty"`
+	Type         string        `json:"type"`
+	ToolUseID    string        `json:"tool_use_id"`
+	Content      string        `json:"content"`
+	IsError      bool          `json:"is_error,omitempty"`
+	CacheControl *cacheControl `json:"cache_control,omitempty"`
 }
 
 func toAnthropicMessages(messages []ConversationMessage) []anthropicMessage {
@@ -214,6 +324,17 @@ func toAnthropicMessages(messages []ConversationMessage) []anthropicMessage {
 
 		for _, block := range msg.Content {
 			switch block.Type {
+			case "thinking":
+				content = append(content, anthropicThinkingContent{
+					Type:      "thinking",
+					Thinking:  block.Thinking,
+					Signature: block.Signature,
+				})
+			case "redacted_thinking":
+				content = append(content, anthropicRedactedThinkingContent{
+					Type: "redacted_thinking",
+					Data: block.Data,
+				})
 			case "text":
 				content = append(content, anthropicTextContent{
 					Type: "text",
@@ -255,48 +376,99 @@ func toAnthropicMessages(messages []ConversationMessage) []anthropicMessage {
 	return out
 }
 
-// Chat sends a chat message to Anthropic Claude API
-func (c *Client) Chat(messages []ConversationMessage, tools []Tool) (*ChatResponse, error) {
-	if c.apiKey == "" {
-		return nil, fmt.Errorf("ANTHROPIC_API_KEY not set")
+// Prompt caching: the system prompt and tool definitions never change during
+// a task, and each loop iteration only appends to the conversation. A
+// breakpoint after the tools and a rolling one on the last message let the
+// next request read everything up to that point from the cache.
+
+// systemBlocks returns the system prompt as a cached block
+func systemBlocks(prompt string) []anthropicSystemBlock {
+	if prompt == "" {
+		return nil
 	}
+	return []anthropicSystemBlock{{Type: "text", Text: prompt, CacheControl: ephemeralCache}}
+}
 
-	req := anthropicRequest{
-		Model:     c.model,
-		MaxTokens: maxTokens,
-		System:    SystemPrompt,
-		Messages:  toAnthropicMessages(messages),
-		Tools:     tools,
+// cachedTools returns the tool definitions with a breakpoint after the last one
+func cachedTools(tools []Tool) []anthropicTool {
+	out := make([]anthropicTool, len(tools))
+	for i, t := range tools {
+		out[i] = anthropicTool{Tool: t}
+	}
+	if len(out) > 0 {
+		out[len(out)-1].CacheControl = ephemeralCache
 	}
+	return out
+}
 
-	jsonBody, err := json.Marshal(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+// markLastMessageCached puts the rolling breakpoint on the last block of the
+// last message, which becomes part of the stable prefix of the next request
+func markLastMessageCached(messages []anthropicMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	content := messages[len(messages)-1].Content
+	if len(content) == 0 {
+		return
 	}
 
-	httpReq, err := http.NewRequest("POST", apiEndpoint, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	switch block := content[len(content)-1].(type) {
+	case anthropicTextContent:
+		block.CacheControl = ephemeralCache
+		content[len(content)-1] = block
+	case anthropicImageContent:
+		block.CacheControl = ephemeralCache
+		content[len(content)-1] = block
+	case anthropicToolUseContent:
+		block.CacheControl = ephemeralCache
+		content[len(content)-1] = block
+	case anthropicToolResultContent:
+		block.CacheControl = ephemeralCache
+		content[len(content)-1] = block
 	}
+}
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", c.apiKey)
-	httpReq.Header.Set("anthropic-version", anthropicVersion)
+// setUsage copies the usage reported by the API into the response
+func (r *ChatResponse) setUsage(u anthropicUsage) {
+	r.Usage.InputTokens = u.InputTokens
+	r.Usage.OutputTokens = u.OutputTokens
+	r.Usage.CacheReadInputTokens = u.CacheReadInputTokens
+	r.Usage.CacheCreationInputTokens = u.CacheCreationInputTokens
+}
+
+// recordTokenMetrics adds a response's usage to the token counters
+func recordTokenMetrics(r *ChatResponse) {
+	metrics.ClaudeTokens.Add(float64(r.Usage.InputTokens), "input")
+	metrics.ClaudeTokens.Add(float64(r.Usage.OutputTokens), "output")
+	metrics.ClaudeTokens.Add(float64(r.Usage.CacheReadInputTokens), "cache_read")
+	metrics.ClaudeTokens.Add(float64(r.Usage.CacheCreationInputTokens), "cache_creation")
+}
+
+// Name returns the provider name of the Anthropic client
+func (c *Client) Name() string {
+	return ProviderAnthropic
+}
 
-	resp, err := c.httpClient.Do(httpReq)
+// Chat sends a chat message to Anthropic Claude API
+func (c *Client) Chat(ctx context.Context, system string, messages []ConversationMessage, tools []Tool) (*ChatResponse, error) {
+	if c.apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY not set")
+	}
+
+	resp, start, err := c.send(ctx, func() (*http.Request, error) {
+		return c.newRequest(ctx, system, messages, tools, false)
+	}, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
-	}
+	metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "ok")
 
 	var apiResp anthropicResponse
 	if err := json.Unmarshal(body, &apiResp); err != nil {
@@ -305,13 +477,25 @@ func (c *Client) Chat(messages []ConversationMessage, tools []Tool) (*ChatRespon
 
 	// Parse response content
 	chatResp := &ChatResponse{
+		Model:      apiResp.Model,
 		StopReason: apiResp.StopReason,
 	}
-	chatResp.Usage.InputTokens = apiResp.Usage.InputTokens
-	chatResp.Usage.OutputTokens = apiResp.Usage.OutputTokens
+	chatResp.setUsage(apiResp.Usage)
+	recordTokenMetrics(chatResp)
 
 	for _, block := range apiResp.Content {
 		switch block.Type {
+		case "thinking":
+			chatResp.Thinking = append(chatResp.Thinking, ContentBlock{
+				Type:      "thinking",
+				Thinking:  block.Thinking,
+				Signature: block.Signature,
+			})
+		case "redacted_thinking":
+			chatResp.Thinking = append(chatResp.Thinking, ContentBlock{
+				Type: "redacted_thinking",
+				Data: block.Data,
+			})
 		case "text":
 			if chatResp.TextContent != "" {
 				chatResp.TextContent += "\n"
@@ -329,6 +513,42 @@ func (c *Client) Chat(messages []ConversationMessage, tools []Tool) (*ChatRespon
 	return chatResp, nil
 }
 
+// newRequest builds the HTTP request for the Messages API
+func (c *Client) newRequest(ctx context.Context, system string, messages []ConversationMessage, tools []Tool, stream bool) (*http.Request, error) {
+	req := anthropicRequest{
+		Model:     c.model,
+		MaxTokens: c.maxTokens,
+		System:    systemBlocks(system),
+		Messages:  toAnthropicMessages(messages),
+		Tools:     cachedTools(tools),
+		Stream:    stream,
+	}
+	if c.thinkingBudget > 0 {
+		// The budget is part of max_tokens, so the answer keeps its room
+		req.Thinking = &anthropicThinking{Type: "enabled", BudgetTokens: c.thinkingBudget}
+		req.MaxTokens += c.thinkingBudget
+	}
+	markLastMessageCached(req.Messages)
+
+	jsonBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", c.apiKey)
+	httpReq.Header.Set("anthropic-version", c.version)
+	if usesComputerTool(tools) {
+		httpReq.Header.Set("anthropic-beta", computerUseBeta)
+	}
+	return httpReq, nil
+}
+
 // CreateTextMessage creates a simple text message
 func CreateTextMessage(role, text string) ConversationMessage {
 	return ConversationMessage{
@@ -416,18 +636,37 @@ func CreateToolResultMessage(results []ToolResult) ConversationMessage {
 	}
 }
 
+// ThinkingText returns the text of the response's thinking blocks; redacted
+// thinking has none
+func (r *ChatResponse) ThinkingText() string {
+	var parts []string
+	for _, block := range r.Thinking {
+		if block.Type == "thinking" && block.Thinking != "" {
+			parts = append(parts, block.Thinking)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
 // CreateAssistantToolUseMessage creates an assistant message with tool uses
 func CreateAssistantToolUseMessage(textContent string, toolCalls []ToolCall) ConversationMessage {
-	content := []ContentBlock{}
+	return CreateAssistantMessage(&ChatResponse{TextContent: textContent, ToolCalls: toolCalls})
+}
+
+// CreateAssistantMessage records a response in the conversation. Thinking
+// blocks come first and are kept as they are: the API checks their
+// signatures when the conversation continues after a tool use.
+func CreateAssistantMessage(resp *ChatResponse) ConversationMessage {
+	content := append([]ContentBlock{}, resp.Thinking...)
 
-	if textContent != "" {
+	if resp.TextContent != "" {
 		content = append(content, ContentBlock{
 			Type: "text",
-			Text: textContent,
+			Text: resp.TextContent,
 		})
 	}
 
-	for _, tc := range toolCalls {
+	for _, tc := range resp.ToolCalls {
 		content = append(content, ContentBlock{
 			Type:  "tool_use",
 			ID:    tc.ID,
@@ -449,6 +688,16 @@ type ToolResult struct {
 	IsError   bool   `json:"is_error,omitempty"`
 }
 
+// CancelledToolResult is the result recorded for a tool call that was
+// never executed because the task was cancelled
+func CancelledToolResult(toolUseID string) ToolResult {
+	return ToolResult{
+		ToolUseID: toolUseID,
+		Content:   "操作已被使用者取消",
+		IsError:   true,
+	}
+}
+
 // GetAPIKey returns the API key status (redacted for safety).
 func (c *Client) GetAPIKey() string {
 	if c.apiKey == "" {
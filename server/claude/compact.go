@@ -0,0 +1,167 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"weekend-chart/server/models"
+)
+
+const (
+	// defaultContextTokenBudget is the estimated conversation size above
+	// which older turns are summarized
+	defaultContextTokenBudget = 60000
+
+	// keepRecentMessages is how many of the latest messages compaction
+	// always keeps verbatim
+	keepRecentMessages = 8
+
+	// imageTokenEstimate is roughly what one 1920x1080 screenshot costs
+	imageTokenEstimate = 1600
+)
+
+// SummaryPrefix starts the message that replaces compacted turns
+const SummaryPrefix = "【先前對話摘要】"
+
+const summaryInstruction = `請將以下瀏覽器自動化對話整理成摘要，讓你之後能接續這個任務。
+請保留：
+1. 使用者的目標與要求
+2. 已完成的步驟與目前進度（目前所在的網頁、已填寫的欄位、已登入的帳號等）
+3. 重要事實（網址、帳號名稱、選項、錯誤訊息與解法）
+4. 尚未完成的步驟
+只輸出摘要本身，不要呼叫任何工具。
+
+對話內容：
+`
+
+// ContextTokenBudget returns the conversation size that triggers
+// compaction, from CONTEXT_TOKEN_BUDGET
+func ContextTokenBudget() int {
+	if v, err := strconv.Atoi(os.Getenv("CONTEXT_TOKEN_BUDGET")); err == nil && v > 0 {
+		return v
+	}
+	return defaultContextTokenBudget
+}
+
+// EstimateTokens gives a rough token count for messages. Text is counted at
+// about three bytes per token, which is close for both English and Chinese.
+func EstimateTokens(messages []ConversationMessage) int {
+	tokens := 0
+	for _, msg := range messages {
+		for _, block := range msg.Content {
+			switch block.Type {
+			case "image":
+				tokens += imageTokenEstimate
+			default:
+				tokens += (len(block.Text) + len(block.Thinking) + len(block.Input) + len(block.Content)) / 3
+			}
+		}
+	}
+	return tokens
+}
+
+// compactionSplit returns the index of the first message to keep verbatim,
+// or 0 if there is nothing to compact. The split never separates a tool_use
+// from its tool_result.
+func compactionSplit(messages []ConversationMessage) int {
+	for split := len(messages) - keepRecentMessages; split > 1; split-- {
+		if hasBlockType(messages[split], "tool_result") {
+			continue
+		}
+		if hasBlockType(messages[split-1], "tool_use") {
+			continue
+		}
+		return split
+	}
+	return 0
+}
+
+func hasBlockType(msg ConversationMessage, blockType string) bool {
+	for _, block := range msg.Content {
+		if block.Type == blockType {
+			return true
+		}
+	}
+	return false
+}
+
+// transcript renders messages as plain text for the summarizer
+func transcript(messages []ConversationMessage) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		for _, block := range msg.Content {
+			switch block.Type {
+			case "text":
+				fmt.Fprintf(&b, "[%s] %s\n", msg.Role, block.Text)
+			case "image":
+				fmt.Fprintf(&b, "[%s] (截圖)\n", msg.Role)
+			case "tool_use":
+				fmt.Fprintf(&b, "[%s] 呼叫工具 %s %s\n", msg.Role, block.Name, string(block.Input))
+			case "tool_result":
+				status := "結果"
+				if block.IsError {
+					status = "錯誤"
+				}
+				fmt.Fprintf(&b, "[工具%s] %s\n", status, block.Content)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Compact replaces older turns with a summary written by the provider when
+// the conversation is estimated to exceed budget. Recent turns are kept as
+// they are. Returns the summarization response, or nil if nothing was
+// compacted. The stored history is kept; the summary is stored with the
+// conversation, so it also replaces the older turns when the conversation
+// is resumed.
+func (c *Conversation) Compact(ctx context.Context, p Provider, budget int) (*ChatResponse, error) {
+	messages := c.GetMessages()
+	if EstimateTokens(messages) <= budget {
+		return nil, nil
+	}
+
+	split := compactionSplit(messages)
+	if split == 0 {
+		return nil, nil
+	}
+
+	request := []ConversationMessage{
+		CreateTextMessage("user", summaryInstruction+transcript(messages[:split])),
+	}
+	resp, err := p.Chat(ctx, "", request, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to summarize conversation: %w", err)
+	}
+	if strings.TrimSpace(resp.TextContent) == "" {
+		return resp, fmt.Errorf("summary was empty")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.Messages) < split {
+		// The conversation was reset while summarizing
+		return resp, nil
+	}
+
+	// Messages added while summarizing are kept after the summary
+	kept := len(c.Messages) - split
+	c.Messages = append([]ConversationMessage{summaryMessage(resp.TextContent)}, c.Messages[split:]...)
+
+	if c.DBID != 0 {
+		if err := models.SetConversationSummary(c.DBID, resp.TextContent, kept); err != nil {
+			log.Printf("Failed to store summary of conversation %d: %v", c.DBID, err)
+		}
+	}
+	return resp, nil
+}
+
+// summaryMessage is the message that stands in for compacted turns
+func summaryMessage(summary string) ConversationMessage {
+	return CreateTextMessage("user", SummaryPrefix+"\n"+summary)
+}
@@ -0,0 +1,79 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"weekend-chart/server/models"
+)
+
+// TestMain opens a database in a temporary directory for the tests that
+// store conversations
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "claude-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := models.InitDB(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	models.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestCompactStoresSummary(t *testing.T) {
+	manager := NewConversationManager()
+	conv, err := manager.Create(1, "agent-compact", "")
+	if err != nil {
+		t.Fatalf("create conversation: %v", err)
+	}
+	for i := 0; i < 12; i++ {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		conv.AddMessage(CreateTextMessage(role, fmt.Sprintf("message %d %s", i, strings.Repeat("x", 300))))
+	}
+
+	fake := NewFakeProvider(FakeResponse{Response: &ChatResponse{TextContent: "目標：登入網站"}})
+	resp, err := conv.Compact(context.Background(), fake, 100)
+	if err != nil || resp == nil {
+		t.Fatalf("Compact = %v, %v", resp, err)
+	}
+
+	compacted := conv.GetMessages()
+	if len(compacted) != keepRecentMessages+1 || !strings.HasPrefix(compacted[0].Content[0].Text, SummaryPrefix) {
+		t.Fatalf("compacted to %d messages starting with %q", len(compacted), compacted[0].Content[0].Text)
+	}
+	conv.AddMessage(CreateTextMessage("user", "message 12"))
+
+	// A fresh manager resumes from the summary, not the full history
+	resumed, err := NewConversationManager().Get(1, "agent-compact", conv.DBID)
+	if err != nil {
+		t.Fatalf("resume conversation: %v", err)
+	}
+	got, want := resumed.GetMessages(), conv.GetMessages()
+	if len(got) != len(want) {
+		t.Fatalf("resumed %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Role != want[i].Role || got[i].Content[0].Text != want[i].Content[0].Text {
+			t.Errorf("message %d = %s %.20q, want %s %.20q", i, got[i].Role, got[i].Content[0].Text, want[i].Role, want[i].Content[0].Text)
+		}
+	}
+
+	// The stored history still has every message
+	stored, err := models.GetConversationMessages(conv.DBID, 0)
+	if err != nil || len(stored) != 13 {
+		t.Errorf("stored %d messages (err: %v), want 13", len(stored), err)
+	}
+}
@@ -0,0 +1,302 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tool modes an agent can be driven with
+const (
+	ToolModeBrowser  = "browser"  // Custom click/type_text/press_key tools
+	ToolModeComputer = "computer" // Anthropic's computer-use tool
+
+	// DefaultToolMode is used when the agent has no mode set
+	DefaultToolMode = ToolModeBrowser
+)
+
+// ComputerToolName is the name the computer-use tool is called by
+const ComputerToolName = "computer"
+
+const (
+	computerToolType = "computer_20250124"
+	computerUseBeta  = "computer-use-2025-01-24"
+)
+
+// maxComputerWait is the longest "wait" action the model may ask for
+const maxComputerWait = 10 * time.Second
+
+// scrollClickPixels is how far one scroll wheel click of the computer-use
+// tool scrolls the page
+const scrollClickPixels = 100
+
+// ValidToolMode reports whether mode is a known tool mode
+func ValidToolMode(mode string) bool {
+	return mode == ToolModeBrowser || mode == ToolModeComputer
+}
+
+// computerModeTools are the custom tools still offered in computer mode:
+// the headless browser has no address bar, and its dropdowns don't show
+// up in screenshots
+var computerModeTools = map[string]bool{
+	"navigate":      true,
+	"select_option": true,
+}
+
+// GetComputerTools returns the computer-use tool for a display of the given
+// size, together with the browser tools it can't replace
+func GetComputerTools(width, height int) []Tool {
+	if width <= 0 || height <= 0 {
+		width, height = DefaultViewportWidth, DefaultViewportHeight
+	}
+	tools := []Tool{{
+		Type:            computerToolType,
+		Name:            ComputerToolName,
+		DisplayWidthPx:  width,
+		DisplayHeightPx: height,
+	}}
+	for _, t := range GetBrowserTools() {
+		if computerModeTools[t.Name] {
+			tools = append(tools, t)
+		}
+	}
+	return tools
+}
+
+// usesComputerTool reports whether tools include the computer-use tool,
+// which needs the beta header
+func usesComputerTool(tools []Tool) bool {
+	for _, t := range tools {
+		if strings.HasPrefix(t.Type, "computer_") {
+			return true
+		}
+	}
+	return false
+}
+
+// ComputerInput is the input of a computer-use tool call
+type ComputerInput struct {
+	Action          string  `json:"action"`
+	Coordinate      []int   `json:"coordinate,omitempty"`
+	StartCoordinate []int   `json:"start_coordinate,omitempty"`
+	Text            string  `json:"text,omitempty"`
+	ScrollDirection string  `json:"scroll_direction,omitempty"`
+	ScrollAmount    int     `json:"scroll_amount,omitempty"`
+	Duration        float64 `json:"duration,omitempty"`
+}
+
+// IsScreenshotCall reports whether a tool call only takes a screenshot
+func IsScreenshotCall(tc ToolCall) bool {
+	if tc.Name == "take_screenshot" {
+		return true
+	}
+	if tc.Name != ComputerToolName {
+		return false
+	}
+	var input ComputerInput
+	return json.Unmarshal(tc.Input, &input) == nil && input.Action == "screenshot"
+}
+
+// computerKeys maps xdotool key names, which the computer-use tool uses, to
+// the key names the agent understands
+var computerKeys = map[string]string{
+	"return":    "Enter",
+	"enter":     "Enter",
+	"kp_enter":  "Enter",
+	"tab":       "Tab",
+	"backspace": "Backspace",
+	"escape":    "Escape",
+	"esc":       "Escape",
+	"delete":    "Delete",
+	"up":        "ArrowUp",
+	"down":      "ArrowDown",
+	"left":      "ArrowLeft",
+	"right":     "ArrowRight",
+	"page_up":   "PageUp",
+	"prior":     "PageUp",
+	"page_down": "PageDown",
+	"next":      "PageDown",
+	"home":      "Home",
+	"end":       "End",
+	"space":     " ",
+}
+
+var computerModifiers = map[string]string{
+	"ctrl":    "ctrl",
+	"control": "ctrl",
+	"shift":   "shift",
+	"alt":     "alt",
+	"super":   "meta",
+	"cmd":     "meta",
+	"meta":    "meta",
+}
+
+// translateComputerKey turns an xdotool key such as "Return" or "ctrl+a"
+// into the agent's key name, with modifiers joined by "+"
+func translateComputerKey(key string) string {
+	parts := strings.Split(strings.TrimSpace(key), "+")
+	for i, part := range parts {
+		lower := strings.ToLower(part)
+		if i < len(parts)-1 {
+			if modifier, ok := computerModifiers[lower]; ok {
+				parts[i] = modifier
+			}
+			continue
+		}
+		if name, ok := computerKeys[lower]; ok {
+			parts[i] = name
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// executeComputerAction runs a computer-use tool call. Actions the browser
+// tools already cover are run as those tools, so policies and approvals
+// apply the same way in both modes.
+func (te *ToolExecutor) executeComputerAction(ctx context.Context, tc ToolCall) (ToolResult, string, error) {
+	result := ToolResult{ToolUseID: tc.ID}
+
+	var input ComputerInput
+	if err := json.Unmarshal(tc.Input, &input); err != nil {
+		result.Content = fmt.Sprintf("解析 computer 參數失敗: %v", err)
+		result.IsError = true
+		return result, "", nil
+	}
+	if te.toolPolicy.ToolDisabled(ComputerToolName) {
+		result.Content = fmt.Sprintf("此 Agent 已停用工具 %s", ComputerToolName)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	x, y := te.computerPoint(input.Coordinate)
+
+	// Run as the equivalent browser tool
+	delegate := func(name string, toolInput interface{}) (ToolResult, string, error) {
+		data, _ := json.Marshal(toolInput)
+		return te.ExecuteTool(ctx, ToolCall{ID: tc.ID, Name: name, Input: data})
+	}
+
+	switch input.Action {
+	case "screenshot":
+		return delegate("take_screenshot", struct{}{})
+
+	case "cursor_position":
+		result.Content = fmt.Sprintf("X=%d, Y=%d", te.cursorX, te.cursorY)
+		return result, "", nil
+
+	case "left_click":
+		te.cursorX, te.cursorY = x, y
+		return delegate("click", ClickInput{X: x, Y: y, Description: fmt.Sprintf("(%d, %d)", x, y)})
+
+	case "type":
+		return delegate("type_text", TypeTextInput{Text: input.Text})
+
+	case "key":
+		key := translateComputerKey(input.Text)
+		if strings.EqualFold(key, "ctrl+a") {
+			return delegate("select_all", struct{}{})
+		}
+		return delegate("press_key", PressKeyInput{Key: key})
+
+	case "scroll":
+		amount := input.ScrollAmount
+		if amount <= 0 {
+			amount = 5
+		}
+		te.cursorX, te.cursorY = x, y
+		return delegate("scroll", ScrollInput{Direction: input.ScrollDirection, Amount: amount * scrollClickPixels})
+
+	case "wait":
+		wait := time.Duration(input.Duration * float64(time.Second))
+		if wait <= 0 || wait > maxComputerWait {
+			wait = maxComputerWait
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return CancelledToolResult(tc.ID), "", nil
+		case <-timer.C:
+		}
+		result.Content = fmt.Sprintf("已等待 %.1f 秒", wait.Seconds())
+		return result, "等待", nil
+	}
+
+	// The remaining actions have no browser tool, so check them here
+	var action BrowserAction
+	var done, description string
+	switch input.Action {
+	case "mouse_move":
+		action = BrowserAction{Type: "mouse_move", X: x, Y: y}
+		done, description = fmt.Sprintf("已移動滑鼠到 (%d, %d)", x, y), "移動滑鼠"
+	case "double_click", "triple_click":
+		count := 2
+		if input.Action == "triple_click" {
+			count = 3
+		}
+		action = BrowserAction{Type: "click_xy", X: x, Y: y, Button: "left", ClickCount: count}
+		done, description = fmt.Sprintf("已在 (%d, %d) 連點 %d 下", x, y, count), fmt.Sprintf("連點 %d 下", count)
+	case "right_click", "middle_click":
+		button := strings.TrimSuffix(input.Action, "_click")
+		action = BrowserAction{Type: "click_xy", X: x, Y: y, Button: button, ClickCount: 1}
+		done, description = fmt.Sprintf("已在 (%d, %d) 按下滑鼠%s鍵", x, y, buttonNames[button]), fmt.Sprintf("按下滑鼠%s鍵", buttonNames[button])
+	case "left_click_drag":
+		fromX, fromY := te.computerPoint(input.StartCoordinate)
+		action = BrowserAction{Type: "drag", X: fromX, Y: fromY, ToX: x, ToY: y}
+		done, description = fmt.Sprintf("已從 (%d, %d) 拖曳到 (%d, %d)", fromX, fromY, x, y), "拖曳"
+	default:
+		result.Content = fmt.Sprintf("不支援的 computer 動作: %s", input.Action)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	if denied := te.checkToolPolicy(tc); denied != nil {
+		return *denied, "", nil
+	}
+	if denied := te.checkApproval(ctx, tc); denied != nil {
+		return *denied, "", nil
+	}
+	if err := te.agent.SendAction(ctx, action); err != nil {
+		result.Content = fmt.Sprintf("%s失敗: %v", description, err)
+		result.IsError = true
+		return result, "", nil
+	}
+	te.cursorX, te.cursorY = x, y
+	result.Content = done
+	return result, description, nil
+}
+
+// computerPoint returns the point a coordinate of a computer action names,
+// or the mouse position if it has none
+func (te *ToolExecutor) computerPoint(coordinate []int) (int, int) {
+	if len(coordinate) == 2 {
+		return coordinate[0], coordinate[1]
+	}
+	return te.cursorX, te.cursorY
+}
+
+// computerClickPoints returns where a computer action without a browser
+// tool presses and releases the left button, so the approval policy can
+// check it like a click. Other actions return nil.
+func (te *ToolExecutor) computerClickPoints(tc ToolCall) [][2]int {
+	var input ComputerInput
+	if json.Unmarshal(tc.Input, &input) != nil {
+		return nil
+	}
+	x, y := te.computerPoint(input.Coordinate)
+	switch input.Action {
+	case "double_click", "triple_click":
+		return [][2]int{{x, y}}
+	case "left_click_drag":
+		fromX, fromY := te.computerPoint(input.StartCoordinate)
+		return [][2]int{{fromX, fromY}, {x, y}}
+	}
+	return nil
+}
+
+var buttonNames = map[string]string{
+	"right":  "右",
+	"middle": "中",
+}
@@ -0,0 +1,59 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// submitButtonPage is a page state with a submit button at (300, 400)
+const submitButtonPage = `{"url":"https://example.com/","inputs":[],"buttons":[{"text":"送出","type":"submit","x":300,"y":400}]}`
+
+func TestComputerClicksNeedApprovalOnSubmitButtons(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantApproval bool
+	}{
+		{"left click on the button", `{"action":"left_click","coordinate":[300,400]}`, true},
+		{"double click on the button", `{"action":"double_click","coordinate":[300,400]}`, true},
+		{"triple click on the button", `{"action":"triple_click","coordinate":[302,398]}`, true},
+		{"double click elsewhere", `{"action":"double_click","coordinate":[50,50]}`, false},
+		{"drag from the button", `{"action":"left_click_drag","start_coordinate":[300,400],"coordinate":[50,50]}`, true},
+		{"drag onto the button", `{"action":"left_click_drag","start_coordinate":[50,50],"coordinate":[300,400]}`, true},
+		{"drag elsewhere", `{"action":"left_click_drag","start_coordinate":[50,50],"coordinate":[80,80]}`, false},
+		{"right click on the button", `{"action":"right_click","coordinate":[300,400]}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &testAgent{pageState: submitButtonPage}
+			approver := &testApprover{approve: false}
+			te := NewToolExecutor(agent)
+			te.RequireApproval(NewApprovalPolicy(ApprovalSubmit), approver)
+
+			result, _, err := te.ExecuteTool(context.Background(), ToolCall{
+				ID: "toolu_1", Name: ComputerToolName, Input: json.RawMessage(tt.input),
+			})
+			if err != nil {
+				t.Fatalf("computer: %v", err)
+			}
+
+			asked := len(approver.requests) > 0
+			if asked != tt.wantApproval {
+				t.Fatalf("approval requested = %v, want %v (%+v)", asked, tt.wantApproval, approver.requests)
+			}
+			if asked {
+				if approver.requests[0].Rule != ApprovalSubmit || approver.requests[0].Description != "點擊送出按鈕「送出」" {
+					t.Errorf("approval request = %+v", approver.requests[0])
+				}
+				// The user declined, so nothing reached the agent
+				if !result.IsError || len(agent.actions) != 0 {
+					t.Errorf("declined call ran: result %+v, actions %+v", result, agent.actions)
+				}
+			} else if result.IsError || len(agent.actions) != 1 {
+				t.Errorf("call didn't run: result %+v, actions %+v", result, agent.actions)
+			}
+		})
+	}
+}
@@ -1,16 +1,25 @@
 package claude
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"strconv"
 	"sync"
 	"time"
+
+	"weekend-chart/server/models"
 )
 
-// Conversation represents a chat conversation
+// Conversation represents a chat conversation. Messages holds the working
+// context sent to the model; every message is also stored in the database.
 type Conversation struct {
 	ID         string
+	DBID       int64 // 0 if the conversation could not be stored
 	UserID     int64
 	AgentToken string
+	Title      string
 	Messages   []ConversationMessage
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
@@ -33,31 +42,38 @@ func NewConversationManager() *ConversationManager {
 // GlobalConversationManager is the global conversation manager
 var GlobalConversationManager = NewConversationManager()
 
-// getConversationID generates a unique conversation ID
-func getConversationID(userID int64, agentToken string) string {
-	return fmt.Sprintf("%d:%s", userID, agentToken)
+// ErrConversationNotFound is returned for conversations that don't exist or
+// belong to another user or agent
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// getConversationID generates the in-memory ID of a stored conversation
+func getConversationID(dbID int64) string {
+	return strconv.FormatInt(dbID, 10)
 }
 
-// GetOrCreate gets an existing conversation or creates a new one
+// GetOrCreate returns the most recent unarchived conversation of a user with
+// an agent, starting a new one if there is none
 func (m *ConversationManager) GetOrCreate(userID int64, agentToken string) *Conversation {
-	id := getConversationID(userID, agentToken)
+	stored, err := models.GetLatestConversation(userID, agentToken)
+	if err == nil {
+		return m.load(stored)
+	}
 
-	m.mu.RLock()
-	if conv, ok := m.conversations[id]; ok {
-		m.mu.RUnlock()
-		return conv
+	if err == sql.ErrNoRows {
+		if conv, err := m.Create(userID, agentToken, ""); err == nil {
+			return conv
+		}
 	}
-	m.mu.RUnlock()
 
-	// Create new conversation
+	// The database is unavailable; keep the conversation in memory only
+	log.Printf("Failed to store conversation for user %d: %v", userID, err)
+	id := fmt.Sprintf("%d:%s", userID, agentToken)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
-
-	// Double-check after acquiring write lock
 	if conv, ok := m.conversations[id]; ok {
 		return conv
 	}
-
 	conv := &Conversation{
 		ID:         id,
 		UserID:     userID,
@@ -70,24 +86,117 @@ func (m *ConversationManager) GetOrCreate(userID int64, agentToken string) *Conv
 	return conv
 }
 
-// Get retrieves a conversation by ID
-func (m *ConversationManager) Get(userID int64, agentToken string) *Conversation {
-	id := getConversationID(userID, agentToken)
-
+// Get returns a stored conversation of a user with an agent, loading it
+// from the database if needed
+func (m *ConversationManager) Get(userID int64, agentToken string, dbID int64) (*Conversation, error) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
+	conv, ok := m.conversations[getConversationID(dbID)]
+	m.mu.RUnlock()
+	if ok {
+		if conv.UserID != userID || conv.AgentToken != agentToken {
+			return nil, ErrConversationNotFound
+		}
+		return conv, nil
+	}
 
-	return m.conversations[id]
+	stored, err := models.GetConversation(userID, dbID)
+	if err == sql.ErrNoRows || (err == nil && stored.AgentToken != agentToken) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.load(stored), nil
 }
 
-// Delete removes a conversation
-func (m *ConversationManager) Delete(userID int64, agentToken string) {
-	id := getConversationID(userID, agentToken)
+// Create starts a new conversation of a user with an agent
+func (m *ConversationManager) Create(userID int64, agentToken, title string) (*Conversation, error) {
+	dbID, err := models.CreateConversation(userID, agentToken, title)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	conv := &Conversation{
+		ID:         getConversationID(dbID),
+		DBID:       dbID,
+		UserID:     userID,
+		AgentToken: agentToken,
+		Title:      title,
+		Messages:   []ConversationMessage{},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conversations[conv.ID] = conv
+	return conv, nil
+}
+
+// load returns the in-memory conversation for a stored one, resuming its
+// history from the database if it isn't loaded yet
+func (m *ConversationManager) load(stored *models.StoredConversation) *Conversation {
+	id := getConversationID(stored.ID)
+
+	m.mu.RLock()
+	if conv, ok := m.conversations[id]; ok {
+		m.mu.RUnlock()
+		return conv
+	}
+	m.mu.RUnlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Double-check after acquiring write lock
+	if conv, ok := m.conversations[id]; ok {
+		return conv
+	}
 
+	conv := &Conversation{
+		ID:         id,
+		DBID:       stored.ID,
+		UserID:     stored.UserID,
+		AgentToken: stored.AgentToken,
+		Title:      stored.Title,
+		Messages:   loadHistory(stored),
+		CreatedAt:  stored.CreatedAt,
+		UpdatedAt:  stored.UpdatedAt,
+	}
+	m.conversations[id] = conv
+	return conv
+}
+
+// Evict drops a conversation from memory if it is loaded, e.g. after its
+// stored history was deleted
+func (m *ConversationManager) Evict(userID, dbID int64) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.conversations, id)
+	id := getConversationID(dbID)
+	if conv, ok := m.conversations[id]; ok && conv.UserID == userID {
+		delete(m.conversations, id)
+	}
+}
+
+// Rename changes the title of a user's stored conversation, including its
+// loaded copy. Returns false if the conversation doesn't belong to the user.
+func (m *ConversationManager) Rename(userID, dbID int64, title string) (bool, error) {
+	renamed, err := models.RenameConversation(userID, dbID, title)
+	if err != nil || !renamed {
+		return renamed, err
+	}
+
+	m.mu.RLock()
+	conv, ok := m.conversations[getConversationID(dbID)]
+	m.mu.RUnlock()
+	if ok {
+		conv.mu.Lock()
+		conv.Title = title
+		conv.mu.Unlock()
+	}
+	return true, nil
 }
 
 // Clear removes all conversations for a user
@@ -102,6 +211,27 @@ func (m *ConversationManager) ClearForUser(userID int64) {
 	}
 }
 
+// SetTitle renames the conversation
+func (c *Conversation) SetTitle(title string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.DBID != 0 {
+		if _, err := models.RenameConversation(c.UserID, c.DBID, title); err != nil {
+			return err
+		}
+	}
+	c.Title = title
+	return nil
+}
+
+// GetTitle returns the conversation's title
+func (c *Conversation) GetTitle() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Title
+}
+
 // AddMessage adds a message to a conversation
 func (c *Conversation) AddMessage(msg ConversationMessage) {
 	c.mu.Lock()
@@ -109,6 +239,10 @@ func (c *Conversation) AddMessage(msg ConversationMessage) {
 
 	c.Messages = append(c.Messages, msg)
 	c.UpdatedAt = time.Now()
+
+	if c.DBID != 0 {
+		persistMessage(c.DBID, msg)
+	}
 }
 
 // GetMessages returns all messages in the conversation
@@ -148,7 +282,8 @@ func (c *Conversation) Clear() {
 	c.UpdatedAt = time.Now()
 }
 
-// TrimToLastN keeps only the last N messages, ensuring tool_use/tool_result pairs are not broken
+// TrimToLastN keeps only the last N messages, ensuring tool_use/tool_result pairs are not broken.
+// Only the working context is trimmed; the stored history is kept.
 func (c *Conversation) TrimToLastN(n int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,84 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ProviderFake is the name FakeProvider reports
+const ProviderFake = "fake"
+
+// FakeResponse is one scripted reply of a FakeProvider
+type FakeResponse struct {
+	Response *ChatResponse
+	Err      error
+}
+
+// FakeProvider replays scripted responses in order, for tests and local
+// development without an API key. It records every request it receives.
+type FakeProvider struct {
+	mu        sync.Mutex
+	responses []FakeResponse
+	requests  [][]ConversationMessage
+	systems   []string
+}
+
+// NewFakeProvider creates a fake that returns the given responses in order
+func NewFakeProvider(responses ...FakeResponse) *FakeProvider {
+	return &FakeProvider{responses: responses}
+}
+
+// Name returns the provider name of the fake
+func (f *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+// Script appends more responses to the fake
+func (f *FakeProvider) Script(responses ...FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, responses...)
+}
+
+// Requests returns the conversations the fake has been called with
+func (f *FakeProvider) Requests() [][]ConversationMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	requests := make([][]ConversationMessage, len(f.requests))
+	copy(requests, f.requests)
+	return requests
+}
+
+// Systems returns the system prompts the fake has been called with, in the
+// same order as Requests
+func (f *FakeProvider) Systems() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.systems...)
+}
+
+// Chat returns the next scripted response
+func (f *FakeProvider) Chat(ctx context.Context, system string, messages []ConversationMessage, tools []Tool) (*ChatResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, append([]ConversationMessage(nil), messages...))
+	f.systems = append(f.systems, system)
+	if len(f.responses) == 0 {
+		return nil, fmt.Errorf("fake provider: no scripted response left")
+	}
+
+	next := f.responses[0]
+	f.responses = f.responses[1:]
+	if next.Err != nil {
+		return nil, next.Err
+	}
+	resp := *next.Response
+	return &resp, nil
+}
@@ -0,0 +1,301 @@
+package claude
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"weekend-chart/server/metrics"
+)
+
+const (
+	defaultOpenAIBaseURL = "https://api.openai.com/v1"
+	defaultOpenAIModel   = "gpt-4o"
+)
+
+// OpenAIClient talks to any OpenAI-compatible chat completions API,
+// including self-hosted servers such as vLLM, Ollama or llama.cpp
+type OpenAIClient struct {
+	apiKey     string
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+// NewOpenAIClient creates a client configured from OPENAI_API_KEY,
+// OPENAI_BASE_URL and OPENAI_MODEL
+func NewOpenAIClient() *OpenAIClient {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = defaultOpenAIBaseURL
+	}
+	model := os.Getenv("OPENAI_MODEL")
+	if model == "" {
+		model = defaultOpenAIModel
+	}
+	return &OpenAIClient{
+		apiKey:  os.Getenv("OPENAI_API_KEY"),
+		baseURL: strings.TrimRight(baseURL, "/"),
+		model:   model,
+		httpClient: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+// Name returns the provider name of the OpenAI-compatible client
+func (c *OpenAIClient) Name() string {
+	return ProviderOpenAI
+}
+
+// OpenAI chat completions request/response types
+type openAIRequest struct {
+	Model     string          `json:"model"`
+	MaxTokens int             `json:"max_tokens"`
+	Messages  []openAIMessage `json:"messages"`
+	Tools     []openAITool    `json:"tools,omitempty"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    interface{}      `json:"content,omitempty"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIContentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Parameters  json.RawMessage `json:"parameters"`
+	} `json:"function"`
+}
+
+type openAIResponse struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content   *string          `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
+}
+
+// toOpenAIMessages converts the conversation to chat completions messages.
+// Tool results become "tool" messages, which must directly follow the
+// assistant message that made the calls.
+func toOpenAIMessages(system string, messages []ConversationMessage) []openAIMessage {
+	var out []openAIMessage
+	if system != "" {
+		out = append(out, openAIMessage{Role: "system", Content: system})
+	}
+
+	for _, msg := range messages {
+		var parts []openAIContentPart
+		var text []string
+		var toolCalls []openAIToolCall
+
+		for _, block := range msg.Content {
+			switch block.Type {
+			case "text":
+				text = append(text, block.Text)
+				parts = append(parts, openAIContentPart{Type: "text", Text: block.Text})
+			case "image":
+				if block.Source != nil {
+					parts = append(parts, openAIContentPart{
+						Type: "image_url",
+						ImageURL: &openAIImageURL{
+							URL: "data:" + block.Source.MediaType + ";base64," + block.Source.Data,
+						},
+					})
+				}
+			case "tool_use":
+				tc := openAIToolCall{ID: block.ID, Type: "function"}
+				tc.Function.Name = block.Name
+				tc.Function.Arguments = string(block.Input)
+				if tc.Function.Arguments == "" {
+					tc.Function.Arguments = "{}"
+				}
+				toolCalls = append(toolCalls, tc)
+			case "tool_result":
+				content := block.Content
+				if block.IsError {
+					content = "Error: " + content
+				}
+				out = append(out, openAIMessage{
+					Role:       "tool",
+					ToolCallID: block.ToolUseID,
+					Content:    content,
+				})
+			}
+		}
+
+		if msg.Role == "assistant" {
+			if len(text) > 0 || len(toolCalls) > 0 {
+				m := openAIMessage{Role: "assistant", ToolCalls: toolCalls}
+				if len(text) > 0 {
+					m.Content = strings.Join(text, "\n")
+				}
+				out = append(out, m)
+			}
+			continue
+		}
+
+		if len(parts) > 0 {
+			out = append(out, openAIMessage{Role: msg.Role, Content: parts})
+		}
+	}
+
+	return out
+}
+
+func toOpenAITools(tools []Tool) ([]openAITool, error) {
+	out := make([]openAITool, 0, len(tools))
+	for _, t := range tools {
+		if t.Type != "" {
+			// Anthropic-defined tools have no function schema. Dropping them
+			// would leave the model without its main tool, so computer mode
+			// has to fall back to the browser tools before it gets here.
+			return nil, fmt.Errorf("tool %s (%s) is not supported by the OpenAI provider", t.Name, t.Type)
+		}
+		ot := openAITool{Type: "function"}
+		ot.Function.Name = t.Name
+		ot.Function.Description = t.Description
+		ot.Function.Parameters = t.InputSchema
+		out = append(out, ot)
+	}
+	return out, nil
+}
+
+// openAIStopReasons maps finish reasons to the Anthropic stop reasons used by ChatResponse
+var openAIStopReasons = map[string]string{
+	"stop":       "end_turn",
+	"tool_calls": "tool_use",
+	"length":     "max_tokens",
+}
+
+// Chat sends the conversation to the chat completions endpoint
+func (c *OpenAIClient) Chat(ctx context.Context, system string, messages []ConversationMessage, tools []Tool) (*ChatResponse, error) {
+	// Self-hosted servers often don't need a key
+	if c.apiKey == "" && c.baseURL == defaultOpenAIBaseURL {
+		return nil, fmt.Errorf("OPENAI_API_KEY not set")
+	}
+
+	openAITools, err := toOpenAITools(tools)
+	if err != nil {
+		return nil, err
+	}
+	req := openAIRequest{
+		Model:     c.model,
+		MaxTokens: defaultMaxTokens,
+		Messages:  toOpenAIMessages(system, messages),
+		Tools:     openAITools,
+	}
+	jsonBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/chat/completions", bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+		return nil, fmt.Errorf("API error (status %d): %s", resp.StatusCode, string(body))
+	}
+	metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "ok")
+
+	var apiResp openAIResponse
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	if len(apiResp.Choices) == 0 {
+		return nil, fmt.Errorf("API returned no choices")
+	}
+
+	choice := apiResp.Choices[0]
+	chatResp := &ChatResponse{
+		Model:      apiResp.Model,
+		StopReason: openAIStopReasons[choice.FinishReason],
+	}
+	if chatResp.StopReason == "" {
+		chatResp.StopReason = choice.FinishReason
+	}
+	// OpenAI caches prompts automatically; cached tokens are part of prompt_tokens
+	cached := apiResp.Usage.PromptTokensDetails.CachedTokens
+	chatResp.Usage.InputTokens = apiResp.Usage.PromptTokens - cached
+	chatResp.Usage.OutputTokens = apiResp.Usage.CompletionTokens
+	chatResp.Usage.CacheReadInputTokens = cached
+	recordTokenMetrics(chatResp)
+
+	if choice.Message.Content != nil {
+		chatResp.TextContent = *choice.Message.Content
+	}
+	for _, tc := range choice.Message.ToolCalls {
+		input := tc.Function.Arguments
+		if strings.TrimSpace(input) == "" {
+			input = "{}"
+		}
+		chatResp.ToolCalls = append(chatResp.ToolCalls, ToolCall{
+			ID:    tc.ID,
+			Name:  tc.Function.Name,
+			Input: json.RawMessage(input),
+		})
+	}
+
+	return chatResp, nil
+}
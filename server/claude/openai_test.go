@@ -0,0 +1,117 @@
+package claude
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToOpenAIMessages(t *testing.T) {
+	screenshot := CreateImageMessage("user", "截圖", "data:image/jpeg;base64,aW1hZ2U=")
+	toolResults := CreateToolResultMessage([]ToolResult{
+		{ToolUseID: "toolu_1", Content: "已點擊"},
+		{ToolUseID: "toolu_2", Content: "逾時", IsError: true},
+	})
+	toolResults.Content = append(toolResults.Content, screenshot.Content...)
+
+	assistant := CreateAssistantMessage(&ChatResponse{
+		Thinking:    []ContentBlock{{Type: "thinking", Thinking: "先點擊", Signature: "sig"}},
+		TextContent: "好的",
+		ToolCalls: []ToolCall{
+			{ID: "toolu_1", Name: "click", Input: json.RawMessage(`{"x":1,"y":2}`)},
+			{ID: "toolu_2", Name: "take_screenshot"},
+		},
+	})
+
+	got, err := json.Marshal(toOpenAIMessages("系統提示", []ConversationMessage{
+		CreateTextMessage("user", "打開網站"),
+		assistant,
+		toolResults,
+		CreateTextMessage("assistant", "完成"),
+	}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	// Tool results come right after the calls, before the rest of their
+	// message; thinking isn't sent
+	want := `[
+		{"role":"system","content":"系統提示"},
+		{"role":"user","content":[{"type":"text","text":"打開網站"}]},
+		{"role":"assistant","content":"好的","tool_calls":[
+			{"id":"toolu_1","type":"function","function":{"name":"click","arguments":"{\"x\":1,\"y\":2}"}},
+			{"id":"toolu_2","type":"function","function":{"name":"take_screenshot","arguments":"{}"}}
+		]},
+		{"role":"tool","content":"已點擊","tool_call_id":"toolu_1"},
+		{"role":"tool","content":"Error: 逾時","tool_call_id":"toolu_2"},
+		{"role":"user","content":[
+			{"type":"image_url","image_url":{"url":"data:image/jpeg;base64,aW1hZ2U="}},
+			{"type":"text","text":"截圖"}
+		]},
+		{"role":"assistant","content":"完成"}
+	]`
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatalf("compact: %v", err)
+	}
+	if string(got) != compact.String() {
+		t.Errorf("messages =\n%s\nwant\n%s", got, compact.String())
+	}
+
+	// No system prompt sends no system message
+	if messages := toOpenAIMessages("", []ConversationMessage{CreateTextMessage("user", "你好")}); messages[0].Role != "user" {
+		t.Errorf("first message = %+v", messages[0])
+	}
+}
+
+func TestToOpenAITools(t *testing.T) {
+	browser := GetBrowserTools()
+	tools, err := toOpenAITools(browser)
+	if err != nil {
+		t.Fatalf("browser tools: %v", err)
+	}
+	if len(tools) != len(browser) {
+		t.Fatalf("converted %d tools, want %d", len(tools), len(browser))
+	}
+	for i, tool := range tools {
+		if tool.Type != "function" || tool.Function.Name != browser[i].Name ||
+			tool.Function.Description != browser[i].Description ||
+			!bytes.Equal(tool.Function.Parameters, browser[i].InputSchema) {
+			t.Errorf("tool %d = %+v, want %s", i, tool, browser[i].Name)
+		}
+	}
+
+	// The computer tool has no function schema, so it can't be offered
+	if _, err := toOpenAITools(GetComputerTools(1280, 800)); err == nil || !strings.Contains(err.Error(), ComputerToolName) {
+		t.Errorf("computer tools: err = %v, want the computer tool rejected", err)
+	}
+}
+
+func TestOpenAIChatRejectsComputerTools(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"},"finish_reason":"stop"}]}`))
+	}))
+	defer srv.Close()
+	t.Setenv("OPENAI_BASE_URL", srv.URL)
+	t.Setenv("OPENAI_API_KEY", "test-key")
+	c := NewOpenAIClient()
+
+	messages := []ConversationMessage{CreateTextMessage("user", "你好")}
+	if _, err := c.Chat(context.Background(), "", messages, GetComputerTools(1280, 800)); err == nil {
+		t.Error("chat with the computer tool succeeded")
+	}
+	if requests != 0 {
+		t.Errorf("sent %d requests with the computer tool", requests)
+	}
+
+	resp, err := c.Chat(context.Background(), "", messages, GetBrowserTools())
+	if err != nil || resp.TextContent != "ok" || requests != 1 {
+		t.Errorf("chat with browser tools = %+v, %v after %d requests", resp, err, requests)
+	}
+}
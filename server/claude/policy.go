@@ -0,0 +1,109 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"weekend-chart/internal/urlpattern"
+	"weekend-chart/server/metrics"
+)
+
+// ToolPolicy restricts what the AI may do on one agent
+type ToolPolicy struct {
+	AllowedURLs   []string // URL patterns navigate may go to; empty allows all
+	BlockedURLs   []string // URL patterns navigate may never go to
+	DisabledTools []string
+	MaxActions    int // Browser actions per task, 0 for no limit
+}
+
+// readOnlyTools don't change the page, so they don't count as actions
+var readOnlyTools = map[string]bool{
+	"take_screenshot": true,
+	"get_page_state":  true,
+}
+
+// CheckURL returns an error if the policy doesn't allow navigating to rawURL
+func (p *ToolPolicy) CheckURL(rawURL string) error {
+	if p == nil {
+		return nil
+	}
+	for _, pattern := range p.BlockedURLs {
+		if urlpattern.Match(pattern, rawURL) {
+			return fmt.Errorf("網址 %s 已被此 Agent 的政策封鎖", rawURL)
+		}
+	}
+	if len(p.AllowedURLs) == 0 {
+		return nil
+	}
+	for _, pattern := range p.AllowedURLs {
+		if urlpattern.Match(pattern, rawURL) {
+			return nil
+		}
+	}
+	return fmt.Errorf("網址 %s 不在此 Agent 允許的網站清單中", rawURL)
+}
+
+// ToolDisabled reports whether the policy disables a tool
+func (p *ToolPolicy) ToolDisabled(name string) bool {
+	if p == nil {
+		return false
+	}
+	for _, disabled := range p.DisabledTools {
+		if disabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterDisabledTools removes the tools the policy disables
+func (p *ToolPolicy) FilterDisabledTools(tools []Tool) []Tool {
+	filtered := make([]Tool, 0, len(tools))
+	for _, t := range tools {
+		if !p.ToolDisabled(t.Name) {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
+
+// SetToolPolicy makes the executor enforce policy; nil removes it
+func (te *ToolExecutor) SetToolPolicy(policy *ToolPolicy) {
+	te.toolPolicy = policy
+}
+
+// checkToolPolicy returns an error result if the policy forbids a tool call.
+// Allowed browser actions are counted against the action limit.
+func (te *ToolExecutor) checkToolPolicy(tc ToolCall) *ToolResult {
+	p := te.toolPolicy
+	if p == nil {
+		return nil
+	}
+
+	violation := func(reason string) *ToolResult {
+		metrics.PolicyViolations.Inc("server")
+		return &ToolResult{ToolUseID: tc.ID, Content: reason, IsError: true}
+	}
+
+	if p.ToolDisabled(tc.Name) {
+		return violation(fmt.Sprintf("此 Agent 已停用工具 %s", tc.Name))
+	}
+
+	if tc.Name == "navigate" {
+		var input NavigateInput
+		if err := json.Unmarshal(tc.Input, &input); err == nil {
+			if err := p.CheckURL(input.URL); err != nil {
+				return violation(err.Error())
+			}
+		}
+	}
+
+	if readOnlyTools[tc.Name] {
+		return nil
+	}
+	if p.MaxActions > 0 && te.actions >= p.MaxActions {
+		return violation(fmt.Sprintf("已達此 Agent 每個任務的操作上限 (%d 次)，請向使用者回報目前進度", p.MaxActions))
+	}
+	te.actions++
+	return nil
+}
@@ -0,0 +1,60 @@
+package claude
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultPromptListsOfferedTools(t *testing.T) {
+	var all []string
+	for _, tool := range GetBrowserTools() {
+		all = append(all, tool.Name)
+	}
+	basic := []string{"take_screenshot", "click", "type_text", "press_key", "navigate", "scroll"}
+
+	for _, locale := range PromptLocales() {
+		vars, err := NewPromptVars(locale, "UTC", "", 0, 0, time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatalf("%s: NewPromptVars: %v", locale, err)
+		}
+
+		vars.Tools = all
+		prompt, err := RenderSystemPrompt(DefaultPromptTemplate(locale), vars)
+		if err != nil {
+			t.Fatalf("%s: render with all tools: %v", locale, err)
+		}
+		for _, name := range []string{"get_page_state", "click_element", "run_actions", "select_all"} {
+			if !strings.Contains(prompt, "- "+name+":") {
+				t.Errorf("%s: prompt with all tools doesn't list %s", locale, name)
+			}
+		}
+
+		vars.Tools = basic
+		prompt, err = RenderSystemPrompt(DefaultPromptTemplate(locale), vars)
+		if err != nil {
+			t.Fatalf("%s: render with basic tools: %v", locale, err)
+		}
+		for _, name := range []string{"get_page_state", "click_element", "type_into", "run_actions", "select_all"} {
+			if strings.Contains(prompt, name) {
+				t.Errorf("%s: prompt mentions %s, which isn't offered", locale, name)
+			}
+		}
+		for _, name := range basic {
+			if !strings.Contains(prompt, "- "+name+":") {
+				t.Errorf("%s: prompt doesn't list %s", locale, name)
+			}
+		}
+
+		// Computer mode lists the browser tools it is offered
+		vars.ToolMode = ToolModeComputer
+		vars.Tools = []string{ComputerToolName, "navigate"}
+		prompt, err = RenderSystemPrompt(DefaultPromptTemplate(locale), vars)
+		if err != nil {
+			t.Fatalf("%s: render computer mode: %v", locale, err)
+		}
+		if !strings.Contains(prompt, "- navigate:") || strings.Contains(prompt, "select_option") {
+			t.Errorf("%s: computer mode prompt lists the wrong tools:\n%s", locale, prompt)
+		}
+	}
+}
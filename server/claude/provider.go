@@ -0,0 +1,121 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Provider is a chat model backend. Messages, tools and responses use the
+// Anthropic-shaped types of this package; other backends convert them.
+type Provider interface {
+	// Name returns the name the provider is registered under
+	Name() string
+
+	// Chat sends the conversation with the given system prompt and returns
+	// the model's reply. An empty system prompt sends none.
+	Chat(ctx context.Context, system string, messages []ConversationMessage, tools []Tool) (*ChatResponse, error)
+}
+
+// StreamingProvider is a Provider that can stream its response
+type StreamingProvider interface {
+	Provider
+
+	// ChatStream is like Chat, but passes text deltas and completed tool
+	// calls to handler as they arrive
+	ChatStream(ctx context.Context, system string, messages []ConversationMessage, tools []Tool, handler StreamHandler) (*ChatResponse, error)
+}
+
+// Built-in provider names
+const (
+	ProviderAnthropic = "anthropic"
+	ProviderOpenAI    = "openai"
+)
+
+var (
+	providers   = make(map[string]func() Provider)
+	providersMu sync.RWMutex
+)
+
+func init() {
+	RegisterProvider(ProviderAnthropic, func() Provider { return NewClient() })
+	RegisterProvider(ProviderOpenAI, func() Provider { return NewOpenAIClient() })
+}
+
+// RegisterProvider makes a provider available under name, replacing any
+// provider already registered with that name
+func RegisterProvider(name string, factory func() Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = factory
+}
+
+// ProviderNames returns the names of all registered providers
+func ProviderNames() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasProvider reports whether a provider is registered under name
+func HasProvider(name string) bool {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	_, ok := providers[name]
+	return ok
+}
+
+// DefaultProviderName returns the provider used when none is configured,
+// taken from LLM_PROVIDER and falling back to Anthropic
+func DefaultProviderName() string {
+	if name := os.Getenv("LLM_PROVIDER"); name != "" {
+		return name
+	}
+	return ProviderAnthropic
+}
+
+// NewProvider creates the provider registered under name.
+// An empty name selects the default provider.
+func NewProvider(name string) (Provider, error) {
+	if name == "" {
+		name = DefaultProviderName()
+	}
+
+	providersMu.RLock()
+	factory, ok := providers[name]
+	providersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown LLM provider %q", name)
+	}
+	return factory(), nil
+}
+
+// StreamChat streams the response if the provider supports it. Otherwise it
+// waits for the full response and then passes it to handler in one piece.
+func StreamChat(ctx context.Context, p Provider, system string, messages []ConversationMessage, tools []Tool, handler StreamHandler) (*ChatResponse, error) {
+	if sp, ok := p.(StreamingProvider); ok {
+		return sp.ChatStream(ctx, system, messages, tools, handler)
+	}
+
+	resp, err := p.Chat(ctx, system, messages, tools)
+	if err != nil {
+		return nil, err
+	}
+	if handler.OnText != nil && resp.TextContent != "" {
+		handler.OnText(resp.TextContent)
+	}
+	if handler.OnToolCall != nil {
+		for _, tc := range resp.ToolCalls {
+			handler.OnToolCall(tc)
+		}
+	}
+	return resp, nil
+}
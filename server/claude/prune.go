@@ -0,0 +1,102 @@
+package claude
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// defaultKeepScreenshots is how many of the latest screenshots stay in the
+// working context; older ones become text placeholders
+const defaultKeepScreenshots = 3
+
+// screenshotPruneStep is how many screenshots beyond the kept ones may pile
+// up before they are pruned. Pruning rewrites earlier messages and so
+// invalidates the cached prompt prefix; doing it in steps keeps the prefix
+// stable for several requests in a row.
+const screenshotPruneStep = 5
+
+// KeepScreenshots returns how many recent screenshots are always sent to the
+// model, from KEEP_RECENT_SCREENSHOTS. A negative value disables pruning.
+func KeepScreenshots() int {
+	if v, err := strconv.Atoi(os.Getenv("KEEP_RECENT_SCREENSHOTS")); err == nil {
+		return v
+	}
+	return defaultKeepScreenshots
+}
+
+// CreateScreenshotMessage creates an image message that remembers the URL and
+// title of the page in the screenshot, so a placeholder can describe it later
+func CreateScreenshotMessage(role, text, base64Image, pageURL, pageTitle string) ConversationMessage {
+	msg := CreateImageMessage(role, text, base64Image)
+	for i := range msg.Content {
+		if msg.Content[i].Type == "image" {
+			msg.Content[i].PageURL = pageURL
+			msg.Content[i].PageTitle = pageTitle
+		}
+	}
+	return msg
+}
+
+// screenshotPlaceholder is the text that replaces a pruned image block
+func screenshotPlaceholder(block ContentBlock) ContentBlock {
+	text := "[較早的截圖已省略]"
+	if block.PageURL != "" {
+		text += fmt.Sprintf(" 網址: %s", block.PageURL)
+	}
+	if block.PageTitle != "" {
+		text += fmt.Sprintf(" 標題: %s", block.PageTitle)
+	}
+	return ContentBlock{Type: "text", Text: text}
+}
+
+// PruneScreenshots replaces all but the keep most recent images with text
+// placeholders once more than keep+screenshotPruneStep images have piled
+// up, and returns how many were replaced. Only the working context changes;
+// the stored history keeps the images.
+func (c *Conversation) PruneScreenshots(keep int) int {
+	if keep < 0 {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	images := 0
+	for _, msg := range c.Messages {
+		for _, block := range msg.Content {
+			if block.Type == "image" {
+				images++
+			}
+		}
+	}
+	if images <= keep+screenshotPruneStep {
+		return 0
+	}
+
+	pruned := 0
+	seen := 0
+	for i := len(c.Messages) - 1; i >= 0; i-- {
+		content := c.Messages[i].Content
+		var replaced []ContentBlock
+		for j := len(content) - 1; j >= 0; j-- {
+			if content[j].Type != "image" {
+				continue
+			}
+			seen++
+			if seen <= keep {
+				continue
+			}
+			// Copy before changing, the slice may be shared with GetMessages callers
+			if replaced == nil {
+				replaced = append([]ContentBlock(nil), content...)
+			}
+			replaced[j] = screenshotPlaceholder(content[j])
+			pruned++
+		}
+		if replaced != nil {
+			c.Messages[i].Content = replaced
+		}
+	}
+	return pruned
+}
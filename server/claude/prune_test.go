@@ -0,0 +1,55 @@
+package claude
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPruneScreenshotsInSteps(t *testing.T) {
+	const keep = 2
+	conv := &Conversation{}
+
+	var prefix []byte
+	for step := 1; step <= 2*(keep+screenshotPruneStep); step++ {
+		conv.AddMessage(CreateScreenshotMessage("user", "after action", "aW1hZ2U=", "https://example.com/", "Example"))
+		pruned := conv.PruneScreenshots(keep)
+
+		images := 0
+		for _, msg := range conv.GetMessages() {
+			for _, block := range msg.Content {
+				if block.Type == "image" {
+					images++
+				}
+			}
+		}
+		if images < min(step, keep) || images > keep+screenshotPruneStep {
+			t.Fatalf("step %d: %d images in context, want %d to %d", step, images, keep, keep+screenshotPruneStep)
+		}
+
+		// Between prunes the earlier messages, and so the cached prefix,
+		// stay the same
+		messages := conv.GetMessages()
+		current, _ := json.Marshal(messages[:len(messages)-1])
+		if pruned == 0 && prefix != nil && string(current) != string(prefix) {
+			t.Fatalf("step %d: earlier messages changed without pruning", step)
+		}
+		if pruned > 0 && images != keep {
+			t.Fatalf("step %d: pruned to %d images, want %d", step, images, keep)
+		}
+		prefix, _ = json.Marshal(messages)
+	}
+}
+
+func TestPruneScreenshotsPlaceholder(t *testing.T) {
+	conv := &Conversation{}
+	for i := 0; i < screenshotPruneStep+1; i++ {
+		conv.AddMessage(CreateScreenshotMessage("user", "", "aW1hZ2U=", "https://example.com/login", "Login"))
+	}
+	if pruned := conv.PruneScreenshots(0); pruned != screenshotPruneStep+1 {
+		t.Fatalf("pruned %d images, want %d", pruned, screenshotPruneStep+1)
+	}
+	block := conv.GetMessages()[0].Content[0]
+	if block.Type != "text" || block.Text != "[較早的截圖已省略] 網址: https://example.com/login 標題: Login" {
+		t.Errorf("placeholder = %+v", block)
+	}
+}
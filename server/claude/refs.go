@@ -0,0 +1,190 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// refTools act on an element by the ref get_page_state gave it. Each runs
+// as a one-step batch, so the agent reports whether the ref still matched.
+var refTools = map[string]bool{
+	"click_element": true,
+	"type_into":     true,
+	"select":        true,
+}
+
+// clickElementTool describes the click_element tool
+var clickElementTool = Tool{
+	Name:        "click_element",
+	Description: "點擊 get_page_state 返回的元素 (用 ref 指定，例如 e12)。會先把元素捲動到畫面內再點擊，頁面捲動或版面變動後仍然準確，比座標更可靠",
+	InputSchema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"ref": {
+				"type": "string",
+				"description": "元素的 ref (例如 e12)"
+			},
+			"description": {
+				"type": "string",
+				"description": "點擊目標的描述"
+			}
+		},
+		"required": ["ref", "description"]
+	}`),
+}
+
+// typeIntoTool describes the type_into tool
+var typeIntoTool = Tool{
+	Name:        "type_into",
+	Description: "在 get_page_state 返回的輸入框 (用 ref 指定) 中輸入文字，會取代輸入框原本的內容。不需要先點擊欄位",
+	InputSchema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"ref": {
+				"type": "string",
+				"description": "輸入框的 ref (例如 e5)"
+			},
+			"text": {
+				"type": "string",
+				"description": "要輸入的文字，空字串會清除輸入框"
+			}
+		},
+		"required": ["ref", "text"]
+	}`),
+}
+
+// selectTool describes the select tool
+var selectTool = Tool{
+	Name:        "select",
+	Description: "選擇 get_page_state 返回的下拉選單 (用 ref 指定) 的選項，需要提供選項的 value 或 text",
+	InputSchema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"ref": {
+				"type": "string",
+				"description": "下拉選單的 ref (例如 e7)"
+			},
+			"value": {
+				"type": "string",
+				"description": "要選擇的選項 value 值"
+			},
+			"text": {
+				"type": "string",
+				"description": "要選擇的選項顯示文字 (如果沒提供 value)"
+			}
+		},
+		"required": ["ref"]
+	}`),
+}
+
+// ClickElementInput represents the input for a click_element action
+type ClickElementInput struct {
+	Ref         string `json:"ref"`
+	Description string `json:"description"`
+}
+
+// TypeIntoInput represents the input for a type_into action
+type TypeIntoInput struct {
+	Ref  string `json:"ref"`
+	Text string `json:"text"`
+}
+
+// SelectInput represents the input for a select action
+type SelectInput struct {
+	Ref   string `json:"ref"`
+	Value string `json:"value"`
+	Text  string `json:"text"`
+}
+
+// refToolCall returns the ref tool call a run_actions step with a ref is
+// equivalent to
+func (s ActionStep) refToolCall(id string) (ToolCall, error) {
+	var name string
+	var input interface{}
+	switch s.Action {
+	case "click":
+		name, input = "click_element", ClickElementInput{Ref: s.Ref, Description: s.Description}
+	case "type":
+		name, input = "type_into", TypeIntoInput{Ref: s.Ref, Text: s.Text}
+	case "select":
+		name, input = "select", SelectInput{Ref: s.Ref, Value: s.Value, Text: s.Text}
+	default:
+		return ToolCall{}, fmt.Errorf("步驟動作 %q 不支援 ref", s.Action)
+	}
+	data, _ := json.Marshal(input)
+	return ToolCall{ID: id, Name: name, Input: data}, nil
+}
+
+// refStep returns the run_actions step a ref tool call is equivalent to
+func refStep(tc ToolCall) (ActionStep, error) {
+	var step ActionStep
+	switch tc.Name {
+	case "click_element":
+		var input ClickElementInput
+		if err := json.Unmarshal(tc.Input, &input); err != nil {
+			return step, err
+		}
+		step = ActionStep{Action: "click", Ref: input.Ref, Description: input.Description}
+	case "type_into":
+		var input TypeIntoInput
+		if err := json.Unmarshal(tc.Input, &input); err != nil {
+			return step, err
+		}
+		step = ActionStep{Action: "type", Ref: input.Ref, Text: input.Text}
+	default:
+		var input SelectInput
+		if err := json.Unmarshal(tc.Input, &input); err != nil {
+			return step, err
+		}
+		step = ActionStep{Action: "select", Ref: input.Ref, Value: input.Value, Text: input.Text}
+	}
+	if step.Ref == "" {
+		return step, fmt.Errorf("缺少 ref，請先用 get_page_state 取得元素的 ref")
+	}
+	return step, nil
+}
+
+// runRefTool executes a click_element, type_into or select call
+func (te *ToolExecutor) runRefTool(ctx context.Context, tc ToolCall) (ToolResult, string, error) {
+	result := ToolResult{ToolUseID: tc.ID}
+
+	step, err := refStep(tc)
+	if err != nil {
+		result.Content = fmt.Sprintf("解析 %s 參數失敗: %v", tc.Name, err)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	if denied := te.checkToolPolicy(tc); denied != nil {
+		return *denied, "", nil
+	}
+	if denied := te.checkSecretRefs(tc); denied != nil {
+		return *denied, "", nil
+	}
+	if denied := te.checkBatchApproval(ctx, tc, []ActionStep{step}); denied != nil {
+		return *denied, "", nil
+	}
+
+	batch, err := te.agent.RunActions(ctx, []BrowserAction{step.browserAction()})
+	if err != nil {
+		if ctx.Err() != nil {
+			return CancelledToolResult(tc.ID), "", nil
+		}
+		result.Content = fmt.Sprintf("%s失敗: %v", step.describe(), err)
+		result.IsError = true
+		return result, "", nil
+	}
+
+	switch {
+	case len(batch.Steps) == 0:
+		result.Content = fmt.Sprintf("%s: 未執行", step.describe())
+		result.IsError = true
+	case !batch.Steps[0].Success:
+		result.Content = fmt.Sprintf("%s失敗: %s", step.describe(), batch.Steps[0].Error)
+		result.IsError = true
+	default:
+		result.Content = "已" + step.describe()
+	}
+	return result, batch.Screenshot, nil
+}
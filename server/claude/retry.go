@@ -0,0 +1,205 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"weekend-chart/server/metrics"
+)
+
+// statusOverloaded is the Anthropic API's "overloaded" status code
+const statusOverloaded = 529
+
+// maxRetryAfter is the longest retry-after the client waits for; a longer
+// one is treated as a permanent failure
+const maxRetryAfter = 60 * time.Second
+
+// APIError is a non-200 response from a model API
+type APIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // From the retry-after header, 0 if absent
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error (status %d): %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the request may succeed if sent again:
+// rate limits, overloads, timeouts and server errors
+func (e *APIError) Retryable() bool {
+	switch {
+	case e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode == http.StatusRequestTimeout,
+		e.StatusCode == http.StatusConflict,
+		e.StatusCode == statusOverloaded,
+		e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+// networkError is a failure to reach the API
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string { return e.err.Error() }
+func (e *networkError) Unwrap() error { return e.err }
+
+// IsRetryable reports whether err is an API or network error that may go
+// away when the request is sent again
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var netErr *networkError
+	return errors.As(err, &netErr)
+}
+
+// RetryPolicy controls how often and how long a client retries
+type RetryPolicy struct {
+	MaxAttempts int           // Including the first attempt
+	BaseDelay   time.Duration // Delay before the first retry, doubled for each further retry
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used by NewClient
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// RetryInfo describes a retry that is about to happen
+type RetryInfo struct {
+	Attempt     int // The attempt that failed, starting at 1
+	MaxAttempts int
+	Wait        time.Duration
+	Err         error
+}
+
+// delay returns how long to wait after the given failed attempt: exponential
+// backoff with jitter, or the server's retry-after if that is longer
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff > p.MaxDelay || backoff <= 0 {
+		backoff = p.MaxDelay
+	}
+	// Jitter spreads out clients that failed at the same moment
+	wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+		wait = apiErr.RetryAfter
+	}
+	return wait
+}
+
+// parseRetryAfter reads a retry-after header given in seconds or as an HTTP date
+func parseRetryAfter(header http.Header) time.Duration {
+	value := header.Get("retry-after")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// send sends a request built by newReq, retrying retryable failures. It
+// returns the response once the API answers 200, with the start time of the
+// successful attempt; the caller reads and closes the body. onRetry, if set,
+// is told about each retry before waiting.
+func (c *Client) send(ctx context.Context, newReq func() (*http.Request, error), onRetry func(RetryInfo)) (*http.Response, time.Time, error) {
+	policy := c.retry
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := c.sendOnce(newReq)
+		if err == nil {
+			return resp, start, nil
+		}
+		if ctx.Err() != nil {
+			return nil, start, ctx.Err()
+		}
+		if !IsRetryable(err) || attempt >= policy.MaxAttempts {
+			return nil, start, err
+		}
+
+		wait := policy.delay(attempt, err)
+		if wait > maxRetryAfter {
+			return nil, start, err
+		}
+		metrics.ClaudeRetries.Inc(retryReason(err))
+		if onRetry != nil {
+			onRetry(RetryInfo{Attempt: attempt, MaxAttempts: policy.MaxAttempts, Wait: wait, Err: err})
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, start, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendOnce sends one request and turns failures into APIError or networkError
+func (c *Client) sendOnce(newReq func() (*http.Request, error)) (*http.Response, error) {
+	httpReq, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+		if httpReq.Context().Err() != nil {
+			return nil, httpReq.Context().Err()
+		}
+		return nil, &networkError{fmt.Errorf("failed to send request: %w", err)}
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+	return nil, &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		RetryAfter: parseRetryAfter(resp.Header),
+	}
+}
+
+// retryReason is the metrics label of a retried error
+func retryReason(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return strconv.Itoa(apiErr.StatusCode)
+	}
+	return "network"
+}
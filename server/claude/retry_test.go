@@ -0,0 +1,225 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedResponse is one answer of a statusServer
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+}
+
+// statusServer answers requests with the given responses in order, and
+// with 200 once they are used up. It returns a count of the requests.
+func statusServer(t *testing.T, responses ...scriptedResponse) (*httptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := requests
+		requests++
+		mu.Unlock()
+
+		if n >= len(responses) {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		if responses[n].retryAfter != "" {
+			w.Header().Set("retry-after", responses[n].retryAfter)
+		}
+		w.WriteHeader(responses[n].status)
+		w.Write([]byte(`{"type":"error","error":{"type":"scripted"}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []scriptedResponse
+		wantCalls int
+		wantErr   int // Status of the returned APIError, 0 for success
+		minWait   time.Duration
+	}{
+		{
+			name:      "rate limited",
+			responses: []scriptedResponse{{status: http.StatusTooManyRequests}},
+			wantCalls: 2,
+		},
+		{
+			name:      "overloaded twice",
+			responses: []scriptedResponse{{status: statusOverloaded}, {status: statusOverloaded}},
+			wantCalls: 3,
+		},
+		{
+			name:      "server errors until out of attempts",
+			responses: []scriptedResponse{{status: 500}, {status: 502}, {status: 503}, {status: 500}},
+			wantCalls: 3,
+			wantErr:   503,
+		},
+		{
+			name:      "bad request is not retried",
+			responses: []scriptedResponse{{status: http.StatusBadRequest}},
+			wantCalls: 1,
+			wantErr:   http.StatusBadRequest,
+		},
+		{
+			name:      "authentication error is not retried",
+			responses: []scriptedResponse{{status: http.StatusUnauthorized}},
+			wantCalls: 1,
+			wantErr:   http.StatusUnauthorized,
+		},
+		{
+			name:      "retry-after is waited for",
+			responses: []scriptedResponse{{status: http.StatusTooManyRequests, retryAfter: "0.05"}},
+			wantCalls: 2,
+			minWait:   50 * time.Millisecond,
+		},
+		{
+			name:      "retry-after beyond the cap gives up",
+			responses: []scriptedResponse{{status: http.StatusTooManyRequests, retryAfter: "120"}},
+			wantCalls: 1,
+			wantErr:   http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, calls := statusServer(t, tt.responses...)
+			c := NewClientWithConfig(ClientConfig{
+				APIKey:  "test-key",
+				BaseURL: srv.URL,
+				Retry:   &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond},
+			})
+
+			var retries []RetryInfo
+			start := time.Now()
+			resp, _, err := c.send(context.Background(), func() (*http.Request, error) {
+				return http.NewRequest(http.MethodPost, srv.URL, nil)
+			}, func(info RetryInfo) { retries = append(retries, info) })
+			elapsed := time.Since(start)
+
+			if got := calls(); got != tt.wantCalls {
+				t.Errorf("sent %d requests, want %d", got, tt.wantCalls)
+			}
+			if len(retries) != tt.wantCalls-1 {
+				t.Errorf("onRetry called %d times, want %d", len(retries), tt.wantCalls-1)
+			}
+			for i, info := range retries {
+				if info.Attempt != i+1 || info.MaxAttempts != 3 {
+					t.Errorf("retry %d = attempt %d of %d", i, info.Attempt, info.MaxAttempts)
+				}
+			}
+
+			if tt.wantErr == 0 {
+				if err != nil {
+					t.Fatalf("send: %v", err)
+				}
+				resp.Body.Close()
+			} else {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantErr {
+					t.Fatalf("err = %v, want an API error with status %d", err, tt.wantErr)
+				}
+			}
+
+			if tt.minWait > 0 {
+				if elapsed < tt.minWait || len(retries) == 0 || retries[0].Wait < tt.minWait {
+					t.Errorf("waited %v (announced %v), want at least %v", elapsed, retries, tt.minWait)
+				}
+			}
+		})
+	}
+}
+
+func TestSendStopsWhenCancelled(t *testing.T) {
+	srv, calls := statusServer(t, scriptedResponse{status: statusOverloaded, retryAfter: "30"})
+	c := NewClientWithConfig(ClientConfig{APIKey: "test-key", BaseURL: srv.URL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, _, err := c.send(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+	}, func(RetryInfo) { cancel() })
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if calls() != 1 {
+		t.Errorf("sent %d requests, want 1", calls())
+	}
+}
+
+func TestSendRetriesNetworkErrors(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	c := NewClientWithConfig(ClientConfig{
+		APIKey: "test-key",
+		Retry:  &RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	retries := 0
+	_, _, err := c.send(context.Background(), func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, url, nil)
+	}, func(RetryInfo) { retries++ })
+
+	if !IsRetryable(err) || retries != 1 {
+		t.Errorf("err = %v after %d retries, want a retryable network error after 1", err, retries)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"2", 2 * time.Second, 2 * time.Second},
+		{"1.5", 1500 * time.Millisecond, 1500 * time.Millisecond},
+		{"0", 0, 0},
+		{"-3", 0, 0},
+		{"soon", 0, 0},
+		{time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat), 28 * time.Second, 30 * time.Second},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Retry-After", tt.value)
+		}
+		if got := parseRetryAfter(header); got < tt.min || got > tt.max {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v to %v", tt.value, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 8 * time.Second}
+
+	for attempt, backoff := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 9: 8 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if got := p.delay(attempt, errors.New("network")); got < backoff/2 || got > backoff {
+				t.Errorf("delay(%d) = %v, want %v to %v", attempt, got, backoff/2, backoff)
+			}
+		}
+	}
+
+	// A longer retry-after wins over the backoff
+	err := &APIError{StatusCode: http.StatusTooManyRequests, RetryAfter: 20 * time.Second}
+	if got := p.delay(1, err); got != 20*time.Second {
+		t.Errorf("delay with retry-after = %v, want 20s", got)
+	}
+}
@@ -0,0 +1,55 @@
+package claude
+
+import (
+	"fmt"
+
+	"weekend-chart/internal/secretref"
+)
+
+// ValidSecretName reports whether name can be used in a placeholder
+func ValidSecretName(name string) bool {
+	return secretref.ValidName(name)
+}
+
+// SecretPlaceholder returns the placeholder the model uses for a secret,
+// such as {{secret:bank_pw}}. The agent replaces placeholders with the
+// stored values just before typing, so the model only ever sees the names.
+func SecretPlaceholder(name string) string {
+	return secretref.Placeholder(name)
+}
+
+// SecretRefs returns the names of the secrets text refers to
+func SecretRefs(text string) []string {
+	return secretref.Refs(text)
+}
+
+// SecretRedactor replaces secret values in text with their placeholders
+type SecretRedactor = secretref.Redactor
+
+// NewSecretRedactor creates a redactor for secrets, a map from name to value
+func NewSecretRedactor(values map[string]string) *SecretRedactor {
+	return secretref.NewRedactor(values)
+}
+
+// SetSecretNames tells the executor which secrets the agent can fill in
+func (te *ToolExecutor) SetSecretNames(names []string) {
+	te.secretNames = make(map[string]bool, len(names))
+	for _, name := range names {
+		te.secretNames[name] = true
+	}
+}
+
+// checkSecretRefs returns an error result if a tool call refers to a secret
+// the agent doesn't have, instead of typing the placeholder literally
+func (te *ToolExecutor) checkSecretRefs(tc ToolCall) *ToolResult {
+	for _, name := range SecretRefs(string(tc.Input)) {
+		if !te.secretNames[name] {
+			return &ToolResult{
+				ToolUseID: tc.ID,
+				Content:   fmt.Sprintf("找不到已儲存的帳號密碼 %q，請使用者先在設定中新增", name),
+				IsError:   true,
+			}
+		}
+	}
+	return nil
+}
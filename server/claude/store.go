@@ -0,0 +1,107 @@
+package claude
+
+import (
+	"encoding/json"
+	"log"
+
+	"weekend-chart/server/models"
+)
+
+// historyLoadLimit is how many stored messages are loaded back into memory
+// when a conversation is resumed. The full history stays in the database.
+const historyLoadLimit = 40
+
+// imageSourceFile marks an image whose data is stored on disk; Data holds the file name
+const imageSourceFile = "file"
+
+// encodeBlocks serializes content blocks for storage, moving image data to files
+func encodeBlocks(conversationID int64, blocks []ContentBlock) (string, error) {
+	stored := make([]ContentBlock, len(blocks))
+	for i, block := range blocks {
+		if block.Type == "image" && block.Source != nil && block.Source.Type == "base64" {
+			name, err := models.SaveImage(conversationID, block.Source.MediaType, block.Source.Data)
+			if err != nil {
+				return "", err
+			}
+			block.Source = &ImageSource{
+				Type:      imageSourceFile,
+				MediaType: block.Source.MediaType,
+				Data:      name,
+			}
+		}
+		stored[i] = block
+	}
+
+	b, err := json.Marshal(stored)
+	return string(b), err
+}
+
+// DecodeStoredBlocks parses stored content blocks. If loadImages is set, image
+// references are replaced with the image data; images missing from disk
+// become a text note.
+func DecodeStoredBlocks(conversationID int64, content string, loadImages bool) ([]ContentBlock, error) {
+	var blocks []ContentBlock
+	if err := json.Unmarshal([]byte(content), &blocks); err != nil {
+		return nil, err
+	}
+	if !loadImages {
+		return blocks, nil
+	}
+
+	for i, block := range blocks {
+		if block.Type != "image" || block.Source == nil || block.Source.Type != imageSourceFile {
+			continue
+		}
+		data, err := models.LoadImage(conversationID, block.Source.Data)
+		if err != nil {
+			log.Printf("Failed to load image %s of conversation %d: %v", block.Source.Data, conversationID, err)
+			blocks[i] = ContentBlock{Type: "text", Text: "[截圖已無法取得]"}
+			continue
+		}
+		blocks[i].Source = &ImageSource{
+			Type:      "base64",
+			MediaType: block.Source.MediaType,
+			Data:      data,
+		}
+	}
+	return blocks, nil
+}
+
+// loadHistory loads the most recent stored messages of a conversation. A
+// compacted conversation resumes from its summary and the messages after it.
+func loadHistory(conv *models.StoredConversation) []ConversationMessage {
+	conversationID := conv.ID
+	stored, err := models.GetConversationMessagesFrom(conversationID, conv.SummaryBefore, historyLoadLimit)
+	if err != nil {
+		log.Printf("Failed to load conversation %d: %v", conversationID, err)
+		return []ConversationMessage{}
+	}
+
+	messages := make([]ConversationMessage, 0, len(stored)+1)
+	if conv.Summary != "" {
+		messages = append(messages, summaryMessage(conv.Summary))
+	}
+	for _, m := range stored {
+		blocks, err := DecodeStoredBlocks(conversationID, m.Content, true)
+		if err != nil {
+			log.Printf("Skipping unreadable message %d: %v", m.ID, err)
+			continue
+		}
+		messages = append(messages, ConversationMessage{Role: m.Role, Content: blocks})
+	}
+
+	// The limit may have cut a tool_use/tool_result pair in half
+	return ValidateAndClean(messages)
+}
+
+// persistMessage stores a message of a conversation
+func persistMessage(conversationID int64, msg ConversationMessage) {
+	content, err := encodeBlocks(conversationID, msg.Content)
+	if err != nil {
+		log.Printf("Failed to encode message for conversation %d: %v", conversationID, err)
+		return
+	}
+	if err := models.AddConversationMessage(conversationID, msg.Role, content); err != nil {
+		log.Printf("Failed to store message for conversation %d: %v", conversationID, err)
+	}
+}
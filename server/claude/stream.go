@@ -0,0 +1,238 @@
+package claude
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"weekend-chart/server/metrics"
+)
+
+// StreamHandler receives events while a response is being streamed
+type StreamHandler struct {
+	// OnText is called with each text delta as it is generated
+	OnText func(delta string)
+
+	// OnThinking is called with each delta of extended thinking
+	OnThinking func(delta string)
+
+	// OnToolCall is called as soon as a tool_use block is complete,
+	// before the rest of the response has arrived
+	OnToolCall func(toolCall ToolCall)
+
+	// OnRetry is called before waiting to resend a request that failed
+	// with a retryable error. Only failures before the stream starts are
+	// retried, so no delta is ever repeated.
+	OnRetry func(info RetryInfo)
+}
+
+// streamEvent is a server-sent event from the Messages API
+type streamEvent struct {
+	Type         string `json:"type"`
+	Index        int    `json:"index"`
+	ContentBlock struct {
+		Type      string `json:"type"`
+		Text      string `json:"text"`
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Thinking  string `json:"thinking"`
+		Signature string `json:"signature"`
+		Data      string `json:"data"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		Thinking    string `json:"thinking"`
+		Signature   string `json:"signature"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// streamBlock accumulates a content block across deltas
+type streamBlock struct {
+	blockType string
+	text      strings.Builder
+	id        string
+	name      string
+	inputJSON strings.Builder
+	signature string
+	data      string // Of a redacted_thinking block
+}
+
+// ChatStream sends a chat request with streaming enabled. Text deltas and
+// completed tool calls are passed to handler as they arrive; the assembled
+// response is returned once the stream ends.
+func (c *Client) ChatStream(ctx context.Context, system string, messages []ConversationMessage, tools []Tool, handler StreamHandler) (*ChatResponse, error) {
+	if c.apiKey == "" {
+		return nil, fmt.Errorf("ANTHROPIC_API_KEY not set")
+	}
+
+	resp, start, err := c.send(ctx, func() (*http.Request, error) {
+		httpReq, err := c.newRequest(ctx, system, messages, tools, true)
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Accept", "text/event-stream")
+		return httpReq, nil
+	}, handler.OnRetry)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	chatResp, err := readStream(resp.Body, handler)
+	if err != nil {
+		metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "error")
+		return nil, err
+	}
+	metrics.ClaudeRequestDuration.Observe(time.Since(start).Seconds(), "ok")
+	recordTokenMetrics(chatResp)
+
+	return chatResp, nil
+}
+
+// readStream parses the server-sent events of a streamed Messages API response
+func readStream(body io.Reader, handler StreamHandler) (*ChatResponse, error) {
+	chatResp := &ChatResponse{}
+	blocks := make(map[int]*streamBlock)
+	completed := false
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Only data lines matter; the event name is repeated in the payload
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+
+		var event streamEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("failed to parse stream event: %w", err)
+		}
+
+		switch event.Type {
+		case "message_start":
+			chatResp.Model = event.Message.Model
+			chatResp.setUsage(event.Message.Usage)
+
+		case "content_block_start":
+			block := &streamBlock{
+				blockType: event.ContentBlock.Type,
+				id:        event.ContentBlock.ID,
+				name:      event.ContentBlock.Name,
+				signature: event.ContentBlock.Signature,
+				data:      event.ContentBlock.Data,
+			}
+			block.text.WriteString(event.ContentBlock.Text)
+			block.text.WriteString(event.ContentBlock.Thinking)
+			blocks[event.Index] = block
+
+		case "content_block_delta":
+			block, ok := blocks[event.Index]
+			if !ok {
+				continue
+			}
+			switch event.Delta.Type {
+			case "text_delta":
+				block.text.WriteString(event.Delta.Text)
+				if handler.OnText != nil && event.Delta.Text != "" {
+					handler.OnText(event.Delta.Text)
+				}
+			case "input_json_delta":
+				block.inputJSON.WriteString(event.Delta.PartialJSON)
+			case "thinking_delta":
+				block.text.WriteString(event.Delta.Thinking)
+				if handler.OnThinking != nil && event.Delta.Thinking != "" {
+					handler.OnThinking(event.Delta.Thinking)
+				}
+			case "signature_delta":
+				block.signature += event.Delta.Signature
+			}
+
+		case "content_block_stop":
+			block, ok := blocks[event.Index]
+			if !ok {
+				continue
+			}
+			switch block.blockType {
+			case "thinking":
+				chatResp.Thinking = append(chatResp.Thinking, ContentBlock{
+					Type:      "thinking",
+					Thinking:  block.text.String(),
+					Signature: block.signature,
+				})
+			case "redacted_thinking":
+				chatResp.Thinking = append(chatResp.Thinking, ContentBlock{
+					Type: "redacted_thinking",
+					Data: block.data,
+				})
+			case "text":
+				if chatResp.TextContent != "" {
+					chatResp.TextContent += "\n"
+				}
+				chatResp.TextContent += block.text.String()
+			case "tool_use":
+				input := block.inputJSON.String()
+				if strings.TrimSpace(input) == "" {
+					input = "{}"
+				}
+				toolCall := ToolCall{
+					ID:    block.id,
+					Name:  block.name,
+					Input: json.RawMessage(input),
+				}
+				chatResp.ToolCalls = append(chatResp.ToolCalls, toolCall)
+				if handler.OnToolCall != nil {
+					handler.OnToolCall(toolCall)
+				}
+			}
+
+		case "message_delta":
+			if event.Delta.StopReason != "" {
+				chatResp.StopReason = event.Delta.StopReason
+			}
+			if event.Usage.OutputTokens > 0 {
+				chatResp.Usage.OutputTokens = event.Usage.OutputTokens
+			}
+
+		case "message_stop":
+			completed = true
+
+		case "error":
+			return nil, fmt.Errorf("stream error (%s): %s", event.Error.Type, event.Error.Message)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read stream: %w", err)
+	}
+	if !completed {
+		return nil, fmt.Errorf("stream ended before message_stop")
+	}
+
+	return chatResp, nil
+}
@@ -0,0 +1,209 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sseServer answers every request with the given events as a stream. Each
+// event is the JSON payload of one data line; its type is the event name.
+func sseServer(t *testing.T, events ...string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Stream {
+			t.Errorf("request is not a streaming request (err: %v)", err)
+		}
+		if got := r.Header.Get("Accept"); got != "text/event-stream" {
+			t.Errorf("Accept = %q, want text/event-stream", got)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			var head struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal([]byte(event), &head)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", head.Type, event)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testClient(baseURL string) *Client {
+	return NewClientWithConfig(ClientConfig{
+		APIKey:  "test-key",
+		BaseURL: baseURL,
+		Retry:   &RetryPolicy{MaxAttempts: 1},
+	})
+}
+
+const (
+	messageStart = `{"type":"message_start","message":{"model":"claude-test","usage":{"input_tokens":12,"output_tokens":1}}}`
+	messageStop  = `{"type":"message_stop"}`
+)
+
+func TestChatStreamTextDeltas(t *testing.T) {
+	srv := sseServer(t,
+		messageStart,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`,
+		messageStop,
+	)
+
+	var deltas []string
+	resp, err := testClient(srv.URL).ChatStream(context.Background(), "system", nil, nil, StreamHandler{
+		OnText: func(text string) { deltas = append(deltas, text) },
+	})
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+
+	if got := strings.Join(deltas, "|"); got != "Hello|, world" {
+		t.Errorf("deltas = %q, want %q", got, "Hello|, world")
+	}
+	if resp.TextContent != "Hello, world" {
+		t.Errorf("TextContent = %q", resp.TextContent)
+	}
+	if resp.Model != "claude-test" || resp.StopReason != "end_turn" {
+		t.Errorf("Model = %q, StopReason = %q", resp.Model, resp.StopReason)
+	}
+	if resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 7 {
+		t.Errorf("Usage = %+v", resp.Usage)
+	}
+}
+
+func TestChatStreamToolUse(t *testing.T) {
+	srv := sseServer(t,
+		messageStart,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Clicking"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"click","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"x\": 10"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":", \"y\": 20, \"description\""}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":": \"OK\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":30}}`,
+		messageStop,
+	)
+
+	var streamed []ToolCall
+	resp, err := testClient(srv.URL).ChatStream(context.Background(), "system", nil, nil, StreamHandler{
+		OnToolCall: func(tc ToolCall) { streamed = append(streamed, tc) },
+	})
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+
+	if len(streamed) != 1 || len(resp.ToolCalls) != 1 {
+		t.Fatalf("got %d streamed and %d returned tool calls, want 1 each", len(streamed), len(resp.ToolCalls))
+	}
+	tc := resp.ToolCalls[0]
+	if tc.ID != "toolu_1" || tc.Name != "click" {
+		t.Errorf("tool call = %s %s", tc.ID, tc.Name)
+	}
+	var input ClickInput
+	if err := json.Unmarshal(tc.Input, &input); err != nil {
+		t.Fatalf("tool input %s: %v", tc.Input, err)
+	}
+	if input != (ClickInput{X: 10, Y: 20, Description: "OK"}) {
+		t.Errorf("input = %+v", input)
+	}
+	if string(streamed[0].Input) != string(tc.Input) {
+		t.Errorf("streamed input %s differs from returned input %s", streamed[0].Input, tc.Input)
+	}
+	if resp.TextContent != "Clicking" || resp.StopReason != "tool_use" {
+		t.Errorf("TextContent = %q, StopReason = %q", resp.TextContent, resp.StopReason)
+	}
+}
+
+func TestChatStreamThinking(t *testing.T) {
+	srv := sseServer(t,
+		messageStart,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"thinking","thinking":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"The form "}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"is empty."}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"signature_delta","signature":"sig-123"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"redacted_thinking","data":"opaque"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"content_block_start","index":2,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":2,"delta":{"type":"text_delta","text":"Done"}}`,
+		`{"type":"content_block_stop","index":2}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":40}}`,
+		messageStop,
+	)
+
+	var thinking strings.Builder
+	resp, err := testClient(srv.URL).ChatStream(context.Background(), "system", nil, nil, StreamHandler{
+		OnThinking: func(text string) { thinking.WriteString(text) },
+	})
+	if err != nil {
+		t.Fatalf("ChatStream: %v", err)
+	}
+
+	if thinking.String() != "The form is empty." {
+		t.Errorf("streamed thinking = %q", thinking.String())
+	}
+	want := []ContentBlock{
+		{Type: "thinking", Thinking: "The form is empty.", Signature: "sig-123"},
+		{Type: "redacted_thinking", Data: "opaque"},
+	}
+	if len(resp.Thinking) != len(want) {
+		t.Fatalf("got %d thinking blocks, want %d", len(resp.Thinking), len(want))
+	}
+	for i, block := range want {
+		got := resp.Thinking[i]
+		if got.Type != block.Type || got.Thinking != block.Thinking || got.Signature != block.Signature || got.Data != block.Data {
+			t.Errorf("thinking block %d = %+v, want %+v", i, got, block)
+		}
+	}
+	if resp.TextContent != "Done" {
+		t.Errorf("TextContent = %q", resp.TextContent)
+	}
+
+	// Thinking blocks go back to the API first and unchanged
+	msg := CreateAssistantMessage(resp)
+	if len(msg.Content) != 3 || msg.Content[0].Signature != "sig-123" || msg.Content[1].Data != "opaque" || msg.Content[2].Text != "Done" {
+		t.Errorf("assistant message = %+v", msg.Content)
+	}
+}
+
+func TestChatStreamWithoutMessageStop(t *testing.T) {
+	srv := sseServer(t,
+		messageStart,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+	)
+
+	_, err := testClient(srv.URL).ChatStream(context.Background(), "system", nil, nil, StreamHandler{})
+	if err == nil || !strings.Contains(err.Error(), "message_stop") {
+		t.Fatalf("err = %v, want an error about the missing message_stop", err)
+	}
+}
+
+func TestChatStreamErrorEvent(t *testing.T) {
+	srv := sseServer(t,
+		messageStart,
+		`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+	)
+
+	_, err := testClient(srv.URL).ChatStream(context.Background(), "system", nil, nil, StreamHandler{})
+	if err == nil || !strings.Contains(err.Error(), "overloaded_error") {
+		t.Fatalf("err = %v, want the stream's error", err)
+	}
+}
@@ -1,9 +1,12 @@
 package claude
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
+
+	"weekend-chart/server/metrics"
 )
 
 // GetBrowserTools returns the tool definitions for browser control
@@ -141,7 +144,41 @@ func GetBrowserTools() []Tool {
 				"required": ["selector"]
 			}`),
 		},
+		clickElementTool,
+		typeIntoTool,
+		selectTool,
+		runActionsTool,
+	}
+}
+
+// toolCapabilities maps each tool to the agent capability it depends on
+var toolCapabilities = map[string]string{
+	"take_screenshot":  "request_screenshot",
+	"click":            "click_xy",
+	"type_text":        "input",
+	"press_key":        "key",
+	"navigate":         "navigate",
+	"scroll":           "scroll",
+	"select_all":       "select_all",
+	"get_page_state":   "get_page_state",
+	"select_option":    "select_option",
+	"click_element":    "element_refs",
+	"type_into":        "element_refs",
+	"select":           "element_refs",
+	ComputerToolName:   "computer_use",
+	RunActionsToolName: "run_actions",
+}
+
+// FilterTools returns only the tools the connected agent is able to execute
+func FilterTools(tools []Tool, hasCapability func(string) bool) []Tool {
+	filtered := make([]Tool, 0, len(tools))
+	for _, t := range tools {
+		if capability, ok := toolCapabilities[t.Name]; ok && !hasCapability(capability) {
+			continue
+		}
+		filtered = append(filtered, t)
 	}
+	return filtered
 }
 
 // ClickInput represents the input for a click action
@@ -184,10 +221,18 @@ type BrowserAction struct {
 	Type        string `json:"type"`
 	Description string `json:"description,omitempty"`
 
-	// For click_xy
+	// For click_xy, mouse_move and drag, which starts here
 	X int `json:"x,omitempty"`
 	Y int `json:"y,omitempty"`
 
+	// For click_xy; empty means a single left click
+	Button     string `json:"button,omitempty"`
+	ClickCount int    `json:"click_count,omitempty"`
+
+	// For drag
+	ToX int `json:"to_x,omitempty"`
+	ToY int `json:"to_y,omitempty"`
+
 	// For input
 	Value string `json:"value,omitempty"`
 
@@ -205,27 +250,77 @@ type BrowserAction struct {
 	Selector    string `json:"selector,omitempty"`
 	OptionValue string `json:"option_value,omitempty"`
 	OptionText  string `json:"option_text,omitempty"`
+
+	// For click_ref, input_ref (with Value) and select_ref (with the
+	// option fields): the element ref from get_page_state
+	Ref string `json:"ref,omitempty"`
+
+	// For steps of run_actions: how long to wait after the step
+	WaitMs int `json:"wait_ms,omitempty"`
+}
+
+// typedKeyNames maps key names the model sometimes types as text to the
+// key it meant to press
+var typedKeyNames = map[string]string{
+	"tab": "Tab", "TAB": "Tab", "Tab": "Tab",
+	"enter": "Enter", "ENTER": "Enter", "Enter": "Enter",
+	"backspace": "Backspace", "BACKSPACE": "Backspace", "Backspace": "Backspace",
+	"escape": "Escape", "ESCAPE": "Escape", "Escape": "Escape", "esc": "Escape", "ESC": "Escape",
+	"delete": "Delete", "DELETE": "Delete", "Delete": "Delete", "del": "Delete", "DEL": "Delete",
+	"arrowup": "ArrowUp", "ArrowUp": "ArrowUp",
+	"arrowdown": "ArrowDown", "ArrowDown": "ArrowDown",
+	"arrowleft": "ArrowLeft", "ArrowLeft": "ArrowLeft",
+	"arrowright": "ArrowRight", "ArrowRight": "ArrowRight",
+}
+
+// typedKeyName returns the key to press instead of typing text, if text is
+// only a key name
+func typedKeyName(text string) (string, bool) {
+	key, ok := typedKeyNames[strings.TrimSpace(text)]
+	return key, ok
 }
 
 // AgentInterface defines the interface for interacting with the agent
 type AgentInterface interface {
-	RequestScreenshot() (string, error)
-	RequestPageState() (string, error)
-	SendAction(action BrowserAction) error
+	RequestScreenshot(ctx context.Context) (string, error)
+	RequestPageState(ctx context.Context) (string, error)
+	SendAction(ctx context.Context, action BrowserAction) error
+	RunActions(ctx context.Context, actions []BrowserAction) (*ActionsResult, error)
 }
 
 // ToolExecutor handles the execution of Claude tools
 type ToolExecutor struct {
 	agent AgentInterface
+
+	// Calls the policy covers wait for the approver
+	policy       ApprovalPolicy
+	approver     Approver
+	visitedHosts map[string]bool
+
+	// toolPolicy restricts the calls; actions counts the ones it allowed
+	toolPolicy *ToolPolicy
+	actions    int
+
+	// secretNames are the secrets the agent fills in for placeholders
+	secretNames map[string]bool
+
+	// Mouse position of the computer-use tool
+	cursorX, cursorY int
 }
 
 // NewToolExecutor creates a new tool executor
 func NewToolExecutor(agent AgentInterface) *ToolExecutor {
-	return &ToolExecutor{agent: agent}
+	return &ToolExecutor{agent: agent, visitedHosts: make(map[string]bool)}
+}
+
+// RequireApproval makes tool calls covered by policy wait for approver
+func (te *ToolExecutor) RequireApproval(policy ApprovalPolicy, approver Approver) {
+	te.policy = policy
+	te.approver = approver
 }
 
 // ExecuteTool executes a single tool call and returns the result
-func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, error) {
+func (te *ToolExecutor) ExecuteTool(ctx context.Context, toolCall ToolCall) (ToolResult, string, error) {
 	result := ToolResult{
 		ToolUseID: toolCall.ID,
 	}
@@ -234,9 +329,28 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 
 	fmt.Printf("[DEBUG] ExecuteTool called: name=%q input=%s\n", toolCall.Name, string(toolCall.Input))
 
+	switch toolCall.Name {
+	case ComputerToolName:
+		return te.executeComputerAction(ctx, toolCall)
+	case RunActionsToolName:
+		return te.runActions(ctx, toolCall)
+	case "click_element", "type_into", "select":
+		return te.runRefTool(ctx, toolCall)
+	}
+
+	if denied := te.checkToolPolicy(toolCall); denied != nil {
+		return *denied, "", nil
+	}
+	if denied := te.checkSecretRefs(toolCall); denied != nil {
+		return *denied, "", nil
+	}
+	if denied := te.checkApproval(ctx, toolCall); denied != nil {
+		return *denied, "", nil
+	}
+
 	switch toolCall.Name {
 	case "take_screenshot":
-		screenshot, err := te.agent.RequestScreenshot()
+		screenshot, err := te.agent.RequestScreenshot(ctx)
 		if err != nil {
 			result.Content = fmt.Sprintf("截圖失敗: %v", err)
 			result.IsError = true
@@ -262,7 +376,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 			Y:           input.Y,
 			Description: input.Description,
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("點擊失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -281,28 +395,14 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 		fmt.Printf("[DEBUG] type_text received: %q (len=%d)\n", input.Text, len(input.Text))
 
 		// Safety: detect if AI mistakenly tried to type a key name
-		keyNames := map[string]string{
-			"tab": "Tab", "TAB": "Tab", "Tab": "Tab",
-			"enter": "Enter", "ENTER": "Enter", "Enter": "Enter",
-			"backspace": "Backspace", "BACKSPACE": "Backspace", "Backspace": "Backspace",
-			"escape": "Escape", "ESCAPE": "Escape", "Escape": "Escape", "esc": "Escape", "ESC": "Escape",
-			"delete": "Delete", "DELETE": "Delete", "Delete": "Delete", "del": "Delete", "DEL": "Delete",
-			"arrowup": "ArrowUp", "ArrowUp": "ArrowUp",
-			"arrowdown": "ArrowDown", "ArrowDown": "ArrowDown",
-			"arrowleft": "ArrowLeft", "ArrowLeft": "ArrowLeft",
-			"arrowright": "ArrowRight", "ArrowRight": "ArrowRight",
-		}
-
-		// Trim whitespace and check for key name
-		trimmedText := strings.TrimSpace(input.Text)
-		if keyName, isKey := keyNames[trimmedText]; isKey {
+		if keyName, isKey := typedKeyName(input.Text); isKey {
 			fmt.Printf("[DEBUG] Auto-converting type_text to press_key: %q -> %q\n", input.Text, keyName)
 			// Convert to press_key action instead
 			action := BrowserAction{
 				Type: "key",
 				Key:  keyName,
 			}
-			if err := te.agent.SendAction(action); err != nil {
+			if err := te.agent.SendAction(ctx, action); err != nil {
 				result.Content = fmt.Sprintf("按鍵失敗: %v", err)
 				result.IsError = true
 			} else {
@@ -314,7 +414,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 				Type:  "input",
 				Value: input.Text,
 			}
-			if err := te.agent.SendAction(action); err != nil {
+			if err := te.agent.SendAction(ctx, action); err != nil {
 				result.Content = fmt.Sprintf("輸入失敗: %v", err)
 				result.IsError = true
 			} else {
@@ -337,7 +437,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 			Type: "key",
 			Key:  input.Key,
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("按鍵失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -357,7 +457,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 			Type: "navigate",
 			URL:  input.URL,
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("導航失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -382,7 +482,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 			Direction: input.Direction,
 			Amount:    input.Amount,
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("滾動失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -394,7 +494,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 		action := BrowserAction{
 			Type: "select_all",
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("全選失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -403,7 +503,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 		}
 
 	case "get_page_state":
-		pageState, err := te.agent.RequestPageState()
+		pageState, err := te.agent.RequestPageState(ctx)
 		if err != nil {
 			result.Content = fmt.Sprintf("取得頁面狀態失敗: %v", err)
 			result.IsError = true
@@ -428,7 +528,7 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 			OptionValue: input.Value,
 			OptionText:  input.Text,
 		}
-		if err := te.agent.SendAction(action); err != nil {
+		if err := te.agent.SendAction(ctx, action); err != nil {
 			result.Content = fmt.Sprintf("選擇選項失敗: %v", err)
 			result.IsError = true
 		} else {
@@ -450,19 +550,47 @@ func (te *ToolExecutor) ExecuteTool(toolCall ToolCall) (ToolResult, string, erro
 }
 
 // ExecuteToolCalls executes all tool calls and returns results
-func (te *ToolExecutor) ExecuteToolCalls(toolCalls []ToolCall) ([]ToolResult, []string, string, error) {
+func (te *ToolExecutor) ExecuteToolCalls(ctx context.Context, toolCalls []ToolCall) ([]ToolResult, []string, string, error) {
+	calls := make(chan ToolCall, len(toolCalls))
+	for _, tc := range toolCalls {
+		calls <- tc
+	}
+	close(calls)
+	return te.ExecuteToolCallStream(ctx, calls)
+}
+
+// ExecuteToolCallStream executes tool calls in order as they arrive on calls,
+// so execution can start while the model is still streaming. It returns once
+// calls is closed.
+//
+// Once ctx is cancelled the remaining calls are not executed but still get an
+// error result, so every tool_use in the conversation keeps its tool_result.
+func (te *ToolExecutor) ExecuteToolCallStream(ctx context.Context, calls <-chan ToolCall) ([]ToolResult, []string, string, error) {
 	var results []ToolResult
 	var actionDescriptions []string
 	var lastScreenshot string
 
-	for _, tc := range toolCalls {
-		result, screenshot, err := te.ExecuteTool(tc)
+	for tc := range calls {
+		if ctx.Err() != nil {
+			results = append(results, CancelledToolResult(tc.ID))
+			continue
+		}
+
+		result, screenshot, err := te.ExecuteTool(ctx, tc)
+		metrics.ToolCalls.Inc(tc.Name)
 		if err != nil {
+			metrics.ToolErrors.Inc(tc.Name)
+			// Drain the rest so the producer isn't blocked
+			for range calls {
+			}
 			return nil, nil, "", err
 		}
+		if result.IsError {
+			metrics.ToolErrors.Inc(tc.Name)
+		}
 		results = append(results, result)
 
-		if tc.Name == "take_screenshot" && screenshot != "" {
+		if ReturnsScreenshot(tc) && screenshot != "" {
 			lastScreenshot = screenshot
 		}
 
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// approvalTimeout is how long a tool call waits for the user's answer
+const approvalTimeout = 2 * time.Minute
+
+// pendingApprovals holds the answer channel of each approval request
+// waiting for a user
+var pendingApprovals = struct {
+	sync.Mutex
+	requests map[string]pendingApproval
+}{requests: make(map[string]pendingApproval)}
+
+type pendingApproval struct {
+	userID int64
+	answer chan bool
+}
+
+var approvalSeq atomic.Int64
+
+// ApprovalResponseData is the user's answer to an approval request
+type ApprovalResponseData struct {
+	ID       string `json:"id"`
+	Approved bool   `json:"approved"`
+}
+
+// RequestApproval shows the tool call with a current screenshot to the user
+// and waits for their answer
+func (ap *AgentProxy) RequestApproval(ctx context.Context, req claude.ApprovalRequest) (bool, error) {
+	id := fmt.Sprintf("%d-%d", ap.userConn.UserID, approvalSeq.Add(1))
+	answer := make(chan bool, 1)
+
+	pendingApprovals.Lock()
+	pendingApprovals.requests[id] = pendingApproval{userID: ap.userConn.UserID, answer: answer}
+	pendingApprovals.Unlock()
+
+	defer func() {
+		pendingApprovals.Lock()
+		delete(pendingApprovals.requests, id)
+		pendingApprovals.Unlock()
+	}()
+
+	screenshot, err := ap.RequestScreenshot(ctx)
+	if err != nil && ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":        "approval_request",
+		"id":          id,
+		"tool":        req.ToolCall.Name,
+		"input":       req.ToolCall.Input,
+		"rule":        req.Rule,
+		"description": req.Description,
+		"screenshot":  screenshot,
+		"timeout":     int(approvalTimeout.Seconds()),
+	})
+	safeSend(ap.userConn.Send, msg)
+	log.Printf("Waiting for user %d to approve %s (%s)", ap.userConn.UserID, req.ToolCall.Name, req.Rule)
+	ap.task.setState(models.TaskWaitingForUser)
+	defer ap.task.setState(models.TaskRunning)
+
+	timer := time.NewTimer(approvalTimeout)
+	defer timer.Stop()
+
+	select {
+	case approved := <-answer:
+		log.Printf("User %d answered approval %s: %v", ap.userConn.UserID, id, approved)
+		return approved, nil
+	case <-ctx.Done():
+		sendApprovalClosed(ap.userConn, id, "cancelled")
+		return false, ctx.Err()
+	case <-timer.C:
+		sendApprovalClosed(ap.userConn, id, "timeout")
+		return false, claude.ErrApprovalTimeout
+	}
+}
+
+// answerApproval passes the user's answer to the waiting tool call. Answers
+// to unknown or expired requests are ignored.
+func answerApproval(uc *relay.UserConn, data json.RawMessage) {
+	var resp ApprovalResponseData
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return
+	}
+
+	pendingApprovals.Lock()
+	pending, ok := pendingApprovals.requests[resp.ID]
+	if ok && pending.userID == uc.UserID {
+		delete(pendingApprovals.requests, resp.ID)
+	}
+	pendingApprovals.Unlock()
+
+	if !ok || pending.userID != uc.UserID {
+		sendApprovalClosed(uc, resp.ID, "expired")
+		return
+	}
+	pending.answer <- resp.Approved
+}
+
+// sendApprovalClosed tells the UI an approval request no longer takes answers
+func sendApprovalClosed(uc *relay.UserConn, id, reason string) {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":   "approval_closed",
+		"id":     id,
+		"reason": reason,
+	})
+	safeSend(uc.Send, msg)
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/metrics"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// activeChats holds the cancel function of the running chat task for each
+// user and agent. Only one task may run per pair at a time.
+var activeChats = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+func chatTaskKey(userID int64, agentToken string) string {
+	return fmt.Sprintf("%d:%s", userID, agentToken)
+}
+
+// startChatTask registers a new chat task. Returns ok=false if one is already
+// running for this user and agent. finish must be called when the task ends.
+func startChatTask(userID int64, agentToken string) (ctx context.Context, finish func(), ok bool) {
+	key := chatTaskKey(userID, agentToken)
+
+	activeChats.Lock()
+	defer activeChats.Unlock()
+
+	if _, running := activeChats.cancels[key]; running {
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	activeChats.cancels[key] = cancel
+
+	finish = func() {
+		activeChats.Lock()
+		delete(activeChats.cancels, key)
+		activeChats.Unlock()
+		cancel()
+	}
+	return ctx, finish, true
+}
+
+// cancelChatTask cancels the running chat task for a user and agent.
+// Returns false if there was nothing to cancel.
+func cancelChatTask(userID int64, agentToken string) bool {
+	activeChats.Lock()
+	defer activeChats.Unlock()
+
+	cancel, ok := activeChats.cancels[chatTaskKey(userID, agentToken)]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// CancelChats cancels every running chat task, e.g. when the shutdown
+// drain timeout has elapsed.
+func CancelChats() {
+	activeChats.Lock()
+	defer activeChats.Unlock()
+
+	for _, cancel := range activeChats.cancels {
+		cancel()
+	}
+}
+
+// TaskBudget limits one chat task; zero means no limit
+type TaskBudget struct {
+	MaxSteps    int // Model responses
+	MaxTokens   int // Input and output tokens
+	MaxDuration time.Duration
+}
+
+// defaultTaskBudget is used for the limits not set in the environment
+var defaultTaskBudget = TaskBudget{
+	MaxSteps:    10,
+	MaxDuration: 10 * time.Minute,
+}
+
+// TaskBudgetFromEnv reads TASK_MAX_STEPS, TASK_MAX_TOKENS and
+// TASK_MAX_DURATION (such as "5m"). "0" removes a limit.
+func TaskBudgetFromEnv() TaskBudget {
+	budget := defaultTaskBudget
+	if v, err := strconv.Atoi(os.Getenv("TASK_MAX_STEPS")); err == nil && v >= 0 {
+		budget.MaxSteps = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("TASK_MAX_TOKENS")); err == nil && v >= 0 {
+		budget.MaxTokens = v
+	}
+	if v := os.Getenv("TASK_MAX_DURATION"); v == "0" {
+		budget.MaxDuration = 0
+	} else if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		budget.MaxDuration = d
+	}
+	return budget
+}
+
+// chatTask tracks the state and stats of a running chat task, stores them
+// and tells the user about every change
+type chatTask struct {
+	mu     sync.Mutex
+	record models.Task
+	uc     *relay.UserConn
+	budget TaskBudget
+}
+
+// newChatTask records a new running task
+func newChatTask(uc *relay.UserConn, agentToken string, conversationID int64, message string) *chatTask {
+	t := &chatTask{
+		record: models.Task{
+			UserID:         uc.UserID,
+			AgentToken:     agentToken,
+			ConversationID: conversationID,
+			Message:        message,
+		},
+		uc:     uc,
+		budget: TaskBudgetFromEnv(),
+	}
+	if err := models.CreateTask(&t.record); err != nil {
+		log.Printf("Failed to store task for user %d: %v", uc.UserID, err)
+	}
+	sendChatStatus(uc, models.TaskRunning)
+	return t
+}
+
+// setState moves a running task to running or waiting_for_user
+func (t *chatTask) setState(state string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.record.Status == state || models.TaskFinished(t.record.Status) {
+		return
+	}
+	t.record.Status = state
+	if t.record.ID != 0 {
+		if err := models.UpdateTaskStatus(t.record.ID, state); err != nil {
+			log.Printf("Failed to update task %d: %v", t.record.ID, err)
+		}
+	}
+	sendChatStatus(t.uc, state)
+}
+
+// addStep counts one model response and the tool calls it made
+func (t *chatTask) addStep(resp *claude.ChatResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.record.Steps++
+	t.record.Actions += len(resp.ToolCalls)
+	t.record.InputTokens += resp.Usage.InputTokens + resp.Usage.CacheReadInputTokens + resp.Usage.CacheCreationInputTokens
+	t.record.OutputTokens += resp.Usage.OutputTokens
+	if resp.TextContent != "" {
+		t.record.Summary = resp.TextContent
+	}
+}
+
+// checkBudget returns why the task may not take another step, or "" if it may
+func (t *chatTask) checkBudget() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case t.budget.MaxSteps > 0 && t.record.Steps >= t.budget.MaxSteps:
+		return fmt.Sprintf("已達每個任務最多 %d 個步驟的上限", t.budget.MaxSteps)
+	case t.budget.MaxTokens > 0 && t.record.InputTokens+t.record.OutputTokens >= t.budget.MaxTokens:
+		return fmt.Sprintf("已達每個任務最多 %d 個 token 的上限", t.budget.MaxTokens)
+	}
+	return ""
+}
+
+// stopped returns the final state of a task whose context is done: the
+// deadline is the wall-clock budget, anything else a cancellation
+func (t *chatTask) stopped(ctx context.Context) (status, reason string) {
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return models.TaskCancelled, ""
+	}
+	reason = fmt.Sprintf("已超過每個任務 %s 的時間上限", t.budget.MaxDuration)
+	sendChatError(t.uc, reason+"，AI 任務已停止")
+	return models.TaskBudgetExceeded, reason
+}
+
+// TaskCompleteMessage reports the outcome of a chat task
+type TaskCompleteMessage struct {
+	Type       string `json:"type"`
+	TaskID     int64  `json:"task_id"`
+	Status     string `json:"status"`
+	Summary    string `json:"summary,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Steps      int    `json:"steps"`
+	Actions    int    `json:"actions"`
+	Tokens     int    `json:"tokens"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// maxTaskSummary is the longest summary sent with task_complete, in runes
+const maxTaskSummary = 200
+
+// finish stores the final state and sends task_complete followed by the
+// final chat_status
+func (t *chatTask) finish(status, reason string) {
+	t.mu.Lock()
+	t.record.Status = status
+	t.record.Error = reason
+	if t.record.ID != 0 {
+		if err := models.FinishTask(&t.record); err != nil {
+			log.Printf("Failed to finish task %d: %v", t.record.ID, err)
+		}
+	}
+	rec := t.record
+	t.mu.Unlock()
+
+	metrics.ChatTasks.Inc(status)
+	summary := []rune(rec.Summary)
+	if len(summary) > maxTaskSummary {
+		summary = append(summary[:maxTaskSummary], '…')
+	}
+	resp, _ := json.Marshal(TaskCompleteMessage{
+		Type:       "task_complete",
+		TaskID:     rec.ID,
+		Status:     status,
+		Summary:    string(summary),
+		Error:      reason,
+		Steps:      rec.Steps,
+		Actions:    rec.Actions,
+		Tokens:     rec.InputTokens + rec.OutputTokens,
+		DurationMs: time.Since(rec.StartedAt).Milliseconds(),
+	})
+	safeSend(t.uc.Send, resp)
+	sendChatStatus(t.uc, status)
+}
+
+// sendChatStatus tells the UI the state of the chat task
+func sendChatStatus(uc *relay.UserConn, status string) {
+	resp, _ := json.Marshal(map[string]interface{}{
+		"type":   "chat_status",
+		"status": status,
+	})
+	safeSend(uc.Send, resp)
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// TestMain opens a database in a temporary directory for all tests
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "handlers-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := models.InitDB(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	models.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testImage is the screenshot fake agents send
+const testImage = "aW1hZ2U="
+
+// newTestUser stores a user with an agent paired to it and returns both
+func newTestUser(t *testing.T) (int64, string) {
+	t.Helper()
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	res, err := models.DB.Exec("INSERT INTO users (username, password_hash) VALUES (?, '')", name)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	userID, _ := res.LastInsertId()
+
+	token := "agent-" + name
+	if err := models.PairAgent(userID, token, "Test"); err != nil {
+		t.Fatalf("pair agent: %v", err)
+	}
+	return userID, token
+}
+
+// fakeAgent stands in for a connected agent without a websocket. It
+// answers screenshot and page state requests and records the rest.
+type fakeAgent struct {
+	ac *relay.AgentConn
+
+	mu       sync.Mutex
+	received []map[string]interface{}
+}
+
+func startFakeAgent(t *testing.T, token string) *fakeAgent {
+	t.Helper()
+	fa := &fakeAgent{
+		ac: relay.GlobalHub.RegisterAgent(token, nil, relay.ProtocolVersion, "test", []string{
+			relay.CapNavigate, relay.CapClick, relay.CapClickXY, relay.CapInput,
+			relay.CapKey, relay.CapScroll, relay.CapScreenshot,
+		}),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range fa.ac.Send {
+			fa.handle(msg)
+		}
+	}()
+	t.Cleanup(func() {
+		relay.GlobalHub.UnregisterAgent(token)
+		<-done
+	})
+	return fa
+}
+
+func (fa *fakeAgent) handle(msg []byte) {
+	var m map[string]interface{}
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return
+	}
+
+	switch m["type"] {
+	case "request_screenshot":
+		raw, _ := json.Marshal(ScreenshotData{
+			Type: "screenshot", Image: testImage,
+			URL: "https://example.com/", Title: "Example", Width: 1280, Height: 800,
+		})
+		handleAgentMessage(fa.ac, WSMessage{Type: "screenshot"}, raw)
+	case "get_page_state":
+		raw := []byte(`{"type":"page_state","state":{"url":"https://example.com/","inputs":[],"buttons":[]}}`)
+		handleAgentMessage(fa.ac, WSMessage{Type: "page_state"}, raw)
+	default:
+		fa.mu.Lock()
+		fa.received = append(fa.received, m)
+		fa.mu.Unlock()
+	}
+}
+
+// commands returns the messages other than screenshot and page state
+// requests the agent has been sent
+func (fa *fakeAgent) commands() []map[string]interface{} {
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	return append([]map[string]interface{}(nil), fa.received...)
+}
+
+// useFakeProvider makes fake the LLM provider of the agent
+func useFakeProvider(t *testing.T, userID int64, agentToken string, fake *claude.FakeProvider) {
+	t.Helper()
+	claude.RegisterProvider(claude.ProviderFake, func() claude.Provider { return fake })
+	if _, err := models.SetAgentLLMProvider(userID, agentToken, claude.ProviderFake); err != nil {
+		t.Fatalf("set provider: %v", err)
+	}
+}
+
+// chatMessages drains what the user has been sent so far and returns the
+// chat_response messages
+func chatMessages(uc *relay.UserConn) []ChatResponse {
+	var responses []ChatResponse
+	for {
+		select {
+		case msg := <-uc.Send:
+			var resp ChatResponse
+			if json.Unmarshal(msg, &resp) == nil && resp.Type == "chat_response" {
+				responses = append(responses, resp)
+			}
+		default:
+			return responses
+		}
+	}
+}
+
+func lastTask(t *testing.T, userID int64, agentToken string) models.Task {
+	t.Helper()
+	tasks, err := models.ListTasks(userID, agentToken, 1)
+	if err != nil || len(tasks) == 0 {
+		t.Fatalf("list tasks: %v (%d tasks)", err, len(tasks))
+	}
+	return tasks[0]
+}
+
+func TestHandleChatMessageRunsToolCalls(t *testing.T) {
+	t.Setenv("APPROVAL_RULES", "none")
+	userID, token := newTestUser(t)
+	agent := startFakeAgent(t, token)
+
+	fake := claude.NewFakeProvider(
+		claude.FakeResponse{Response: &claude.ChatResponse{
+			TextContent: "點擊按鈕",
+			ToolCalls: []claude.ToolCall{{
+				ID:    "toolu_1",
+				Name:  "click",
+				Input: json.RawMessage(`{"x": 100, "y": 200, "description": "OK 按鈕"}`),
+			}},
+			StopReason: "tool_use",
+		}},
+		claude.FakeResponse{Response: &claude.ChatResponse{TextContent: "已完成", StopReason: "end_turn"}},
+	)
+	useFakeProvider(t, userID, token, fake)
+
+	uc := relay.GlobalHub.RegisterUser(userID, nil)
+	defer relay.GlobalHub.UnregisterUser(uc)
+	conv := claude.GlobalConversationManager.GetOrCreate(userID, token)
+
+	handleChatMessage(context.Background(), uc, token, conv, "請按 OK")
+
+	// The click reached the agent
+	var clicked bool
+	for _, cmd := range agent.commands() {
+		if cmd["type"] == "click_xy" && cmd["x"] == 100.0 && cmd["y"] == 200.0 {
+			clicked = true
+		}
+	}
+	if !clicked {
+		t.Errorf("agent did not get the click, got %v", agent.commands())
+	}
+
+	// The second request answers the tool call
+	requests := fake.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(requests))
+	}
+	var answered bool
+	for _, msg := range requests[1] {
+		for _, block := range msg.Content {
+			if block.Type == "tool_result" && block.ToolUseID == "toolu_1" {
+				answered = true
+				if block.IsError {
+					t.Errorf("tool result is an error: %s", block.Content)
+				}
+			}
+		}
+	}
+	if !answered {
+		t.Errorf("second request has no tool_result for toolu_1")
+	}
+	if systems := fake.Systems(); systems[0] == "" || systems[0] != systems[1] {
+		t.Errorf("system prompt is empty or changed between steps")
+	}
+	// The agent can't use element refs, so the prompt doesn't describe them
+	if strings.Contains(fake.Systems()[0], "click_element") {
+		t.Errorf("system prompt describes click_element, which isn't offered")
+	}
+
+	var replied bool
+	for _, resp := range chatMessages(uc) {
+		if resp.IsError {
+			t.Errorf("unexpected error sent to user: %s", resp.Content)
+		}
+		if resp.Role == "assistant" && resp.Content == "已完成" {
+			replied = true
+		}
+	}
+	if !replied {
+		t.Errorf("final reply not sent to user")
+	}
+
+	messages := conv.GetMessages()
+	if last := messages[len(messages)-1]; last.Role != "assistant" || last.Content[0].Text != "已完成" {
+		t.Errorf("last message = %+v", last)
+	}
+	if task := lastTask(t, userID, token); task.Status != models.TaskSucceeded || task.Steps != 2 || task.Actions != 1 {
+		t.Errorf("task = %+v", task)
+	}
+}
+
+func TestHandleChatMessageProviderError(t *testing.T) {
+	userID, token := newTestUser(t)
+	startFakeAgent(t, token)
+
+	fake := claude.NewFakeProvider(claude.FakeResponse{Err: errors.New("invalid request")})
+	useFakeProvider(t, userID, token, fake)
+
+	uc := relay.GlobalHub.RegisterUser(userID, nil)
+	defer relay.GlobalHub.UnregisterUser(uc)
+	conv := claude.GlobalConversationManager.GetOrCreate(userID, token)
+
+	handleChatMessage(context.Background(), uc, token, conv, "你好")
+
+	var reported bool
+	for _, resp := range chatMessages(uc) {
+		if resp.IsError && strings.Contains(resp.Content, "invalid request") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Errorf("provider error not sent to user")
+	}
+
+	// Only the user's message is kept
+	if messages := conv.GetMessages(); len(messages) != 1 || messages[0].Role != "user" {
+		t.Errorf("conversation = %+v", messages)
+	}
+	if task := lastTask(t, userID, token); task.Status != models.TaskFailed || !strings.Contains(task.Error, "invalid request") {
+		t.Errorf("task = %+v", task)
+	}
+}
+
+func TestHandleChatMessageCancelled(t *testing.T) {
+	userID, token := newTestUser(t)
+	startFakeAgent(t, token)
+
+	fake := claude.NewFakeProvider()
+	useFakeProvider(t, userID, token, fake)
+
+	uc := relay.GlobalHub.RegisterUser(userID, nil)
+	defer relay.GlobalHub.UnregisterUser(uc)
+	conv := claude.GlobalConversationManager.GetOrCreate(userID, token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handleChatMessage(ctx, uc, token, conv, "你好")
+
+	if n := len(fake.Requests()); n != 0 {
+		t.Errorf("provider called %d times after cancel", n)
+	}
+	if task := lastTask(t, userID, token); task.Status != models.TaskCancelled {
+		t.Errorf("task status = %s, want %s", task.Status, models.TaskCancelled)
+	}
+}
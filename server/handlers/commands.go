@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// commandQueueTTL is how long a command waits for an offline agent
+const commandQueueTTL = 1 * time.Hour
+
+type QueuedCommandInfo struct {
+	ID          int64           `json:"id"`
+	CommandType string          `json:"command_type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	CreatedAt   string          `json:"created_at"`
+	ExpiresAt   string          `json:"expires_at"`
+	DeliveredAt string          `json:"delivered_at,omitempty"`
+}
+
+// queueCommand stores a command for an offline agent and tells the user
+func queueCommand(uc *relay.UserConn, agentToken, commandType string, rawMsg []byte) {
+	id, err := models.EnqueueCommand(uc.UserID, agentToken, commandType, string(rawMsg), commandQueueTTL)
+	if err != nil {
+		log.Printf("Failed to queue command for agent %s: %v", agentToken[:10], err)
+		sendError(uc, "Agent 離線中，且無法排程指令")
+		return
+	}
+	log.Printf("User %d queued %s for offline agent %s (id %d)", uc.UserID, commandType, agentToken[:10], id)
+	safeSend(uc.Send, relay.CommandStatusMessage(id, commandType, models.CommandPending))
+}
+
+func toQueuedCommandInfos(commands []models.QueuedCommand) []QueuedCommandInfo {
+	infos := []QueuedCommandInfo{}
+	for _, c := range commands {
+		info := QueuedCommandInfo{
+			ID:          c.ID,
+			CommandType: c.CommandType,
+			Payload:     json.RawMessage(c.Payload),
+			Status:      c.Status,
+			CreatedAt:   c.CreatedAt.Format("2006-01-02 15:04:05"),
+			ExpiresAt:   c.ExpiresAt.Format("2006-01-02 15:04:05"),
+		}
+		// Pending commands past their expiry are reported as expired even
+		// before the cleanup ticker gets to them
+		if c.Status == models.CommandPending && time.Now().After(c.ExpiresAt) {
+			info.Status = models.CommandExpired
+		}
+		if !c.DeliveredAt.IsZero() {
+			info.DeliveredAt = c.DeliveredAt.Format("2006-01-02 15:04:05")
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// HandleCommands lists (GET ?agent=<token>) and cancels (DELETE) queued commands
+func HandleCommands(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agentToken := r.URL.Query().Get("agent")
+		agent, err := models.GetAgentByToken(agentToken)
+		if err != nil || agent.UserID != userID {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+
+		commands, err := models.GetUserCommands(userID, agentToken)
+		if err != nil {
+			sendJSON(w, []QueuedCommandInfo{})
+			return
+		}
+		sendJSON(w, toQueuedCommandInfos(commands))
+
+	case http.MethodDelete:
+		var req struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		cancelled, err := models.CancelCommand(userID, req.ID)
+		if err != nil || !cancelled {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		relay.GlobalHub.SendToUser(userID, relay.CommandStatusMessage(req.ID, "", models.CommandCancelled))
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
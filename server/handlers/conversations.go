@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+type ConversationInfo struct {
+	ID           int64  `json:"id"`
+	AgentToken   string `json:"agent_token"`
+	Title        string `json:"title"`
+	Archived     bool   `json:"archived"`
+	MessageCount int    `json:"message_count"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+}
+
+type ConversationMessageInfo struct {
+	Role      string                `json:"role"`
+	Content   []claude.ContentBlock `json:"content"`
+	CreatedAt string                `json:"created_at"`
+}
+
+type ConversationDetail struct {
+	ConversationInfo
+	Messages []ConversationMessageInfo `json:"messages"`
+}
+
+func toConversationInfo(c models.StoredConversation) ConversationInfo {
+	return ConversationInfo{
+		ID:           c.ID,
+		AgentToken:   c.AgentToken,
+		Title:        c.Title,
+		Archived:     c.Archived,
+		MessageCount: c.MessageCount,
+		CreatedAt:    c.CreatedAt.Format("2006-01-02 15:04:05"),
+		UpdatedAt:    c.UpdatedAt.Format("2006-01-02 15:04:05"),
+	}
+}
+
+// conversationDetail returns a conversation with its full stored history.
+// Images are returned as references to the image endpoint.
+func conversationDetail(conv *models.StoredConversation) (*ConversationDetail, error) {
+	stored, err := models.GetConversationMessages(conv.ID, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	detail := &ConversationDetail{
+		ConversationInfo: toConversationInfo(*conv),
+		Messages:         []ConversationMessageInfo{},
+	}
+	for _, m := range stored {
+		blocks, err := claude.DecodeStoredBlocks(conv.ID, m.Content, false)
+		if err != nil {
+			continue
+		}
+		for _, b := range blocks {
+			if b.Type == "image" && b.Source != nil {
+				b.Source.Data = fmt.Sprintf("/api/conversations/image?id=%d&name=%s", conv.ID, b.Source.Data)
+			}
+		}
+		detail.Messages = append(detail.Messages, ConversationMessageInfo{
+			Role:      m.Role,
+			Content:   blocks,
+			CreatedAt: m.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+	return detail, nil
+}
+
+// sendConversationList sends the user's threads with an agent
+func sendConversationList(uc *relay.UserConn, agentToken string, includeArchived bool) {
+	conversations, err := models.GetAgentConversations(uc.UserID, agentToken, includeArchived)
+	if err != nil {
+		log.Printf("Failed to list conversations for user %d: %v", uc.UserID, err)
+	}
+	infos := []ConversationInfo{}
+	for _, c := range conversations {
+		infos = append(infos, toConversationInfo(c))
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"type":          "conversations",
+		"agent_token":   agentToken,
+		"conversations": infos,
+	})
+	safeSend(uc.Send, resp)
+}
+
+// sendConversationLoaded sends a thread and its history so the UI can switch to it
+func sendConversationLoaded(uc *relay.UserConn, conv *claude.Conversation) {
+	stored, err := models.GetConversation(uc.UserID, conv.DBID)
+	if err != nil {
+		// Not stored; there is no history to show
+		stored = &models.StoredConversation{UserID: uc.UserID, AgentToken: conv.AgentToken, Title: conv.GetTitle()}
+	}
+	detail, err := conversationDetail(stored)
+	if err != nil {
+		sendError(uc, "無法載入對話")
+		return
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"type":         "conversation_loaded",
+		"conversation": detail,
+	})
+	safeSend(uc.Send, resp)
+}
+
+// handleConversationMessage handles the thread management messages of the
+// user WebSocket for the agent the user is viewing
+func handleConversationMessage(uc *relay.UserConn, msgType string, data json.RawMessage) {
+	agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
+	if agentToken == "" {
+		sendError(uc, "請先選擇一個 Agent")
+		return
+	}
+
+	var req struct {
+		ID              int64  `json:"id"`
+		Title           string `json:"title"`
+		Archived        bool   `json:"archived"`
+		IncludeArchived bool   `json:"include_archived"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			sendError(uc, "Invalid conversation request")
+			return
+		}
+	}
+
+	switch msgType {
+	case "list_conversations":
+		sendConversationList(uc, agentToken, req.IncludeArchived)
+
+	case "new_conversation", "clear_conversation":
+		// Clearing starts a fresh thread; the old one stays in the history
+		conv, err := claude.GlobalConversationManager.Create(uc.UserID, agentToken, req.Title)
+		if err != nil {
+			log.Printf("Failed to create conversation for user %d: %v", uc.UserID, err)
+			sendError(uc, "無法建立新對話")
+			return
+		}
+		sendConversationLoaded(uc, conv)
+		sendConversationList(uc, agentToken, false)
+		if msgType == "clear_conversation" {
+			sendChatResponse(uc, "system", "對話已清除", "", nil)
+		}
+
+	case "load_conversation":
+		// ID 0 loads the most recent thread
+		var conv *claude.Conversation
+		if req.ID == 0 {
+			conv = claude.GlobalConversationManager.GetOrCreate(uc.UserID, agentToken)
+		} else {
+			var err error
+			conv, err = claude.GlobalConversationManager.Get(uc.UserID, agentToken, req.ID)
+			if err != nil {
+				sendError(uc, "找不到此對話")
+				return
+			}
+		}
+		sendConversationLoaded(uc, conv)
+
+	case "rename_conversation":
+		if ok, err := claude.GlobalConversationManager.Rename(uc.UserID, req.ID, req.Title); err != nil || !ok {
+			sendError(uc, "無法重新命名對話")
+			return
+		}
+		sendConversationList(uc, agentToken, false)
+
+	case "archive_conversation":
+		if ok, err := models.SetConversationArchived(uc.UserID, req.ID, req.Archived); err != nil || !ok {
+			sendError(uc, "無法封存對話")
+			return
+		}
+		sendConversationList(uc, agentToken, false)
+	}
+}
+
+// HandleConversations lists (GET, optionally ?agent=<token>&archived=1),
+// fetches (GET ?id=<id>), renames or archives (PATCH) and deletes (DELETE)
+// stored conversations
+func HandleConversations(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		idParam := r.URL.Query().Get("id")
+		if idParam == "" {
+			var conversations []models.StoredConversation
+			var err error
+			if agentToken := r.URL.Query().Get("agent"); agentToken != "" {
+				includeArchived := r.URL.Query().Get("archived") == "1"
+				conversations, err = models.GetAgentConversations(userID, agentToken, includeArchived)
+			} else {
+				conversations, err = models.GetUserConversations(userID)
+			}
+			if err != nil {
+				sendJSON(w, []ConversationInfo{})
+				return
+			}
+			infos := []ConversationInfo{}
+			for _, c := range conversations {
+				infos = append(infos, toConversationInfo(c))
+			}
+			sendJSON(w, infos)
+			return
+		}
+
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+			return
+		}
+		conv, err := models.GetConversation(userID, id)
+		if err != nil {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+
+		detail, err := conversationDetail(conv)
+		if err != nil {
+			http.Error(w, "Failed to load conversation", http.StatusInternalServerError)
+			return
+		}
+		sendJSON(w, detail)
+
+	case http.MethodPatch:
+		// Rename and/or archive a conversation
+		var req struct {
+			ID       int64   `json:"id"`
+			Title    *string `json:"title"`
+			Archived *bool   `json:"archived"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if req.Title != nil {
+			if ok, err := claude.GlobalConversationManager.Rename(userID, req.ID, *req.Title); err != nil || !ok {
+				sendJSON(w, map[string]bool{"success": false})
+				return
+			}
+		}
+		if req.Archived != nil {
+			if ok, err := models.SetConversationArchived(userID, req.ID, *req.Archived); err != nil || !ok {
+				sendJSON(w, map[string]bool{"success": false})
+				return
+			}
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	case http.MethodDelete:
+		var req struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		deleted, err := models.DeleteConversation(userID, req.ID)
+		if err != nil || !deleted {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		claude.GlobalConversationManager.Evict(userID, req.ID)
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleConversationImage serves a screenshot stored with a conversation
+// (GET ?id=<conversation id>&name=<file name>)
+func HandleConversationImage(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid conversation id", http.StatusBadRequest)
+		return
+	}
+	if _, err := models.GetConversation(userID, id); err != nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	path, err := models.ImagePath(id, r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, "Invalid image name", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeFile(w, r, path)
+}
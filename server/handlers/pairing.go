@@ -10,11 +10,17 @@ import (
 type PairRequest struct {
 	Code string `json:"code"`
 	Name string `json:"name,omitempty"`
+
+	// Opt into end-to-end encryption with this device
+	E2E             bool   `json:"e2e,omitempty"`
+	DeviceID        string `json:"device_id,omitempty"`
+	DevicePublicKey string `json:"device_public_key,omitempty"`
 }
 
 type PairResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message,omitempty"`
+	Success    bool   `json:"success"`
+	Message    string `json:"message,omitempty"`
+	AgentToken string `json:"agent_token,omitempty"`
 }
 
 type AgentInfo struct {
@@ -44,12 +50,17 @@ func HandlePair(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate pairing code
-	agentToken, err := models.ValidatePairingCode(req.Code)
+	agentToken, agentPublicKey, err := models.ValidatePairingCode(req.Code)
 	if err != nil {
 		sendJSON(w, PairResponse{Success: false, Message: "Invalid or expired pairing code"})
 		return
 	}
 
+	if req.E2E && (agentPublicKey == "" || req.DeviceID == "" || req.DevicePublicKey == "") {
+		sendJSON(w, PairResponse{Success: false, Message: "This agent does not support end-to-end encryption"})
+		return
+	}
+
 	// Set agent name
 	name := req.Name
 	if name == "" {
@@ -65,17 +76,32 @@ func HandlePair(w http.ResponseWriter, r *http.Request) {
 	// Delete used pairing code
 	models.DeletePairingCode(req.Code)
 
+	if req.E2E {
+		if err := models.EnableAgentE2E(agentToken, agentPublicKey); err != nil {
+			sendJSON(w, PairResponse{Success: false, Message: "Failed to enable encryption"})
+			return
+		}
+	}
+
 	// Update agent's user ID in relay hub
 	relay.GlobalHub.UpdateAgentUserID(agentToken, userID)
 
-	// Notify agent that it's paired
-	notifyMsg, _ := json.Marshal(map[string]interface{}{
+	// Notify agent that it's paired, handing over the device key for E2E mode.
+	// Public keys only, so the server can't decrypt anything it relays.
+	notify := map[string]interface{}{
 		"type":    "paired",
 		"user_id": userID,
-	})
+	}
+	if req.E2E {
+		notify["e2e"] = true
+		notify["device_id"] = req.DeviceID
+		notify["device_public_key"] = req.DevicePublicKey
+	}
+	notifyMsg, _ := json.Marshal(notify)
 	relay.GlobalHub.SendToAgent(agentToken, notifyMsg)
+	syncSecrets(userID, agentToken)
 
-	sendJSON(w, PairResponse{Success: true})
+	sendJSON(w, PairResponse{Success: true, AgentToken: agentToken})
 }
 
 func HandleAgents(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/metrics"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// SetPolicyMessage tells an agent which URLs its browser may open. The
+// agent checks navigations the AI didn't ask for, such as link clicks.
+type SetPolicyMessage struct {
+	AllowedURLs []string `json:"allowed_urls"`
+	BlockedURLs []string `json:"blocked_urls"`
+}
+
+// PolicyViolationData is sent flat by the agent when it stopped a navigation
+type PolicyViolationData struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+// loadToolPolicy returns the policy the tool executor enforces for an agent,
+// or nil if the agent has none
+func loadToolPolicy(agentToken string) *claude.ToolPolicy {
+	p, err := models.GetAgentPolicy(agentToken)
+	if err != nil {
+		log.Printf("Failed to load agent policy: %v", err)
+		return nil
+	}
+	if p == nil {
+		return nil
+	}
+	return &claude.ToolPolicy{
+		AllowedURLs:   p.AllowedURLs,
+		BlockedURLs:   p.BlockedURLs,
+		DisabledTools: p.DisabledTools,
+		MaxActions:    p.MaxActions,
+	}
+}
+
+// setPolicyMessage builds the set_policy message for an agent. An agent
+// without a policy gets empty lists, which allow everything.
+func setPolicyMessage(agentToken string) []byte {
+	var data SetPolicyMessage
+	if p := loadToolPolicy(agentToken); p != nil {
+		data.AllowedURLs = p.AllowedURLs
+		data.BlockedURLs = p.BlockedURLs
+	}
+	msg, _ := json.Marshal(WSMessage{Type: "set_policy", Data: mustMarshal(data)})
+	return msg
+}
+
+// handlePolicyViolation reports a navigation the agent stopped to the users
+// viewing it
+func handlePolicyViolation(ac *relay.AgentConn, rawMsg []byte) {
+	var violation PolicyViolationData
+	if err := json.Unmarshal(rawMsg, &violation); err != nil {
+		return
+	}
+	metrics.PolicyViolations.Inc("agent")
+	log.Printf("Agent %s blocked navigation to %s: %s", ac.Token[:10], violation.URL, violation.Reason)
+
+	msg, _ := json.Marshal(ChatResponse{
+		Type:    "chat_response",
+		Role:    "system",
+		Content: "已阻止前往 " + violation.URL + "：" + violation.Reason,
+		IsError: true,
+	})
+	relay.GlobalHub.BroadcastToAgentUsers(ac.Token, msg)
+}
+
+// HandleAgentPolicy shows (GET ?agent=<token>), changes (PUT) and removes
+// (DELETE ?agent=<token>) the policy of one of the user's agents
+func HandleAgentPolicy(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agentToken := r.URL.Query().Get("agent")
+		agent, err := models.GetAgentByToken(agentToken)
+		if err != nil || agent.UserID != userID {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+
+		policy, err := models.GetAgentPolicy(agentToken)
+		if err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if policy == nil {
+			policy = &models.AgentPolicy{AgentToken: agentToken}
+		}
+		sendJSON(w, policy)
+
+	case http.MethodPut:
+		var req models.AgentPolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxActions < 0 {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		saved, err := models.SaveAgentPolicy(userID, req)
+		if err != nil || !saved {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		relay.GlobalHub.SendToAgent(req.AgentToken, setPolicyMessage(req.AgentToken))
+		sendJSON(w, map[string]bool{"success": true})
+
+	case http.MethodDelete:
+		agentToken := r.URL.Query().Get("agent")
+		if err := models.DeleteAgentPolicy(userID, agentToken); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		relay.GlobalHub.SendToAgent(agentToken, setPolicyMessage(agentToken))
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
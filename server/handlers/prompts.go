@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+type PromptSettingsInfo struct {
+	Template  *models.PromptTemplate `json:"template"`  // Stored for the requested scope, if any
+	Effective models.PromptTemplate  `json:"effective"` // Merged over the user-wide template and defaults
+	Default   string                 `json:"default"`   // Built-in template of the effective locale
+	Locales   []string               `json:"locales"`
+	Variables []string               `json:"variables"`
+}
+
+// promptVars fills in the template variables for a user's agent that is
+// offered tools
+func promptVars(userID int64, agentToken string, settings models.PromptTemplate, tools []claude.Tool) (claude.PromptVars, error) {
+	var agentName string
+	if agentToken != "" {
+		if agent, err := models.GetAgentByToken(agentToken); err == nil && agent.UserID == userID {
+			agentName = agent.Name
+		}
+	}
+	width, height, _ := relay.GlobalHub.GetViewport(agentToken)
+	vars, err := claude.NewPromptVars(settings.Locale, settings.TimeZone, agentName, width, height, time.Now())
+	if err != nil {
+		return vars, err
+	}
+
+	// Only the names; the values never reach the model
+	vars.Secrets, err = models.GetSecretNames(userID, agentToken)
+	if err != nil {
+		log.Printf("Failed to list secrets of user %d: %v", userID, err)
+	}
+	vars.ToolMode = effectiveToolMode(userID, agentToken)
+	vars.Tools = toolNames(tools)
+	return vars, nil
+}
+
+// renderPrompt renders settings for a user's agent. An empty content uses
+// the built-in template of the locale.
+func renderPrompt(userID int64, agentToken string, settings models.PromptTemplate, tools []claude.Tool) (string, error) {
+	vars, err := promptVars(userID, agentToken, settings, tools)
+	if err != nil {
+		return "", err
+	}
+	tmpl := settings.Content
+	if tmpl == "" {
+		tmpl = claude.DefaultPromptTemplate(vars.Locale)
+	}
+	return claude.RenderSystemPrompt(tmpl, vars)
+}
+
+// buildSystemPrompt renders the system prompt configured for a user's agent,
+// describing only the tools the chat offers. A broken template falls back to
+// the built-in one so the chat still works.
+func buildSystemPrompt(userID int64, agentToken string, tools []claude.Tool) string {
+	settings, err := models.GetEffectivePromptTemplate(userID, agentToken)
+	if err != nil {
+		log.Printf("Failed to load prompt template for user %d: %v", userID, err)
+	}
+
+	prompt, err := renderPrompt(userID, agentToken, settings, tools)
+	if err == nil {
+		return prompt
+	}
+	log.Printf("Prompt template of user %d is unusable, using the default: %v", userID, err)
+
+	vars, _ := claude.NewPromptVars(settings.Locale, "", "", 0, 0, time.Now())
+	vars.Tools = toolNames(tools)
+	prompt, err = claude.RenderSystemPrompt(claude.DefaultPromptTemplate(vars.Locale), vars)
+	if err != nil {
+		log.Printf("Failed to render default prompt: %v", err)
+	}
+	return prompt
+}
+
+// HandlePrompts shows (GET ?agent=<token>), changes (PUT) and resets
+// (DELETE ?agent=<token>) the system prompt template. Without an agent the
+// user-wide template is used.
+func HandlePrompts(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agentToken := r.URL.Query().Get("agent")
+		if agentToken != "" {
+			agent, err := models.GetAgentByToken(agentToken)
+			if err != nil || agent.UserID != userID {
+				http.Error(w, "Agent not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		stored, err := models.GetPromptTemplate(userID, agentToken)
+		if err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		effective, err := models.GetEffectivePromptTemplate(userID, agentToken)
+		if err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		locale := effective.Locale
+		if locale == "" {
+			locale = claude.DefaultLocale
+		}
+		sendJSON(w, PromptSettingsInfo{
+			Template:  stored,
+			Effective: effective,
+			Default:   claude.DefaultPromptTemplate(locale),
+			Locales:   claude.PromptLocales(),
+			Variables: claude.PromptVariables,
+		})
+
+	case http.MethodPut:
+		var req models.PromptTemplate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		// Reject templates that would fail at chat time
+		if _, err := renderPrompt(userID, req.AgentToken, req, currentTools(userID, req.AgentToken)); err != nil {
+			sendJSON(w, map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+
+		saved, err := models.SavePromptTemplate(userID, req)
+		if err != nil || !saved {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	case http.MethodDelete:
+		if err := models.DeletePromptTemplate(userID, r.URL.Query().Get("agent")); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlePromptPreview renders a template (POST) as it would be sent for an
+// agent right now. Fields left empty in the request use the saved settings.
+func HandlePromptPreview(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.PromptTemplate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSON(w, map[string]bool{"success": false})
+		return
+	}
+	if req.AgentToken != "" {
+		agent, err := models.GetAgentByToken(req.AgentToken)
+		if err != nil || agent.UserID != userID {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	settings, err := models.GetEffectivePromptTemplate(userID, req.AgentToken)
+	if err != nil {
+		sendJSON(w, map[string]bool{"success": false})
+		return
+	}
+	if req.Locale != "" {
+		settings.Locale = req.Locale
+	}
+	if req.TimeZone != "" {
+		settings.TimeZone = req.TimeZone
+	}
+	if req.Content != "" {
+		settings.Content = req.Content
+	}
+
+	prompt, err := renderPrompt(userID, req.AgentToken, settings, currentTools(userID, req.AgentToken))
+	if err != nil {
+		sendJSON(w, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	sendJSON(w, map[string]interface{}{"success": true, "prompt": prompt})
+}
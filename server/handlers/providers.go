@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+)
+
+type LLMProviderInfo struct {
+	Providers     []string `json:"providers"`
+	Default       string   `json:"default"`
+	UserProvider  string   `json:"user_provider"`
+	AgentProvider string   `json:"agent_provider,omitempty"`
+	Effective     string   `json:"effective"`
+}
+
+// HandleLLMProvider shows (GET ?agent=<token>) and changes (PUT) which LLM
+// provider runs the AI assistant. PUT without agent_token sets the user's
+// provider for all agents; an empty provider clears the setting.
+func HandleLLMProvider(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		userProvider, _ := models.GetUserLLMProvider(userID)
+		info := LLMProviderInfo{
+			Providers:    claude.ProviderNames(),
+			Default:      claude.DefaultProviderName(),
+			UserProvider: userProvider,
+			Effective:    userProvider,
+		}
+
+		if agentToken := r.URL.Query().Get("agent"); agentToken != "" {
+			agent, err := models.GetAgentByToken(agentToken)
+			if err != nil || agent.UserID != userID {
+				http.Error(w, "Agent not found", http.StatusNotFound)
+				return
+			}
+			info.Effective = models.GetLLMProvider(userID, agentToken)
+			if info.Effective != userProvider {
+				info.AgentProvider = info.Effective
+			}
+		}
+		if info.Effective == "" {
+			info.Effective = info.Default
+		}
+		sendJSON(w, info)
+
+	case http.MethodPut:
+		var req struct {
+			AgentToken string `json:"agent_token"`
+			Provider   string `json:"provider"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if req.Provider != "" && !claude.HasProvider(req.Provider) {
+			sendJSON(w, map[string]interface{}{"success": false, "error": "Unknown provider"})
+			return
+		}
+
+		if req.AgentToken == "" {
+			if err := models.SetUserLLMProvider(userID, req.Provider); err != nil {
+				sendJSON(w, map[string]bool{"success": false})
+				return
+			}
+		} else {
+			updated, err := models.SetAgentLLMProvider(userID, req.AgentToken, req.Provider)
+			if err != nil || !updated {
+				sendJSON(w, map[string]bool{"success": false})
+				return
+			}
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// SecretRequest stores a secret; the value is never sent back
+type SecretRequest struct {
+	AgentToken string `json:"agent_token"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+}
+
+// SetSecretsMessage hands an agent the values it fills in for placeholders
+type SetSecretsMessage struct {
+	Secrets map[string]string `json:"secrets"`
+}
+
+// loadSecrets returns the secrets usable on a user's agent, and a redactor
+// that replaces their values with placeholders
+func loadSecrets(userID int64, agentToken string) (map[string]string, *claude.SecretRedactor) {
+	secrets, err := models.GetAgentSecrets(userID, agentToken)
+	if err != nil {
+		log.Printf("Failed to load secrets of user %d: %v", userID, err)
+		secrets = nil
+	}
+	return secrets, claude.NewSecretRedactor(secrets)
+}
+
+// syncSecrets sends the current secrets to a user's agent, or to all of the
+// user's agents for user-wide secrets. Offline agents get them when they
+// connect.
+func syncSecrets(userID int64, agentToken string) {
+	tokens := []string{agentToken}
+	if agentToken == "" {
+		agents, err := models.GetUserAgents(userID)
+		if err != nil {
+			log.Printf("Failed to list agents of user %d: %v", userID, err)
+			return
+		}
+		tokens = tokens[:0]
+		for _, a := range agents {
+			tokens = append(tokens, a.Token)
+		}
+	}
+
+	for _, token := range tokens {
+		ac, ok := relay.GlobalHub.GetAgent(token)
+		if !ok {
+			continue
+		}
+		if msg := setSecretsMessage(ac); msg != nil {
+			relay.GlobalHub.SendToAgent(token, msg)
+		}
+	}
+}
+
+// setSecretsMessage builds the set_secrets message for a connected agent,
+// or returns nil if the agent shouldn't get secrets. E2E agents don't: the
+// AI is disabled for them, and the server is not meant to see their traffic.
+func setSecretsMessage(ac *relay.AgentConn) []byte {
+	if ac.UserID == 0 || !ac.HasCapability("secrets") {
+		return nil
+	}
+	agent, err := models.GetAgentByToken(ac.Token)
+	if err != nil || agent.E2EEnabled {
+		return nil
+	}
+
+	secrets, _ := loadSecrets(ac.UserID, ac.Token)
+	if secrets == nil {
+		secrets = map[string]string{}
+	}
+	msg, _ := json.Marshal(WSMessage{
+		Type: "set_secrets",
+		Data: mustMarshal(SetSecretsMessage{Secrets: secrets}),
+	})
+	return msg
+}
+
+// HandleSecrets lists (GET ?agent=<token>), stores (PUT) and deletes
+// (DELETE ?agent=<token>&name=<name>) secrets. Without an agent the
+// user-wide secrets are used. Values are write-only.
+func HandleSecrets(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agentToken := r.URL.Query().Get("agent")
+		if agentToken != "" {
+			agent, err := models.GetAgentByToken(agentToken)
+			if err != nil || agent.UserID != userID {
+				http.Error(w, "Agent not found", http.StatusNotFound)
+				return
+			}
+		}
+
+		secrets, err := models.ListSecrets(userID, agentToken)
+		if err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		sendJSON(w, map[string]interface{}{
+			"enabled": models.SecretsEnabled(),
+			"secrets": secrets,
+		})
+
+	case http.MethodPut:
+		var req SecretRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !claude.ValidSecretName(req.Name) || req.Value == "" {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+
+		saved, err := models.SaveSecret(userID, req.AgentToken, req.Name, req.Value)
+		if err != nil {
+			log.Printf("Failed to save secret %q of user %d: %v", req.Name, userID, err)
+		}
+		if err != nil || !saved {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		syncSecrets(userID, req.AgentToken)
+		sendJSON(w, map[string]bool{"success": true})
+
+	case http.MethodDelete:
+		agentToken := r.URL.Query().Get("agent")
+		if err := models.DeleteSecret(userID, agentToken, r.URL.Query().Get("name")); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		syncSecrets(userID, agentToken)
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	// chatLoops tracks running handleChatMessage goroutines
+	chatLoops sync.WaitGroup
+
+	// chatLoopsMu keeps chatLoops.Add from racing with BeginShutdown, so
+	// no loop starts once WaitForChats may be waiting
+	chatLoopsMu sync.Mutex
+
+	// shutdownCh is closed when the server starts shutting down
+	shutdownCh   = make(chan struct{})
+	shutdownOnce sync.Once
+)
+
+// BeginShutdown stops new chat tasks from starting and asks running ones
+// to stop after their current step.
+func BeginShutdown() {
+	chatLoopsMu.Lock()
+	defer chatLoopsMu.Unlock()
+	shutdownOnce.Do(func() { close(shutdownCh) })
+}
+
+// startChatLoop adds a chat loop to chatLoops. It returns false once
+// shutdown has begun; the caller must then not start the loop.
+func startChatLoop() bool {
+	chatLoopsMu.Lock()
+	defer chatLoopsMu.Unlock()
+	if isShuttingDown() {
+		return false
+	}
+	chatLoops.Add(1)
+	return true
+}
+
+// isShuttingDown reports whether BeginShutdown has been called
+func isShuttingDown() bool {
+	select {
+	case <-shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForChats waits for running chat tasks to finish.
+// Returns false if the timeout elapsed first.
+func WaitForChats(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		chatLoops.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"weekend-chart/server/models"
+)
+
+const (
+	defaultTaskListLimit = 50
+	maxTaskListLimit     = 200
+)
+
+// HandleTasks lists the user's latest chat tasks, optionally only those of
+// one agent (?agent=), or returns a single task (?id=)
+func HandleTasks(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if idParam := r.URL.Query().Get("id"); idParam != "" {
+		id, err := strconv.ParseInt(idParam, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid task id", http.StatusBadRequest)
+			return
+		}
+		task, err := models.GetTask(userID, id)
+		if err != nil {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		sendJSON(w, task)
+		return
+	}
+
+	limit := defaultTaskListLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = min(v, maxTaskListLimit)
+	}
+	tasks, err := models.ListTasks(userID, r.URL.Query().Get("agent"), limit)
+	if err != nil {
+		sendJSON(w, []models.Task{})
+		return
+	}
+	sendJSON(w, tasks)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+type ToolModeInfo struct {
+	Modes     []string `json:"modes"`
+	Default   string   `json:"default"`
+	AgentMode string   `json:"agent_mode,omitempty"`
+	Effective string   `json:"effective"` // What the next chat uses, see effectiveToolMode
+}
+
+// effectiveToolMode returns the tool mode a user's agent is driven with.
+// Computer mode needs the Anthropic provider and an agent that can execute
+// the computer-use actions; otherwise the browser tools are used.
+func effectiveToolMode(userID int64, agentToken string) string {
+	if models.GetAgentToolMode(userID, agentToken) != claude.ToolModeComputer {
+		return claude.DefaultToolMode
+	}
+
+	provider := models.GetLLMProvider(userID, agentToken)
+	if provider == "" {
+		provider = claude.DefaultProviderName()
+	}
+	if provider != claude.ProviderAnthropic {
+		return claude.ToolModeBrowser
+	}
+	if ac, ok := relay.GlobalHub.GetAgent(agentToken); ok && !ac.HasCapability("computer_use") {
+		return claude.ToolModeBrowser
+	}
+	return claude.ToolModeComputer
+}
+
+// offeredTools returns the tools of a tool mode the model is offered for an
+// agent: those the agent's policy doesn't disable and the agent is able to
+// execute
+func offeredTools(agentToken, toolMode string, toolPolicy *claude.ToolPolicy) []claude.Tool {
+	tools := claude.GetBrowserTools()
+	if toolMode == claude.ToolModeComputer {
+		width, height, _ := relay.GlobalHub.GetViewport(agentToken)
+		tools = claude.GetComputerTools(width, height)
+	}
+
+	tools = toolPolicy.FilterDisabledTools(tools)
+	if ac, ok := relay.GlobalHub.GetAgent(agentToken); ok {
+		tools = claude.FilterTools(tools, ac.HasCapability)
+	}
+	return tools
+}
+
+// currentTools returns the tools a chat with a user's agent would offer now
+func currentTools(userID int64, agentToken string) []claude.Tool {
+	return offeredTools(agentToken, effectiveToolMode(userID, agentToken), loadToolPolicy(agentToken))
+}
+
+// toolNames returns the names of tools
+func toolNames(tools []claude.Tool) []string {
+	names := make([]string, len(tools))
+	for i, t := range tools {
+		names[i] = t.Name
+	}
+	return names
+}
+
+// HandleToolMode shows (GET ?agent=<token>) and changes (PUT) which tools
+// the AI uses to drive an agent. An empty mode clears the setting.
+func HandleToolMode(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		agentToken := r.URL.Query().Get("agent")
+		agent, err := models.GetAgentByToken(agentToken)
+		if err != nil || agent.UserID != userID {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		sendJSON(w, ToolModeInfo{
+			Modes:     []string{claude.ToolModeBrowser, claude.ToolModeComputer},
+			Default:   claude.DefaultToolMode,
+			AgentMode: models.GetAgentToolMode(userID, agentToken),
+			Effective: effectiveToolMode(userID, agentToken),
+		})
+
+	case http.MethodPut:
+		var req struct {
+			AgentToken string `json:"agent_token"`
+			Mode       string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if req.Mode != "" && !claude.ValidToolMode(req.Mode) {
+			sendJSON(w, map[string]interface{}{"success": false, "error": "Unknown tool mode"})
+			return
+		}
+
+		updated, err := models.SetAgentToolMode(userID, req.AgentToken, req.Mode)
+		if err != nil || !updated {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
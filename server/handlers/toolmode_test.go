@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"testing"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+func TestComputerModeFallsBackWithoutAnthropic(t *testing.T) {
+	t.Setenv("LLM_PROVIDER", "")
+	userID, token := newTestUser(t)
+	if _, err := models.SetAgentToolMode(userID, token, claude.ToolModeComputer); err != nil {
+		t.Fatalf("set tool mode: %v", err)
+	}
+	relay.GlobalHub.RegisterAgent(token, nil, relay.ProtocolVersion, "test", []string{
+		relay.CapNavigate, relay.CapClickXY, relay.CapScreenshot, "computer_use",
+	})
+	defer relay.GlobalHub.UnregisterAgent(token)
+
+	tests := []struct {
+		provider string
+		want     string
+	}{
+		{claude.ProviderAnthropic, claude.ToolModeComputer},
+		{claude.ProviderOpenAI, claude.ToolModeBrowser},
+	}
+	for _, tt := range tests {
+		if _, err := models.SetAgentLLMProvider(userID, token, tt.provider); err != nil {
+			t.Fatalf("set provider: %v", err)
+		}
+		if got := effectiveToolMode(userID, token); got != tt.want {
+			t.Errorf("%s: tool mode = %s, want %s", tt.provider, got, tt.want)
+		}
+
+		// The OpenAI provider is never offered the computer tool
+		tools := currentTools(userID, token)
+		for _, tool := range tools {
+			if tool.Type != "" && tt.provider != claude.ProviderAnthropic {
+				t.Errorf("%s: offered %s", tt.provider, tool.Name)
+			}
+		}
+	}
+}
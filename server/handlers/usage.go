@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+	"weekend-chart/server/models"
+)
+
+type UsageReport struct {
+	Today   models.UsageTotals            `json:"today"`
+	Month   models.UsageTotals            `json:"month"`
+	Budget  models.Budget                 `json:"budget"`
+	ByModel map[string]models.UsageTotals `json:"by_model"`
+	ByAgent map[string]models.UsageTotals `json:"by_agent"`
+	Rates   []models.ModelRate            `json:"rates"`
+}
+
+// HandleUsage reports token usage and cost for this month (GET) and sets
+// the user's daily and monthly budgets in USD (PUT). Budgets cap spending
+// on the server's API key, so users can only lower their own limits;
+// raising one is up to the operator.
+func HandleUsage(w http.ResponseWriter, r *http.Request) {
+	userID := GetUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		monthStart := models.StartOfMonth(now)
+
+		var report UsageReport
+		var err error
+		if report.Today, err = models.GetUsageTotals(userID, models.StartOfDay(now)); err != nil {
+			http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+			return
+		}
+		if report.Month, err = models.GetUsageTotals(userID, monthStart); err != nil {
+			http.Error(w, "Failed to load usage", http.StatusInternalServerError)
+			return
+		}
+		report.Budget, _ = models.GetBudget(userID)
+		report.ByModel, _ = models.GetUsageByModel(userID, monthStart)
+		report.ByAgent, _ = models.GetUsageByAgent(userID, monthStart)
+		report.Rates, _ = models.GetModelRates()
+		sendJSON(w, report)
+
+	case http.MethodPut:
+		var budget models.Budget
+		if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if budget.DailyLimit < 0 || budget.MonthlyLimit < 0 {
+			sendJSON(w, map[string]interface{}{"success": false, "error": "Limits must not be negative"})
+			return
+		}
+		current, err := models.GetBudget(userID)
+		if err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		if raisesLimit(current.DailyLimit, budget.DailyLimit) || raisesLimit(current.MonthlyLimit, budget.MonthlyLimit) {
+			sendJSON(w, map[string]interface{}{"success": false, "error": "Limits can only be lowered"})
+			return
+		}
+		if err := models.SetBudget(userID, budget); err != nil {
+			sendJSON(w, map[string]bool{"success": false})
+			return
+		}
+		sendJSON(w, map[string]bool{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// raisesLimit reports whether changing a limit from current to next loosens
+// it. A limit of 0 means no limit.
+func raisesLimit(current, next float64) bool {
+	return current > 0 && (next == 0 || next > current)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"weekend-chart/server/models"
+)
+
+func TestHandleUsageOnlyLowersBudget(t *testing.T) {
+	userID, _ := newTestUser(t)
+	session := generateToken(16)
+	if err := models.CreateSession(userID, session); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	steps := []struct {
+		name string
+		body string
+		ok   bool
+		want models.Budget
+	}{
+		{"set from no limit", `{"daily_limit": 10, "monthly_limit": 100}`, true, models.Budget{DailyLimit: 10, MonthlyLimit: 100}},
+		{"lower daily", `{"daily_limit": 5, "monthly_limit": 100}`, true, models.Budget{DailyLimit: 5, MonthlyLimit: 100}},
+		{"raise daily", `{"daily_limit": 20, "monthly_limit": 100}`, false, models.Budget{DailyLimit: 5, MonthlyLimit: 100}},
+		{"remove daily", `{"daily_limit": 0, "monthly_limit": 100}`, false, models.Budget{DailyLimit: 5, MonthlyLimit: 100}},
+		{"remove monthly", `{"daily_limit": 5, "monthly_limit": 0}`, false, models.Budget{DailyLimit: 5, MonthlyLimit: 100}},
+		{"negative", `{"daily_limit": -1, "monthly_limit": 50}`, false, models.Budget{DailyLimit: 5, MonthlyLimit: 100}},
+		{"lower both", `{"daily_limit": 1, "monthly_limit": 50}`, true, models.Budget{DailyLimit: 1, MonthlyLimit: 50}},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(http.MethodPut, "/api/usage", strings.NewReader(step.body))
+		req.AddCookie(&http.Cookie{Name: "session", Value: session})
+		rec := httptest.NewRecorder()
+		HandleUsage(rec, req)
+
+		var resp struct {
+			Success bool `json:"success"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: response %q: %v", step.name, rec.Body.String(), err)
+		}
+		if resp.Success != step.ok {
+			t.Errorf("%s: success = %v, want %v", step.name, resp.Success, step.ok)
+		}
+		if got, _ := models.GetBudget(userID); got != step.want {
+			t.Errorf("%s: budget = %+v, want %+v", step.name, got, step.want)
+		}
+	}
+}
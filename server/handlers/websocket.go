@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 	"weekend-chart/server/claude"
+	"weekend-chart/server/metrics"
 	"weekend-chart/server/models"
 	"weekend-chart/server/relay"
 
@@ -28,6 +31,16 @@ type WSMessage struct {
 
 type AuthMessage struct {
 	Token string `json:"token"`
+
+	// Sent by agents speaking protocol version 1 or later
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	AgentVersion    string   `json:"agent_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+}
+
+type AuthOKMessage struct {
+	ProtocolVersion         int `json:"protocol_version"`
+	MinAgentProtocolVersion int `json:"min_agent_protocol_version"`
 }
 
 type PairingCodeMessage struct {
@@ -41,7 +54,8 @@ type ConnectAgentMessage struct {
 
 // Chat message types
 type ChatMessageData struct {
-	Message string `json:"message"`
+	Message        string `json:"message"`
+	ConversationID int64  `json:"conversation_id,omitempty"` // 0 continues the most recent thread
 }
 
 type ChatResponse struct {
@@ -64,10 +78,19 @@ type ScreenshotData struct {
 	Type   string `json:"type"`
 	Image  string `json:"image"`
 	URL    string `json:"url"`
+	Title  string `json:"title"`
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
 }
 
+// ActionsResultData is the agent's answer to run_actions, with a
+// screenshot taken after the last step that ran
+type ActionsResultData struct {
+	ScreenshotData
+	RequestID string                    `json:"request_id"`
+	Results   []claude.ActionStepResult `json:"results"`
+}
+
 // HandleAgentWS handles WebSocket connections from agents
 func HandleAgentWS(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -96,14 +119,53 @@ func HandleAgentWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Auth fields normally live in "data", but accept a flat message as well
+	authData := []byte(wsMsg.Data)
+	if len(authData) == 0 {
+		authData = msg
+	}
+
 	var authMsg AuthMessage
-	if err := json.Unmarshal(wsMsg.Data, &authMsg); err != nil || authMsg.Token == "" {
+	if err := json.Unmarshal(authData, &authMsg); err != nil || authMsg.Token == "" {
 		conn.Close()
 		return
 	}
 
 	// Register agent
-	ac := relay.GlobalHub.RegisterAgent(authMsg.Token, conn)
+	ac := relay.GlobalHub.RegisterAgent(authMsg.Token, conn, authMsg.ProtocolVersion, authMsg.AgentVersion, authMsg.Capabilities)
+
+	// The handshake is written before the write pump starts, so the agent
+	// has its URL policy and secrets before any queued command arrives
+	write := func(msg []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteMessage(websocket.TextMessage, msg)
+	}
+
+	// Tell the agent which protocol the server speaks (older agents ignore this)
+	resp, _ := json.Marshal(WSMessage{
+		Type: "auth_ok",
+		Data: mustMarshal(AuthOKMessage{
+			ProtocolVersion:         relay.ProtocolVersion,
+			MinAgentProtocolVersion: relay.MinAgentProtocolVersion,
+		}),
+	})
+	// The agent re-checks navigations it didn't get from the server
+	handshake := [][]byte{resp, setPolicyMessage(ac.Token)}
+	if msg := setSecretsMessage(ac); msg != nil {
+		handshake = append(handshake, msg)
+	}
+	for _, msg := range handshake {
+		if err := write(msg); err != nil {
+			relay.GlobalHub.UnregisterAgent(ac.Token)
+			conn.Close()
+			return
+		}
+	}
+
+	// Deliver anything queued while the agent was offline
+	if ac.UserID > 0 {
+		relay.GlobalHub.DeliverQueuedCommands(ac, write)
+	}
 
 	// Start read/write pumps
 	go agentWritePump(ac)
@@ -168,9 +230,15 @@ func agentWritePump(ac *relay.AgentConn) {
 func handleAgentMessage(ac *relay.AgentConn, wsMsg WSMessage, rawMsg []byte) {
 	switch wsMsg.Type {
 	case "request_pairing_code":
+		// Agents that support E2E offer their public key with the request
+		var pairingReq struct {
+			E2EPublicKey string `json:"e2e_public_key"`
+		}
+		json.Unmarshal(wsMsg.Data, &pairingReq)
+
 		// Generate and store pairing code
 		code := generatePairingCode()
-		if err := models.CreatePairingCode(code, ac.Token); err != nil {
+		if err := models.CreatePairingCode(code, ac.Token, pairingReq.E2EPublicKey); err != nil {
 			log.Printf("Failed to create pairing code: %v", err)
 			return
 		}
@@ -183,13 +251,19 @@ func handleAgentMessage(ac *relay.AgentConn, wsMsg WSMessage, rawMsg []byte) {
 				ExpiresIn: 300,
 			}),
 		})
-		ac.Send <- resp
+		relay.GlobalHub.SendToAgentConn(ac, resp)
 
 	case "screenshot":
 		// Cache the screenshot - agent sends flat structure, not nested in "data"
 		var screenshotData ScreenshotData
 		if err := json.Unmarshal(rawMsg, &screenshotData); err == nil && screenshotData.Image != "" {
-			relay.GlobalHub.UpdateScreenshotCache(ac.Token, screenshotData.Image)
+			relay.GlobalHub.UpdateScreenshotPage(ac.Token, screenshotData.Image, relay.ScreenshotPage{
+				URL:    screenshotData.URL,
+				Title:  screenshotData.Title,
+				Width:  screenshotData.Width,
+				Height: screenshotData.Height,
+			})
+			metrics.ScreenshotBytes.Observe(float64(len(screenshotData.Image)))
 			log.Printf("Screenshot cached for agent %s (size: %d)", ac.Token[:10], len(screenshotData.Image))
 		} else {
 			log.Printf("Failed to parse screenshot from agent %s: %v", ac.Token[:10], err)
@@ -201,6 +275,10 @@ func handleAgentMessage(ac *relay.AgentConn, wsMsg WSMessage, rawMsg []byte) {
 		// Forward to connected user
 		relay.GlobalHub.BroadcastToAgentUsers(ac.Token, rawMsg)
 
+	case "e2e":
+		// Encrypted for a user device; route on the envelope only
+		relay.GlobalHub.BroadcastToAgentUsers(ac.Token, rawMsg)
+
 	case "page_state":
 		// Cache the page state
 		var pageStateMsg struct {
@@ -211,6 +289,27 @@ func handleAgentMessage(ac *relay.AgentConn, wsMsg WSMessage, rawMsg []byte) {
 			relay.GlobalHub.UpdatePageStateCache(ac.Token, pageStateMsg.State)
 			log.Printf("Page state cached for agent %s", ac.Token[:10])
 		}
+
+	case "actions_result":
+		var result ActionsResultData
+		if err := json.Unmarshal(rawMsg, &result); err != nil {
+			log.Printf("Failed to parse actions result from agent: %v", err)
+			return
+		}
+		if result.Image != "" {
+			relay.GlobalHub.UpdateScreenshotPage(ac.Token, result.Image, relay.ScreenshotPage{
+				URL:    result.URL,
+				Title:  result.Title,
+				Width:  result.Width,
+				Height: result.Height,
+			})
+		}
+		if !relay.GlobalHub.DeliverActionsResult(ac.Token, result.RequestID, rawMsg) {
+			log.Printf("Dropped actions result for unknown request %q", result.RequestID)
+		}
+
+	case "policy_violation":
+		handlePolicyViolation(ac, rawMsg)
 	}
 }
 
@@ -309,25 +408,109 @@ func handleUserMessage(uc *relay.UserConn, wsMsg WSMessage, rawMsg []byte) {
 		relay.GlobalHub.SetUserViewingAgent(uc.UserID, cam.AgentToken)
 
 		// Check if agent is online
-		online := relay.GlobalHub.IsAgentOnline(cam.AgentToken)
-		resp, _ := json.Marshal(map[string]interface{}{
+		status := map[string]interface{}{
 			"type":   "agent_status",
-			"online": online,
-		})
-		uc.Send <- resp
+			"online": false,
+		}
+		if agent.E2EEnabled {
+			status["e2e"] = true
+			status["agent_public_key"] = agent.E2EPublicKey
+		}
+		if ac, online := relay.GlobalHub.GetAgent(cam.AgentToken); online {
+			status["online"] = true
+			status["protocol_version"] = ac.ProtocolVersion
+			status["agent_version"] = ac.AgentVersion
+			if ac.IsOutdated() {
+				status["outdated"] = true
+				status["warning"] = outdatedAgentWarning
+			}
+		}
+		resp, _ := json.Marshal(status)
+		safeSend(uc.Send, resp)
 
-	case "navigate", "click", "click_xy", "input", "key", "scroll", "request_screenshot":
+	case "navigate", "click", "click_xy", "input", "key", "scroll", "request_screenshot", "e2e":
 		// Forward to agent
 		agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
 		if agentToken == "" {
 			log.Printf("User %d: No agent selected", uc.UserID)
 			return
 		}
+		ac, online := relay.GlobalHub.GetAgent(agentToken)
+		if !online {
+			// Queue the command until the agent reconnects
+			if wsMsg.Type != "request_screenshot" {
+				queueCommand(uc, agentToken, wsMsg.Type, rawMsg)
+			}
+			return
+		}
+		if !ac.HasCapability(wsMsg.Type) {
+			sendError(uc, "Agent 版本過舊，不支援此操作: "+wsMsg.Type)
+			return
+		}
 		log.Printf("User %d -> Agent %s: %s", uc.UserID, agentToken[:10], wsMsg.Type)
 		if !relay.GlobalHub.SendToAgent(agentToken, rawMsg) {
 			log.Printf("Failed to send to agent %s", agentToken[:10])
 		}
 
+	case "e2e_register_device":
+		// A new device of the user wants to join an E2E agent
+		var req struct {
+			DeviceID  string `json:"device_id"`
+			PublicKey string `json:"public_key"`
+		}
+		if err := json.Unmarshal(wsMsg.Data, &req); err != nil || req.DeviceID == "" || req.PublicKey == "" {
+			sendError(uc, "Invalid device registration")
+			return
+		}
+
+		agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
+		agent, err := models.GetAgentByToken(agentToken)
+		if err != nil || agent.UserID != uc.UserID || !agent.E2EEnabled {
+			sendError(uc, "Agent 未啟用端對端加密")
+			return
+		}
+
+		addDeviceMsg, _ := json.Marshal(map[string]string{
+			"type":              "e2e_add_device",
+			"device_id":         req.DeviceID,
+			"device_public_key": req.PublicKey,
+		})
+		// Devices register on every connect until the agent's user confirms
+		// them, so nothing is queued while the agent is offline
+		relay.GlobalHub.SendToAgent(agentToken, addDeviceMsg)
+
+	case "list_queued_commands":
+		agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
+		if agentToken == "" {
+			sendError(uc, "請先選擇一個 Agent")
+			return
+		}
+		commands, err := models.GetUserCommands(uc.UserID, agentToken)
+		if err != nil {
+			sendError(uc, "無法取得排程指令")
+			return
+		}
+		resp, _ := json.Marshal(map[string]interface{}{
+			"type":     "queued_commands",
+			"commands": toQueuedCommandInfos(commands),
+		})
+		safeSend(uc.Send, resp)
+
+	case "cancel_queued_command":
+		var req struct {
+			ID int64 `json:"id"`
+		}
+		if err := json.Unmarshal(wsMsg.Data, &req); err != nil {
+			sendError(uc, "Invalid cancel request")
+			return
+		}
+		cancelled, err := models.CancelCommand(uc.UserID, req.ID)
+		if err != nil || !cancelled {
+			sendError(uc, "指令無法取消（可能已送出或已過期）")
+			return
+		}
+		safeSend(uc.Send, relay.CommandStatusMessage(req.ID, "", models.CommandCancelled))
+
 	case "chat_message":
 		// Handle chat message with Claude
 		var chatData ChatMessageData
@@ -347,17 +530,61 @@ func handleUserMessage(uc *relay.UserConn, wsMsg WSMessage, rawMsg []byte) {
 			return
 		}
 
-		// Process chat message in a goroutine to avoid blocking
-		go handleChatMessage(uc, agentToken, chatData.Message)
+		// The server can't see an E2E agent's screen, so the AI can't either
+		if agent, err := models.GetAgentByToken(agentToken); err == nil && agent.E2EEnabled {
+			sendChatError(uc, "此 Agent 已啟用端對端加密，AI 助手已停用")
+			return
+		}
+
+		if isShuttingDown() {
+			sendChatError(uc, "伺服器即將重新啟動，請稍後再試")
+			return
+		}
+
+		var conv *claude.Conversation
+		if chatData.ConversationID != 0 {
+			var err error
+			conv, err = claude.GlobalConversationManager.Get(uc.UserID, agentToken, chatData.ConversationID)
+			if err != nil {
+				sendChatError(uc, "找不到此對話")
+				return
+			}
+		} else {
+			conv = claude.GlobalConversationManager.GetOrCreate(uc.UserID, agentToken)
+		}
+
+		ctx, finish, ok := startChatTask(uc.UserID, agentToken)
+		if !ok {
+			sendChatError(uc, "AI 仍在執行上一個任務，請等待完成或先取消")
+			return
+		}
 
-	case "clear_conversation":
-		// Clear conversation history
+		// Process chat message in a goroutine to avoid blocking
+		if !startChatLoop() {
+			finish()
+			sendChatError(uc, "伺服器即將重新啟動，請稍後再試")
+			return
+		}
+		go func() {
+			defer chatLoops.Done()
+			defer finish()
+			handleChatMessage(ctx, uc, agentToken, conv, chatData.Message)
+		}()
+
+	case "cancel_chat":
+		// Stop the running AI task; it finishes its cleanup in the background
 		agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
-		if agentToken != "" {
-			claude.GlobalConversationManager.Delete(uc.UserID, agentToken)
-			sendChatResponse(uc, "system", "對話已清除", "", nil)
+		if agentToken == "" || !cancelChatTask(uc.UserID, agentToken) {
+			sendChatStatus(uc, models.TaskCancelled)
 		}
 
+	case "approval_response":
+		answerApproval(uc, wsMsg.Data)
+
+	case "list_conversations", "new_conversation", "clear_conversation", "load_conversation",
+		"rename_conversation", "archive_conversation":
+		handleConversationMessage(uc, wsMsg.Type, wsMsg.Data)
+
 	case "direct_action":
 		// Handle direct action from UI (e.g., click on screenshot)
 		agentToken := relay.GlobalHub.GetUserViewingAgent(uc.UserID)
@@ -371,6 +598,11 @@ func handleUserMessage(uc *relay.UserConn, wsMsg WSMessage, rawMsg []byte) {
 			return
 		}
 
+		if agent, err := models.GetAgentByToken(agentToken); err == nil && agent.E2EEnabled {
+			sendActionResult(uc, false, "", "此 Agent 已啟用端對端加密，請使用加密通道")
+			return
+		}
+
 		var actionData struct {
 			Action string `json:"action"`
 			X      int    `json:"x"`
@@ -381,6 +613,11 @@ func handleUserMessage(uc *relay.UserConn, wsMsg WSMessage, rawMsg []byte) {
 			return
 		}
 
+		if ac, ok := relay.GlobalHub.GetAgent(agentToken); ok && !ac.HasCapability(actionData.Action) {
+			sendActionResult(uc, false, "", "Agent 版本過舊，不支援此操作")
+			return
+		}
+
 		// Build and send action to agent
 		actionMsg, _ := json.Marshal(map[string]interface{}{
 			"type": actionData.Action,
@@ -398,6 +635,13 @@ func handleUserMessage(uc *relay.UserConn, wsMsg WSMessage, rawMsg []byte) {
 	}
 }
 
+// outdatedAgentWarning is shown to users whose agent speaks an old protocol
+const outdatedAgentWarning = "Agent 版本過舊，部分功能無法使用，請下載最新版本"
+
+// computerModeUnavailable is shown when an agent set to computer mode is
+// driven with the browser tools instead
+const computerModeUnavailable = "電腦操作模式需要 Anthropic 模型與最新版 Agent，本次改用瀏覽器工具"
+
 func sendError(uc *relay.UserConn, msg string) {
 	resp, _ := json.Marshal(map[string]string{
 		"type":  "error",
@@ -444,6 +688,26 @@ func sendChatResponse(uc *relay.UserConn, role, content, screenshot string, acti
 	safeSend(uc.Send, resp)
 }
 
+// sendChatDelta sends a piece of streamed assistant text
+func sendChatDelta(uc *relay.UserConn, delta string) {
+	resp, _ := json.Marshal(ChatResponse{
+		Type:    "chat_delta",
+		Role:    "assistant",
+		Content: delta,
+	})
+	safeSend(uc.Send, resp)
+}
+
+// sendChatReasoning sends the model's extended thinking, shown collapsed
+func sendChatReasoning(uc *relay.UserConn, reasoning string) {
+	resp, _ := json.Marshal(ChatResponse{
+		Type:    "chat_reasoning",
+		Role:    "assistant",
+		Content: reasoning,
+	})
+	safeSend(uc.Send, resp)
+}
+
 func sendChatError(uc *relay.UserConn, message string) {
 	resp, _ := json.Marshal(ChatResponse{
 		Type:    "chat_response",
@@ -458,12 +722,14 @@ func sendChatError(uc *relay.UserConn, message string) {
 func safeSend(ch chan []byte, data []byte) {
 	defer func() {
 		if r := recover(); r != nil {
+			metrics.DroppedMessages.Inc("user")
 			log.Printf("Channel send failed (connection closed): %v", r)
 		}
 	}()
 	select {
 	case ch <- data:
 	default:
+		metrics.DroppedMessages.Inc("user")
 		log.Printf("Channel full or closed, dropping message")
 	}
 }
@@ -472,25 +738,26 @@ func safeSend(ch chan []byte, data []byte) {
 type AgentProxy struct {
 	agentToken string
 	userConn   *relay.UserConn
+	task       *chatTask // Set while the proxy runs a chat task
 }
 
-func (ap *AgentProxy) RequestScreenshot() (string, error) {
-	return relay.GlobalHub.RequestScreenshotSync(ap.agentToken, 15*time.Second)
+func (ap *AgentProxy) RequestScreenshot(ctx context.Context) (string, error) {
+	return relay.GlobalHub.RequestScreenshotSync(ctx, ap.agentToken, 15*time.Second)
 }
 
-func (ap *AgentProxy) RequestPageState() (string, error) {
-	data, err := relay.GlobalHub.RequestPageStateSync(ap.agentToken, 10*time.Second)
+func (ap *AgentProxy) RequestPageState(ctx context.Context) (string, error) {
+	data, err := relay.GlobalHub.RequestPageStateSync(ctx, ap.agentToken, 10*time.Second)
 	if err != nil {
 		return "", err
 	}
 	return string(data), nil
 }
 
-func (ap *AgentProxy) SendAction(action claude.BrowserAction) error {
-	return ap.sendActionWithRetry(action, 3) // Max 3 attempts
+func (ap *AgentProxy) SendAction(ctx context.Context, action claude.BrowserAction) error {
+	return ap.sendActionWithRetry(ctx, action, 3) // Max 3 attempts
 }
 
-func (ap *AgentProxy) sendActionWithRetry(action claude.BrowserAction, maxAttempts int) error {
+func (ap *AgentProxy) sendActionWithRetry(ctx context.Context, action claude.BrowserAction, maxAttempts int) error {
 	// Build message in the format agent expects (flat structure)
 	var msg []byte
 	var err error
@@ -503,9 +770,25 @@ func (ap *AgentProxy) sendActionWithRetry(action claude.BrowserAction, maxAttemp
 		})
 	case "click_xy":
 		msg, err = json.Marshal(map[string]interface{}{
-			"type": "click_xy",
+			"type":        "click_xy",
+			"x":           action.X,
+			"y":           action.Y,
+			"button":      action.Button,
+			"click_count": action.ClickCount,
+		})
+	case "mouse_move":
+		msg, err = json.Marshal(map[string]interface{}{
+			"type": "mouse_move",
+			"x":    action.X,
+			"y":    action.Y,
+		})
+	case "drag":
+		msg, err = json.Marshal(map[string]interface{}{
+			"type": "drag",
 			"x":    action.X,
 			"y":    action.Y,
+			"to_x": action.ToX,
+			"to_y": action.ToY,
 		})
 	case "input":
 		msg, err = json.Marshal(map[string]interface{}{
@@ -523,6 +806,13 @@ func (ap *AgentProxy) sendActionWithRetry(action claude.BrowserAction, maxAttemp
 			"direction": action.Direction,
 			"amount":    action.Amount,
 		})
+	case "select_option":
+		msg, err = json.Marshal(map[string]interface{}{
+			"type":         "select_option",
+			"selector":     action.Selector,
+			"option_value": action.OptionValue,
+			"option_text":  action.OptionText,
+		})
 	default:
 		msg, err = json.Marshal(map[string]interface{}{
 			"type": action.Type,
@@ -535,7 +825,7 @@ func (ap *AgentProxy) sendActionWithRetry(action claude.BrowserAction, maxAttemp
 
 	// For input actions, use retry with verification
 	if action.Type == "input" && action.Value != "" {
-		return ap.sendInputWithVerification(msg, action.Value, maxAttempts)
+		return ap.sendInputWithVerification(ctx, msg, action.Value, maxAttempts)
 	}
 
 	// For other actions, just send and wait
@@ -544,27 +834,52 @@ func (ap *AgentProxy) sendActionWithRetry(action claude.BrowserAction, maxAttemp
 	}
 
 	// Wait for the action to complete
-	time.Sleep(800 * time.Millisecond)
-	return nil
+	return sleepCtx(ctx, 800*time.Millisecond)
+}
+
+// RunActions sends a batch of steps in one message and waits until the
+// agent has run them
+func (ap *AgentProxy) RunActions(ctx context.Context, actions []claude.BrowserAction) (*claude.ActionsResult, error) {
+	timeout := 15 * time.Second
+	for _, action := range actions {
+		timeout += 2*time.Second + time.Duration(action.WaitMs)*time.Millisecond
+	}
+
+	data, err := relay.GlobalHub.RunActionsSync(ctx, ap.agentToken, actions, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var result ActionsResultData
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid actions result: %w", err)
+	}
+	return &claude.ActionsResult{Steps: result.Results, Screenshot: result.Image}, nil
 }
 
 // sendInputWithVerification sends input and verifies it was received correctly
-func (ap *AgentProxy) sendInputWithVerification(msg []byte, expectedValue string, maxAttempts int) error {
+func (ap *AgentProxy) sendInputWithVerification(ctx context.Context, msg []byte, expectedValue string, maxAttempts int) error {
 	// Send input only ONCE
 	if !relay.GlobalHub.SendToAgent(ap.agentToken, msg) {
 		return errAgentNotConnected
 	}
 
 	// Wait for input to be processed
-	time.Sleep(600 * time.Millisecond)
+	if err := sleepCtx(ctx, 600*time.Millisecond); err != nil {
+		return err
+	}
 
 	// Verify the input (retry verification only, not the send)
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		pageStateData, err := relay.GlobalHub.RequestPageStateSync(ap.agentToken, 5*time.Second)
+		pageStateData, err := relay.GlobalHub.RequestPageStateSync(ctx, ap.agentToken, 5*time.Second)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			log.Printf("Failed to get page state for verification (attempt %d): %v", attempt, err)
 			if attempt < maxAttempts {
-				time.Sleep(500 * time.Millisecond)
+				if err := sleepCtx(ctx, 500*time.Millisecond); err != nil {
+					return err
+				}
 				continue
 			}
 			return nil // Don't fail, just proceed
@@ -609,7 +924,9 @@ func (ap *AgentProxy) sendInputWithVerification(msg []byte, expectedValue string
 
 		log.Printf("Input verification check %d: value not found yet, expected: %s", attempt, expectedValue)
 		if attempt < maxAttempts {
-			time.Sleep(500 * time.Millisecond)
+			if err := sleepCtx(ctx, 500*time.Millisecond); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -617,6 +934,26 @@ func (ap *AgentProxy) sendInputWithVerification(msg []byte, expectedValue string
 	return nil // Don't fail the action, let the AI see the result and decide
 }
 
+// sleepCtx waits for d, returning early with the context's error if it is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// toolExecution is the outcome of executing one model turn's tool calls
+type toolExecution struct {
+	results     []claude.ToolResult
+	actionDescs []string
+	screenshot  string
+	err         error
+}
+
 var errAgentNotConnected = &agentError{"agent not connected"}
 
 type agentError struct {
@@ -627,18 +964,39 @@ func (e *agentError) Error() string {
 	return e.msg
 }
 
-func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
-	log.Printf("Chat message from user %d: %s", uc.UserID, message)
+// handleChatMessage runs the AI loop for one user message until the model
+// stops calling tools or ctx is cancelled
+func handleChatMessage(ctx context.Context, uc *relay.UserConn, agentToken string, conv *claude.Conversation, message string) {
+	// Passwords the user typed into chat are stored secrets; keep them out
+	// of the log, the history and the model's context
+	_, redactor := loadSecrets(uc.UserID, agentToken)
+	message = redactor.Redact(message)
+	log.Printf("Chat message from user %d (conversation %s): %s", uc.UserID, conv.ID, message)
+
+	// Name new threads after their first message
+	if conv.GetTitle() == "" {
+		if err := conv.SetTitle(conversationTitle(message)); err != nil {
+			log.Printf("Failed to name conversation %s: %v", conv.ID, err)
+		}
+	}
+
+	task := newChatTask(uc, agentToken, conv.DBID, message)
+	status, reason := models.TaskSucceeded, ""
+	defer func() { task.finish(status, reason) }()
 
-	// Get or create conversation
-	conv := claude.GlobalConversationManager.GetOrCreate(uc.UserID, agentToken)
+	// The wall-clock budget covers the whole task, including tool calls
+	if task.budget.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, task.budget.MaxDuration)
+		defer cancel()
+	}
 
 	// Get current screenshot
 	screenshot, _, hasScreenshot := relay.GlobalHub.GetCachedScreenshot(agentToken)
 	if !hasScreenshot {
 		// Try to request a fresh screenshot
 		var err error
-		screenshot, err = relay.GlobalHub.RequestScreenshotSync(agentToken, 5*time.Second)
+		screenshot, err = relay.GlobalHub.RequestScreenshotSync(ctx, agentToken, 5*time.Second)
 		if err != nil {
 			log.Printf("Failed to get screenshot: %v", err)
 		}
@@ -647,7 +1005,8 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 	// Create user message with screenshot
 	var userMsg claude.ConversationMessage
 	if screenshot != "" {
-		userMsg = claude.CreateImageMessage("user", message, screenshot)
+		page, _ := relay.GlobalHub.GetScreenshotPage(agentToken, screenshot)
+		userMsg = claude.CreateScreenshotMessage("user", message, screenshot, page.URL, page.Title)
 	} else {
 		userMsg = claude.CreateTextMessage("user", message)
 	}
@@ -658,38 +1017,152 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 		sendChatResponse(uc, "system", "", screenshot, nil)
 	}
 
-	// Create OpenAI client and call API
-	client := claude.NewClient()
-	tools := claude.GetBrowserTools()
+	// Use the LLM provider configured for this user and agent
+	provider, err := claude.NewProvider(models.GetLLMProvider(uc.UserID, agentToken))
+	if err != nil {
+		log.Printf("LLM provider error for user %d: %v", uc.UserID, err)
+		sendChatError(uc, "AI 服務設定錯誤: "+err.Error())
+		status, reason = models.TaskFailed, err.Error()
+		return
+	}
+	toolMode := effectiveToolMode(uc.UserID, agentToken)
+	if toolMode != claude.ToolModeComputer && models.GetAgentToolMode(uc.UserID, agentToken) == claude.ToolModeComputer {
+		sendChatResponse(uc, "system", computerModeUnavailable, "", nil)
+	}
+	if ac, ok := relay.GlobalHub.GetAgent(agentToken); ok && ac.IsOutdated() {
+		sendChatResponse(uc, "system", outdatedAgentWarning, "", nil)
+	}
+
+	// The agent's policy can take tools away and limit what the rest may
+	// do, and only tools the agent is able to execute are offered
+	toolPolicy := loadToolPolicy(agentToken)
+	tools := offeredTools(agentToken, toolMode, toolPolicy)
 
 	// Create agent proxy for tool execution
 	agentProxy := &AgentProxy{
 		agentToken: agentToken,
 		userConn:   uc,
+		task:       task,
 	}
 	toolExecutor := claude.NewToolExecutor(agentProxy)
-
-	// Limit conversation history to last 20 messages to avoid context overflow
-	if conv.MessageCount() > 20 {
-		conv.TrimToLastN(20)
+	toolExecutor.RequireApproval(claude.ApprovalPolicyFromEnv(), agentProxy)
+	toolExecutor.SetToolPolicy(toolPolicy)
+	if ac, ok := relay.GlobalHub.GetAgent(agentToken); ok && ac.HasCapability("secrets") {
+		names, _ := models.GetSecretNames(uc.UserID, agentToken)
+		toolExecutor.SetSecretNames(names)
 	}
 
+	// Rendered once per task so the prompt stays cacheable between steps
+	systemPrompt := buildSystemPrompt(uc.UserID, agentToken, tools)
+	contextBudget := claude.ContextTokenBudget()
+	keepScreenshots := claude.KeepScreenshots()
+
 	// Loop until no more tool calls
-	maxIterations := 10
-	for i := 0; i < maxIterations; i++ {
+	for {
+		if ctx.Err() != nil {
+			status, reason = task.stopped(ctx)
+			break
+		}
+
+		// Stop between steps when the server is shutting down; the
+		// conversation only holds complete steps, so it can be resumed later
+		if isShuttingDown() {
+			sendChatError(uc, "伺服器即將重新啟動，任務已暫停，請稍後繼續")
+			status, reason = models.TaskCancelled, "server shutting down"
+			break
+		}
+
+		// Stop once the task has used up its steps or tokens
+		if exceeded := task.checkBudget(); exceeded != "" {
+			sendChatError(uc, exceeded+"，AI 任務已停止")
+			status, reason = models.TaskBudgetExceeded, exceeded
+			break
+		}
+
+		// Stop before spending more than the user allows
+		if exceeded, budgetReason, err := models.CheckBudget(uc.UserID); err != nil {
+			log.Printf("Failed to check budget for user %d: %v", uc.UserID, err)
+		} else if exceeded {
+			sendChatError(uc, budgetReason+"，AI 任務已停止")
+			status, reason = models.TaskBudgetExceeded, budgetReason
+			break
+		}
+
+		// Only the latest screenshots are sent; older ones become placeholders
+		prunedImages := conv.PruneScreenshots(keepScreenshots)
+		if prunedImages > 0 {
+			metrics.PrunedScreenshots.Add(float64(prunedImages))
+		}
+
+		compactConversation(ctx, uc, agentToken, conv, provider, contextBudget)
+
 		messages := conv.GetMessages()
 
 		// Validate and clean messages to ensure tool_use/tool_result pairs are intact
 		messages = claude.ValidateAndClean(messages)
 
-		resp, err := client.Chat(messages, tools)
+		// Execute tool calls as soon as each block has been streamed
+		toolCalls := make(chan claude.ToolCall, 16)
+		execDone := make(chan toolExecution, 1)
+		go func() {
+			var exec toolExecution
+			exec.results, exec.actionDescs, exec.screenshot, exec.err = toolExecutor.ExecuteToolCallStream(ctx, toolCalls)
+			execDone <- exec
+		}()
+
+		// What has streamed so far, kept in case the stream fails later
+		var streamedText strings.Builder
+		var streamedCalls []claude.ToolCall
+
+		resp, err := claude.StreamChat(ctx, provider, systemPrompt, messages, tools, claude.StreamHandler{
+			OnText: func(delta string) {
+				streamedText.WriteString(delta)
+				sendChatDelta(uc, delta)
+			},
+			OnToolCall: func(tc claude.ToolCall) {
+				streamedCalls = append(streamedCalls, tc)
+				toolCalls <- tc
+			},
+			OnRetry: func(info claude.RetryInfo) {
+				log.Printf("%s API busy (attempt %d/%d), retrying in %v: %v", provider.Name(), info.Attempt, info.MaxAttempts, info.Wait, info.Err)
+				sendChatResponse(uc, "system", fmt.Sprintf("AI 服務暫時忙碌，%d 秒後重試（%d/%d）",
+					int(info.Wait.Round(time.Second)/time.Second), info.Attempt, info.MaxAttempts-1), "", nil)
+			},
+		})
+		close(toolCalls)
+		exec := <-execDone
+
 		if err != nil {
-			log.Printf("OpenAI API error: %v", err)
-			sendChatError(uc, "AI 服務發生錯誤: "+err.Error())
+			// Tool calls that streamed before the failure have run in the
+			// browser, so they are kept with their results. Anything else
+			// of the partial response is dropped, and the conversation
+			// still ends on a complete step.
+			if len(streamedCalls) > 0 {
+				conv.AddMessage(claude.CreateAssistantToolUseMessage(streamedText.String(), streamedCalls))
+				conv.AddMessage(claude.CreateToolResultMessage(cancelledToolResults(streamedCalls, exec.results)))
+			}
+			if ctx.Err() != nil {
+				status, reason = task.stopped(ctx)
+				break
+			}
+			log.Printf("%s API error: %v", provider.Name(), err)
+			if claude.IsRetryable(err) {
+				sendChatError(uc, "AI 服務目前忙碌，重試後仍然失敗，請稍後再試: "+err.Error())
+			} else {
+				sendChatError(uc, "AI 服務發生錯誤: "+err.Error())
+			}
+			status, reason = models.TaskFailed, err.Error()
 			return
 		}
 
-		// Send text response to user
+		recordUsage(uc.UserID, agentToken, conv, provider, resp, prunedImages)
+		task.addStep(resp)
+
+		if reasoning := resp.ThinkingText(); reasoning != "" {
+			sendChatReasoning(uc, reasoning)
+		}
+
+		// Send the complete text so the UI can finalize the streamed message
 		if resp.TextContent != "" {
 			sendChatResponse(uc, "assistant", resp.TextContent, "", nil)
 		}
@@ -698,19 +1171,26 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 		if len(resp.ToolCalls) == 0 {
 			// No more tool calls, add assistant response and exit
 			if resp.TextContent != "" {
-				conv.AddMessage(claude.CreateTextMessage("assistant", resp.TextContent))
+				conv.AddMessage(claude.CreateAssistantMessage(resp))
 			}
 			break
 		}
 
 		// Add assistant message with tool calls to conversation
-		conv.AddMessage(claude.CreateAssistantToolUseMessage(resp.TextContent, resp.ToolCalls))
+		conv.AddMessage(claude.CreateAssistantMessage(resp))
 
-		// Execute tool calls
-		results, actionDescs, newScreenshot, err := toolExecutor.ExecuteToolCalls(resp.ToolCalls)
-		if err != nil {
-			log.Printf("Tool execution error: %v", err)
-			sendChatError(uc, "工具執行失敗: "+err.Error())
+		results, actionDescs, newScreenshot := exec.results, exec.actionDescs, exec.screenshot
+		if ctx.Err() != nil {
+			// Answer every tool_use so the conversation stays valid
+			conv.AddMessage(claude.CreateToolResultMessage(cancelledToolResults(resp.ToolCalls, results)))
+			status, reason = task.stopped(ctx)
+			break
+		}
+		if exec.err != nil {
+			conv.AddMessage(claude.CreateToolResultMessage(cancelledToolResults(resp.ToolCalls, results)))
+			log.Printf("Tool execution error: %v", exec.err)
+			sendChatError(uc, "工具執行失敗: "+exec.err.Error())
+			status, reason = models.TaskFailed, exec.err.Error()
 			return
 		}
 
@@ -742,7 +1222,7 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 		// If we executed actions, request a new screenshot to see the result
 		hasNonScreenshotAction := false
 		for _, tc := range resp.ToolCalls {
-			if tc.Name != "take_screenshot" {
+			if !claude.ReturnsScreenshot(tc) {
 				hasNonScreenshotAction = true
 				break
 			}
@@ -751,10 +1231,12 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 		// Get screenshot after actions and include it in the conversation for the model to see
 		var screenshotForClaude string
 		if hasNonScreenshotAction {
-			time.Sleep(1000 * time.Millisecond) // Wait longer for action to complete visually
-			screenshotForClaude, _ = agentProxy.RequestScreenshot()
+			// Wait longer for action to complete visually
+			if sleepCtx(ctx, 1000*time.Millisecond) == nil {
+				screenshotForClaude, _ = agentProxy.RequestScreenshot(ctx)
+			}
 		} else if newScreenshot != "" {
-			// Use the screenshot from take_screenshot tool
+			// Use the screenshot returned by take_screenshot or run_actions
 			screenshotForClaude = newScreenshot
 		}
 
@@ -762,9 +1244,83 @@ func handleChatMessage(uc *relay.UserConn, agentToken, message string) {
 			sendChatResponse(uc, "system", "", screenshotForClaude, nil)
 			relay.GlobalHub.UpdateScreenshotCache(agentToken, screenshotForClaude)
 			// Add screenshot to conversation so Claude can see the result
-			conv.AddMessage(claude.CreateImageMessage("user", "這是執行操作後的截圖", screenshotForClaude))
+			page, _ := relay.GlobalHub.GetScreenshotPage(agentToken, screenshotForClaude)
+			conv.AddMessage(claude.CreateScreenshotMessage("user", afterActionCaption, screenshotForClaude, page.URL, page.Title))
+		}
+	}
+
+	log.Printf("Chat task %s for user %d", status, uc.UserID)
+}
+
+// compactConversation summarizes older turns once the conversation outgrows
+// the context budget. If summarizing fails, the oldest messages are dropped
+// instead so the request still fits.
+func compactConversation(ctx context.Context, uc *relay.UserConn, agentToken string, conv *claude.Conversation, provider claude.Provider, budget int) {
+	resp, err := conv.Compact(ctx, provider, budget)
+	if resp != nil {
+		recordUsage(uc.UserID, agentToken, conv, provider, resp, 0)
+	}
+	if err != nil {
+		log.Printf("Conversation %s compaction failed, trimming instead: %v", conv.ID, err)
+		if conv.MessageCount() > 20 {
+			conv.TrimToLastN(20)
 		}
+		return
+	}
+	if resp != nil {
+		log.Printf("Conversation %s compacted (%d messages remain)", conv.ID, conv.MessageCount())
+		sendChatResponse(uc, "system", "對話內容較長，已將較早的步驟整理成摘要", "", nil)
+	}
+}
+
+// recordUsage stores the token usage of one model response and how many
+// screenshots were pruned from the context before it
+func recordUsage(userID int64, agentToken string, conv *claude.Conversation, provider claude.Provider, resp *claude.ChatResponse, prunedImages int) {
+	model := resp.Model
+	if model == "" {
+		model = provider.Name()
+	}
+	_, err := models.RecordUsage(models.UsageRecord{
+		UserID:         userID,
+		AgentToken:     agentToken,
+		ConversationID: conv.DBID,
+		Provider:       provider.Name(),
+		Model:          model,
+		InputTokens:    resp.Usage.InputTokens,
+		OutputTokens:   resp.Usage.OutputTokens,
+		CacheRead:      resp.Usage.CacheReadInputTokens,
+		CacheCreation:  resp.Usage.CacheCreationInputTokens,
+		PrunedImages:   prunedImages,
+	})
+	if err != nil {
+		log.Printf("Failed to record usage for user %d: %v", userID, err)
+	}
+}
+
+// afterActionCaption is the text of the screenshot message added after each step
+const afterActionCaption = "這是執行操作後的截圖"
+
+// conversationTitle derives a thread title from its first message
+func conversationTitle(message string) string {
+	const maxLen = 30
+	runes := []rune(strings.TrimSpace(message))
+	if len(runes) > maxLen {
+		return string(runes[:maxLen]) + "…"
 	}
+	return string(runes)
+}
 
-	log.Printf("Chat completed for user %d", uc.UserID)
+// cancelledToolResults returns the results of a cancelled step, filling in
+// an error result for every tool call that didn't get one
+func cancelledToolResults(toolCalls []claude.ToolCall, results []claude.ToolResult) []claude.ToolResult {
+	answered := make(map[string]bool, len(results))
+	for _, r := range results {
+		answered[r.ToolUseID] = true
+	}
+	for _, tc := range toolCalls {
+		if !answered[tc.ID] {
+			results = append(results, claude.CancelledToolResult(tc.ID))
+		}
+	}
+	return results
 }
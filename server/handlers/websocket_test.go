@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"weekend-chart/server/claude"
+	"weekend-chart/server/claude/claudetest"
+	"weekend-chart/server/models"
+	"weekend-chart/server/relay"
+)
+
+// wsServer serves the agent and user websockets like main does
+func wsServer(t *testing.T) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws/agent", HandleAgentWS)
+	mux.HandleFunc("/ws/user", HandleUserWS)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// dialAgent connects a fake agent over the websocket. It answers screenshot
+// and page state requests and passes the other commands to commands.
+func dialAgent(t *testing.T, url, token string, commands chan<- map[string]interface{}) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/agent", nil)
+	if err != nil {
+		t.Fatalf("dial agent: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	auth, _ := json.Marshal(map[string]interface{}{
+		"type": "auth",
+		"data": AuthMessage{
+			Token:           token,
+			ProtocolVersion: relay.ProtocolVersion,
+			AgentVersion:    "test",
+			Capabilities: []string{
+				relay.CapNavigate, relay.CapClick, relay.CapClickXY, relay.CapInput,
+				relay.CapKey, relay.CapScroll, relay.CapScreenshot,
+			},
+		},
+	})
+	if err := conn.WriteMessage(websocket.TextMessage, auth); err != nil {
+		t.Fatalf("send auth: %v", err)
+	}
+	var ok WSMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&ok); err != nil || ok.Type != "auth_ok" {
+		t.Fatalf("auth: got %+v, %v", ok, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go func() {
+		for {
+			var m map[string]interface{}
+			if err := conn.ReadJSON(&m); err != nil {
+				return
+			}
+			switch m["type"] {
+			case "request_screenshot":
+				conn.WriteJSON(ScreenshotData{
+					Type: "screenshot", Image: testImage,
+					URL: "https://example.com/", Title: "Example", Width: 1280, Height: 800,
+				})
+			case "get_page_state":
+				conn.WriteMessage(websocket.TextMessage,
+					[]byte(`{"type":"page_state","state":{"url":"https://example.com/","inputs":[],"buttons":[]}}`))
+			case "set_policy", "set_secrets":
+			default:
+				commands <- m
+			}
+		}
+	}()
+}
+
+// dialUser connects as the user with a new session
+func dialUser(t *testing.T, url string, userID int64) *websocket.Conn {
+	t.Helper()
+	session := "session-" + t.Name()
+	if err := models.CreateSession(userID, session); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/user", http.Header{"Cookie": {"session=" + session}})
+	if err != nil {
+		t.Fatalf("dial user: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readUntil reads user messages until done returns true for one
+func readUntil(t *testing.T, conn *websocket.Conn, done func(map[string]interface{}) bool) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		var m map[string]interface{}
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatalf("read user message: %v", err)
+		}
+		if done(m) {
+			return
+		}
+	}
+}
+
+func TestUserWSChatDrivesAgent(t *testing.T) {
+	t.Setenv("APPROVAL_RULES", "none")
+	api := claudetest.NewServer(
+		claudetest.ToolReply("點擊按鈕", "click", map[string]interface{}{"x": 100, "y": 200, "description": "OK 按鈕"}),
+		claudetest.TextReply("已完成"),
+	)
+	defer api.Close()
+	t.Setenv("ANTHROPIC_BASE_URL", api.URL)
+	t.Setenv("ANTHROPIC_API_KEY", claudetest.APIKey)
+	t.Setenv("LLM_PROVIDER", "")
+
+	url := wsServer(t)
+	userID, token := newTestUser(t)
+	commands := make(chan map[string]interface{}, 16)
+	dialAgent(t, url, token, commands)
+	user := dialUser(t, url, userID)
+
+	user.WriteJSON(map[string]interface{}{"type": "connect_agent", "data": map[string]string{"agent_token": token}})
+	readUntil(t, user, func(m map[string]interface{}) bool {
+		if m["type"] == "agent_status" && m["online"] != true {
+			t.Fatalf("agent is offline: %v", m)
+		}
+		return m["type"] == "agent_status"
+	})
+
+	user.WriteJSON(map[string]interface{}{"type": "chat_message", "data": map[string]string{"message": "請按 OK"}})
+	var replies []string
+	readUntil(t, user, func(m map[string]interface{}) bool {
+		switch m["type"] {
+		case "chat_response":
+			if m["is_error"] == true {
+				t.Fatalf("error sent to user: %v", m["content"])
+			}
+			if m["role"] == "assistant" {
+				replies = append(replies, m["content"].(string))
+			}
+		case "chat_status":
+			return m["status"] != models.TaskRunning
+		}
+		return false
+	})
+	if len(replies) == 0 || replies[len(replies)-1] != "已完成" {
+		t.Errorf("assistant replies = %q, want the last to be 已完成", replies)
+	}
+
+	// The model's click reached the agent over its websocket
+	var clicked bool
+	for len(commands) > 0 {
+		if cmd := <-commands; cmd["type"] == "click_xy" && cmd["x"] == 100.0 && cmd["y"] == 200.0 {
+			clicked = true
+		}
+	}
+	if !clicked {
+		t.Errorf("agent did not get the click")
+	}
+
+	// The second request answers the tool call with the agent's screenshot
+	requests := api.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("API called %d times, want 2", len(requests))
+	}
+	var answered bool
+	for _, msg := range requests[1].Messages {
+		for _, block := range msg.Content {
+			if block.Type == "tool_result" && !block.IsError {
+				answered = true
+			}
+		}
+	}
+	if !answered {
+		t.Errorf("second request has no successful tool_result")
+	}
+	if names := requests[0].ToolNames(); !slices.Contains(names, "click") || slices.Contains(names, claude.ComputerToolName) {
+		t.Errorf("offered tools = %v", names)
+	}
+	if task := lastTask(t, userID, token); task.Status != models.TaskSucceeded {
+		t.Errorf("task = %+v", task)
+	}
+}
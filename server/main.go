@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"weekend-chart/server/claude"
 	"weekend-chart/server/handlers"
+	"weekend-chart/server/metrics"
 	"weekend-chart/server/models"
 	"weekend-chart/server/relay"
 
@@ -52,6 +57,25 @@ func main() {
 	http.HandleFunc("/api/check-auth", handlers.HandleCheckAuth)
 	http.HandleFunc("/api/pair", handlers.RequireAuth(handlers.HandlePair))
 	http.HandleFunc("/api/agents", handlers.HandleAgents)
+	http.HandleFunc("/api/commands", handlers.HandleCommands)
+	http.HandleFunc("/api/llm-provider", handlers.HandleLLMProvider)
+	http.HandleFunc("/api/conversations", handlers.HandleConversations)
+	http.HandleFunc("/api/conversations/image", handlers.HandleConversationImage)
+	http.HandleFunc("/api/usage", handlers.HandleUsage)
+	http.HandleFunc("/api/prompts", handlers.HandlePrompts)
+	http.HandleFunc("/api/prompts/preview", handlers.HandlePromptPreview)
+	http.HandleFunc("/api/agent-policy", handlers.HandleAgentPolicy)
+	http.HandleFunc("/api/secrets", handlers.HandleSecrets)
+	http.HandleFunc("/api/tool-mode", handlers.HandleToolMode)
+	http.HandleFunc("/api/tasks", handlers.HandleTasks)
+
+	// Prometheus metrics, for scrapers that send METRICS_TOKEN as a bearer
+	// token. The labels name connected agents, so they are never public.
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		http.Handle("/metrics", metrics.RequireToken(token, metrics.Handler()))
+	} else {
+		log.Printf("METRICS_TOKEN not set, /metrics is disabled")
+	}
 
 	// WebSocket routes
 	http.HandleFunc("/ws/agent", handlers.HandleAgentWS)
@@ -71,7 +95,59 @@ func main() {
 	log.Printf("Server starting on port %s", port)
 	log.Printf("Static files served from %s", staticDir)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	srv := &http.Server{Addr: ":" + port}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Wait for termination signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+	log.Printf("Received %v, shutting down...", sig)
+
+	shutdown(srv)
+}
+
+const (
+	// chatDrainTimeout bounds how long running chat tasks may take to finish
+	chatDrainTimeout = 30 * time.Second
+
+	// chatCancelTimeout bounds how long cancelled chat tasks may take to clean up
+	chatCancelTimeout = 5 * time.Second
+
+	// reconnectAfter is how long agents and users should wait before reconnecting
+	reconnectAfter = 10 * time.Second
+)
+
+func shutdown(srv *http.Server) {
+	// Stop accepting new chat tasks and new connections
+	handlers.BeginShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
 	}
+
+	// Let running chat tasks finish their current step while agents are still connected
+	if !handlers.WaitForChats(chatDrainTimeout) {
+		log.Printf("Chat tasks did not finish within %v, cancelling them", chatDrainTimeout)
+		handlers.CancelChats()
+		handlers.WaitForChats(chatCancelTimeout)
+	}
+
+	// Tell agents and users to reconnect, then close every socket
+	relay.GlobalHub.Shutdown(reconnectAfter)
+
+	// Give the write pumps a moment to flush the shutdown notice
+	time.Sleep(500 * time.Millisecond)
+
+	if err := models.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+
+	log.Printf("Server stopped")
 }
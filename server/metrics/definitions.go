@@ -0,0 +1,74 @@
+package metrics
+
+// Relay metrics
+var (
+	DroppedMessages = NewCounterVec(
+		"weekend_chart_dropped_messages_total",
+		"Messages dropped because a connection's send channel was full or closed.",
+		"kind",
+	)
+
+	ScreenshotBytes = NewHistogramVec(
+		"weekend_chart_screenshot_bytes",
+		"Size of screenshots received from agents (base64 encoded).",
+		SizeBuckets,
+	)
+
+	AgentRequestDuration = NewHistogramVec(
+		"weekend_chart_agent_request_duration_seconds",
+		"Latency of synchronous screenshot and page state requests to agents.",
+		DefaultLatencyBuckets,
+		"request", "result",
+	)
+)
+
+// AI loop metrics
+var (
+	ClaudeRequestDuration = NewHistogramVec(
+		"weekend_chart_claude_request_duration_seconds",
+		"Latency of Claude Messages API calls.",
+		DefaultLatencyBuckets,
+		"result",
+	)
+
+	ClaudeRetries = NewCounterVec(
+		"weekend_chart_claude_retries_total",
+		"Claude API requests resent after a retryable error.",
+		"reason",
+	)
+
+	ClaudeTokens = NewCounterVec(
+		"weekend_chart_claude_tokens_total",
+		"Tokens reported by the Claude API usage field.",
+		"type",
+	)
+
+	ToolCalls = NewCounterVec(
+		"weekend_chart_tool_calls_total",
+		"Tool calls executed by the AI loop.",
+		"tool",
+	)
+
+	ToolErrors = NewCounterVec(
+		"weekend_chart_tool_errors_total",
+		"Tool calls that returned an error result.",
+		"tool",
+	)
+
+	PolicyViolations = NewCounterVec(
+		"weekend_chart_policy_violations_total",
+		"Tool calls and navigations stopped by an agent policy.",
+		"source",
+	)
+
+	PrunedScreenshots = NewCounterVec(
+		"weekend_chart_pruned_screenshots_total",
+		"Older screenshots replaced by text placeholders in the working context.",
+	)
+
+	ChatTasks = NewCounterVec(
+		"weekend_chart_chat_tasks_total",
+		"Finished chat tasks by final status.",
+		"status",
+	)
+)
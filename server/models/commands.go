@@ -0,0 +1,128 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Queued command statuses
+const (
+	CommandPending   = "pending"
+	CommandDelivered = "delivered"
+	CommandCancelled = "cancelled"
+	CommandExpired   = "expired"
+	CommandFailed    = "failed"
+)
+
+type QueuedCommand struct {
+	ID          int64
+	UserID      int64
+	AgentToken  string
+	CommandType string
+	Payload     string
+	Status      string
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	DeliveredAt time.Time
+}
+
+// EnqueueCommand stores a command for an offline agent
+func EnqueueCommand(userID int64, agentToken, commandType, payload string, ttl time.Duration) (int64, error) {
+	expiresAt := time.Now().UTC().Add(ttl)
+	res, err := DB.Exec(
+		"INSERT INTO queued_commands (user_id, agent_token, command_type, payload, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, agentToken, commandType, payload, expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// GetPendingCommands returns the unexpired pending commands for an agent, oldest first
+func GetPendingCommands(agentToken string) ([]QueuedCommand, error) {
+	return queryCommands(
+		"SELECT id, user_id, agent_token, command_type, payload, status, created_at, expires_at, delivered_at FROM queued_commands WHERE agent_token = ? AND status = ? AND expires_at > ? ORDER BY id",
+		agentToken, CommandPending, time.Now().UTC(),
+	)
+}
+
+// GetUserCommands returns the most recent queued commands of a user for an agent
+func GetUserCommands(userID int64, agentToken string) ([]QueuedCommand, error) {
+	return queryCommands(
+		"SELECT id, user_id, agent_token, command_type, payload, status, created_at, expires_at, delivered_at FROM queued_commands WHERE user_id = ? AND agent_token = ? ORDER BY id DESC LIMIT 50",
+		userID, agentToken,
+	)
+}
+
+func queryCommands(query string, args ...interface{}) ([]QueuedCommand, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []QueuedCommand
+	for rows.Next() {
+		var c QueuedCommand
+		var createdAt, expiresAt, deliveredAt sql.NullTime
+		err := rows.Scan(&c.ID, &c.UserID, &c.AgentToken, &c.CommandType, &c.Payload, &c.Status, &createdAt, &expiresAt, &deliveredAt)
+		if err != nil {
+			continue
+		}
+		if createdAt.Valid {
+			c.CreatedAt = createdAt.Time
+		}
+		if expiresAt.Valid {
+			c.ExpiresAt = expiresAt.Time
+		}
+		if deliveredAt.Valid {
+			c.DeliveredAt = deliveredAt.Time
+		}
+		commands = append(commands, c)
+	}
+	return commands, nil
+}
+
+// GetCommandStatus returns the current status of a queued command
+func GetCommandStatus(id int64) (string, error) {
+	var status string
+	err := DB.QueryRow("SELECT status FROM queued_commands WHERE id = ?", id).Scan(&status)
+	return status, err
+}
+
+// UpdateCommandStatus sets the status of a queued command
+func UpdateCommandStatus(id int64, status string) error {
+	if status == CommandDelivered {
+		_, err := DB.Exec(
+			"UPDATE queued_commands SET status = ?, delivered_at = ? WHERE id = ?",
+			status, time.Now().UTC(), id,
+		)
+		return err
+	}
+	_, err := DB.Exec("UPDATE queued_commands SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// CancelCommand cancels a pending command owned by the user.
+// Returns false if no pending command matched.
+func CancelCommand(userID, id int64) (bool, error) {
+	res, err := DB.Exec(
+		"UPDATE queued_commands SET status = ? WHERE id = ? AND user_id = ? AND status = ?",
+		CommandCancelled, id, userID, CommandPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ExpireQueuedCommands marks pending commands past their expiry as expired
+func ExpireQueuedCommands() error {
+	_, err := DB.Exec(
+		"UPDATE queued_commands SET status = ? WHERE status = ? AND expires_at <= ?",
+		CommandExpired, CommandPending, time.Now().UTC(),
+	)
+	return err
+}
@@ -0,0 +1,246 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type StoredConversation struct {
+	ID           int64
+	UserID       int64
+	AgentToken   string
+	Title        string
+	Archived     bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	MessageCount int
+
+	// Summary replaces the messages before SummaryBefore in the model's
+	// context once the conversation has been compacted
+	Summary       string
+	SummaryBefore int64 // ID of the first message the summary doesn't cover
+}
+
+type StoredMessage struct {
+	ID             int64
+	ConversationID int64
+	Role           string
+	Content        string // JSON encoded content blocks
+	CreatedAt      time.Time
+}
+
+// CreateConversation starts a new stored conversation
+func CreateConversation(userID int64, agentToken, title string) (int64, error) {
+	now := time.Now().UTC()
+	res, err := DB.Exec(
+		"INSERT INTO conversations (user_id, agent_token, title, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		userID, agentToken, title, now, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const conversationColumns = `c.id, c.user_id, c.agent_token, c.title, c.archived, c.created_at, c.updated_at,
+	(SELECT COUNT(*) FROM conversation_messages m WHERE m.conversation_id = c.id), c.summary, c.summary_before`
+
+// GetLatestConversation returns the most recently updated unarchived
+// conversation of a user with an agent. Returns sql.ErrNoRows if there is none.
+func GetLatestConversation(userID int64, agentToken string) (*StoredConversation, error) {
+	conversations, err := queryConversations(
+		"SELECT "+conversationColumns+" FROM conversations c WHERE c.user_id = ? AND c.agent_token = ? AND c.archived = 0 ORDER BY c.updated_at DESC, c.id DESC LIMIT 1",
+		userID, agentToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &conversations[0], nil
+}
+
+// GetConversation returns a conversation if it belongs to the user.
+// Returns sql.ErrNoRows otherwise.
+func GetConversation(userID, id int64) (*StoredConversation, error) {
+	conversations, err := queryConversations(
+		"SELECT "+conversationColumns+" FROM conversations c WHERE c.id = ? AND c.user_id = ?",
+		id, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(conversations) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &conversations[0], nil
+}
+
+// GetUserConversations returns a user's conversations, most recently updated first
+func GetUserConversations(userID int64) ([]StoredConversation, error) {
+	return queryConversations(
+		"SELECT "+conversationColumns+" FROM conversations c WHERE c.user_id = ? ORDER BY c.updated_at DESC, c.id DESC",
+		userID,
+	)
+}
+
+// GetAgentConversations returns a user's conversations with one agent, most
+// recently updated first
+func GetAgentConversations(userID int64, agentToken string, includeArchived bool) ([]StoredConversation, error) {
+	query := "SELECT " + conversationColumns + " FROM conversations c WHERE c.user_id = ? AND c.agent_token = ?"
+	if !includeArchived {
+		query += " AND c.archived = 0"
+	}
+	return queryConversations(query+" ORDER BY c.updated_at DESC, c.id DESC", userID, agentToken)
+}
+
+// RenameConversation changes the title of a user's conversation.
+// Returns false if the conversation doesn't belong to the user.
+func RenameConversation(userID, id int64, title string) (bool, error) {
+	res, err := DB.Exec("UPDATE conversations SET title = ? WHERE id = ? AND user_id = ?", title, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// SetConversationSummary stores the summary that replaces all messages of
+// a conversation except the last keep in the model's context
+func SetConversationSummary(conversationID int64, summary string, keep int) error {
+	_, err := DB.Exec(
+		`UPDATE conversations SET summary = ?, summary_before = COALESCE(
+			(SELECT id FROM conversation_messages WHERE conversation_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?), 0)
+		WHERE id = ?`,
+		summary, conversationID, keep-1, conversationID,
+	)
+	return err
+}
+
+// SetConversationArchived archives or restores a user's conversation.
+// Returns false if the conversation doesn't belong to the user.
+func SetConversationArchived(userID, id int64, archived bool) (bool, error) {
+	res, err := DB.Exec("UPDATE conversations SET archived = ? WHERE id = ? AND user_id = ?", archived, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func queryConversations(query string, args ...interface{}) ([]StoredConversation, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conversations []StoredConversation
+	for rows.Next() {
+		var c StoredConversation
+		var createdAt, updatedAt sql.NullTime
+		var title, summary sql.NullString
+		var summaryBefore sql.NullInt64
+		err := rows.Scan(&c.ID, &c.UserID, &c.AgentToken, &title, &c.Archived, &createdAt, &updatedAt, &c.MessageCount, &summary, &summaryBefore)
+		if err != nil {
+			continue
+		}
+		c.Title = title.String
+		c.Summary = summary.String
+		c.SummaryBefore = summaryBefore.Int64
+		if createdAt.Valid {
+			c.CreatedAt = createdAt.Time
+		}
+		if updatedAt.Valid {
+			c.UpdatedAt = updatedAt.Time
+		}
+		conversations = append(conversations, c)
+	}
+	return conversations, rows.Err()
+}
+
+// AddConversationMessage appends a message to a stored conversation
+func AddConversationMessage(conversationID int64, role, content string) error {
+	now := time.Now().UTC()
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO conversation_messages (conversation_id, role, content, created_at) VALUES (?, ?, ?, ?)",
+		conversationID, role, content, now,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE conversations SET updated_at = ? WHERE id = ?", now, conversationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetConversationMessages returns the messages of a conversation, oldest
+// first. If limit is positive only the last limit messages are returned.
+func GetConversationMessages(conversationID int64, limit int) ([]StoredMessage, error) {
+	return GetConversationMessagesFrom(conversationID, 0, limit)
+}
+
+// GetConversationMessagesFrom is like GetConversationMessages, but skips
+// the messages before the one with ID firstID
+func GetConversationMessagesFrom(conversationID, firstID int64, limit int) ([]StoredMessage, error) {
+	query := "SELECT id, conversation_id, role, content, created_at FROM conversation_messages WHERE conversation_id = ? AND id >= ? ORDER BY id"
+	args := []interface{}{conversationID, firstID}
+	if limit > 0 {
+		query = "SELECT * FROM (SELECT id, conversation_id, role, content, created_at FROM conversation_messages WHERE conversation_id = ? AND id >= ? ORDER BY id DESC LIMIT ?) ORDER BY id"
+		args = append(args, limit)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []StoredMessage
+	for rows.Next() {
+		var m StoredMessage
+		var createdAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &m.Content, &createdAt); err != nil {
+			continue
+		}
+		if createdAt.Valid {
+			m.CreatedAt = createdAt.Time
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// DeleteConversation removes a user's conversation, its messages and its
+// screenshots. Returns false if the conversation doesn't belong to the user.
+func DeleteConversation(userID, id int64) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM conversations WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec("DELETE FROM conversation_messages WHERE conversation_id = ?", id); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	deleteConversationImages(id)
+	return true, nil
+}
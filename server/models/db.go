@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"log"
+	"path/filepath"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,6 +12,9 @@ import (
 
 var DB *sql.DB
 
+// stopCleanup is closed by Close to stop the cleanup ticker
+var stopCleanup = make(chan struct{})
+
 func InitDB(dbPath string) error {
 	var err error
 	DB, err = sql.Open("sqlite3", dbPath)
@@ -51,6 +55,124 @@ func InitDB(dbPath string) error {
 		expires_at DATETIME,
 		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
+
+	CREATE TABLE IF NOT EXISTS queued_commands (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL,
+		command_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		delivered_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conversations_user_agent ON conversations(user_id, agent_token);
+
+	CREATE TABLE IF NOT EXISTS conversation_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		conversation_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (conversation_id) REFERENCES conversations(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_conversation_messages_conversation ON conversation_messages(conversation_id);
+
+	CREATE TABLE IF NOT EXISTS usage_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL,
+		conversation_id INTEGER,
+		provider TEXT NOT NULL,
+		model TEXT NOT NULL,
+		input_tokens INTEGER NOT NULL DEFAULT 0,
+		output_tokens INTEGER NOT NULL DEFAULT 0,
+		cost REAL NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_usage_records_user_time ON usage_records(user_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS model_rates (
+		model TEXT PRIMARY KEY,
+		input_per_mtok REAL NOT NULL,
+		output_per_mtok REAL NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS user_budgets (
+		user_id INTEGER PRIMARY KEY,
+		daily_limit REAL NOT NULL DEFAULT 0,
+		monthly_limit REAL NOT NULL DEFAULT 0,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS prompt_templates (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL DEFAULT '',
+		locale TEXT NOT NULL DEFAULT '',
+		timezone TEXT NOT NULL DEFAULT '',
+		content TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, agent_token),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS agent_policies (
+		agent_token TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		allowed_urls TEXT NOT NULL DEFAULT '[]',
+		blocked_urls TEXT NOT NULL DEFAULT '[]',
+		disabled_tools TEXT NOT NULL DEFAULT '[]',
+		max_actions INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS secrets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		ciphertext TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, agent_token, name),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS tasks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		agent_token TEXT NOT NULL,
+		conversation_id INTEGER,
+		message TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL,
+		steps INTEGER NOT NULL DEFAULT 0,
+		actions INTEGER NOT NULL DEFAULT 0,
+		input_tokens INTEGER NOT NULL DEFAULT 0,
+		output_tokens INTEGER NOT NULL DEFAULT 0,
+		summary TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		started_at DATETIME NOT NULL,
+		finished_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tasks_user_time ON tasks(user_id, started_at);
 	`
 
 	_, err = DB.Exec(schema)
@@ -58,6 +180,42 @@ func InitDB(dbPath string) error {
 		return err
 	}
 
+	// Columns added after the initial schema
+	migrations := []struct{ table, column, definition string }{
+		{"pairing_codes", "e2e_public_key", "TEXT DEFAULT ''"},
+		{"agents", "e2e_enabled", "INTEGER DEFAULT 0"},
+		{"agents", "e2e_public_key", "TEXT DEFAULT ''"},
+		{"users", "llm_provider", "TEXT DEFAULT ''"},
+		{"agents", "llm_provider", "TEXT DEFAULT ''"},
+		{"agents", "tool_mode", "TEXT DEFAULT ''"},
+		{"conversations", "title", "TEXT DEFAULT ''"},
+		{"conversations", "archived", "INTEGER DEFAULT 0"},
+		{"conversations", "summary", "TEXT DEFAULT ''"},
+		{"conversations", "summary_before", "INTEGER DEFAULT 0"},
+		{"usage_records", "cache_read_tokens", "INTEGER NOT NULL DEFAULT 0"},
+		{"usage_records", "cache_creation_tokens", "INTEGER NOT NULL DEFAULT 0"},
+		{"usage_records", "pruned_images", "INTEGER NOT NULL DEFAULT 0"},
+		{"model_rates", "cache_read_per_mtok", "REAL NOT NULL DEFAULT 0"},
+		{"model_rates", "cache_write_per_mtok", "REAL NOT NULL DEFAULT 0"},
+	}
+	for _, m := range migrations {
+		if err := addColumnIfMissing(m.table, m.column, m.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := seedModelRates(); err != nil {
+		return err
+	}
+
+	// Tasks still open were cut off by a crash or restart
+	if err := failOpenTasks(); err != nil {
+		return err
+	}
+
+	// Conversation screenshots are stored next to the database
+	imageDir = filepath.Join(filepath.Dir(dbPath), "images")
+
 	// Create default user if not exists
 	err = createDefaultUser("wake", "721225")
 	if err != nil {
@@ -70,6 +228,25 @@ func InitDB(dbPath string) error {
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := DB.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err == nil && name == column {
+			return nil
+		}
+	}
+
+	_, err = DB.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 func createDefaultUser(username, password string) error {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), 14)
 	if err != nil {
@@ -85,11 +262,24 @@ func createDefaultUser(username, password string) error {
 
 func cleanupExpiredCodes() {
 	ticker := time.NewTicker(1 * time.Minute)
-	for range ticker.C {
-		DB.Exec("DELETE FROM pairing_codes WHERE expires_at < datetime('now')")
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			DB.Exec("DELETE FROM pairing_codes WHERE expires_at < datetime('now')")
+			ExpireQueuedCommands()
+		case <-stopCleanup:
+			return
+		}
 	}
 }
 
+// Close stops background cleanup and closes the database
+func Close() error {
+	close(stopCleanup)
+	return DB.Close()
+}
+
 // User functions
 func ValidateUser(username, password string) (int64, error) {
 	var id int64
@@ -135,22 +325,24 @@ func DeleteSession(token string) error {
 }
 
 // Agent functions
-func CreatePairingCode(code, agentToken string) error {
+func CreatePairingCode(code, agentToken, e2ePublicKey string) error {
 	expiresAt := time.Now().Add(5 * time.Minute)
 	_, err := DB.Exec(
-		"INSERT OR REPLACE INTO pairing_codes (code, agent_token, expires_at) VALUES (?, ?, ?)",
-		code, agentToken, expiresAt,
+		"INSERT OR REPLACE INTO pairing_codes (code, agent_token, e2e_public_key, expires_at) VALUES (?, ?, ?, ?)",
+		code, agentToken, e2ePublicKey, expiresAt,
 	)
 	return err
 }
 
-func ValidatePairingCode(code string) (string, error) {
+// ValidatePairingCode returns the agent token and the agent's E2E public key (if offered)
+func ValidatePairingCode(code string) (string, string, error) {
 	var agentToken string
+	var e2ePublicKey sql.NullString
 	err := DB.QueryRow(
-		"SELECT agent_token FROM pairing_codes WHERE code = ? AND expires_at > datetime('now')",
+		"SELECT agent_token, e2e_public_key FROM pairing_codes WHERE code = ? AND expires_at > datetime('now')",
 		code,
-	).Scan(&agentToken)
-	return agentToken, err
+	).Scan(&agentToken, &e2ePublicKey)
+	return agentToken, e2ePublicKey.String, err
 }
 
 func DeletePairingCode(code string) error {
@@ -196,14 +388,16 @@ func GetAgentByToken(token string) (*Agent, error) {
 	var a Agent
 	var lastSeen sql.NullTime
 	var userID int64
+	var e2ePublicKey sql.NullString
 	err := DB.QueryRow(
-		"SELECT id, user_id, agent_token, name, last_seen FROM agents WHERE agent_token = ?",
+		"SELECT id, user_id, agent_token, name, last_seen, e2e_enabled, e2e_public_key FROM agents WHERE agent_token = ?",
 		token,
-	).Scan(&a.ID, &userID, &a.Token, &a.Name, &lastSeen)
+	).Scan(&a.ID, &userID, &a.Token, &a.Name, &lastSeen, &a.E2EEnabled, &e2ePublicKey)
 	if err != nil {
 		return nil, err
 	}
 	a.UserID = userID
+	a.E2EPublicKey = e2ePublicKey.String
 	if lastSeen.Valid {
 		a.LastSeen = lastSeen.Time
 	}
@@ -218,6 +412,15 @@ func UpdateAgentLastSeen(token string) error {
 	return err
 }
 
+// EnableAgentE2E turns on end-to-end encryption for an agent
+func EnableAgentE2E(token, publicKey string) error {
+	_, err := DB.Exec(
+		"UPDATE agents SET e2e_enabled = 1, e2e_public_key = ? WHERE agent_token = ?",
+		publicKey, token,
+	)
+	return err
+}
+
 func DeleteAgent(userID int64, agentID int64) error {
 	_, err := DB.Exec(
 		"DELETE FROM agents WHERE id = ? AND user_id = ?",
@@ -232,4 +435,7 @@ type Agent struct {
 	Token    string
 	Name     string
 	LastSeen time.Time
+
+	E2EEnabled   bool
+	E2EPublicKey string
 }
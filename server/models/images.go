@@ -0,0 +1,85 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// imageDir is where conversation screenshots are stored, one directory per
+// conversation. Set by InitDB.
+var imageDir string
+
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// SaveImage stores a base64 encoded image for a conversation and returns the
+// file name to reference it by. Identical images are stored once.
+func SaveImage(conversationID int64, mediaType, data string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid image data: %w", err)
+	}
+
+	ext, ok := imageExtensions[mediaType]
+	if !ok {
+		ext = ".bin"
+	}
+	sum := sha256.Sum256(raw)
+	name := hex.EncodeToString(sum[:16]) + ext
+
+	dir := conversationImageDir(conversationID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// LoadImage returns a stored image base64 encoded
+func LoadImage(conversationID int64, name string) (string, error) {
+	path, err := ImagePath(conversationID, name)
+	if err != nil {
+		return "", err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// ImagePath returns the path of a stored image, rejecting names that would
+// escape the conversation's directory
+func ImagePath(conversationID int64, name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid image name")
+	}
+	return filepath.Join(conversationImageDir(conversationID), name), nil
+}
+
+func conversationImageDir(conversationID int64) string {
+	return filepath.Join(imageDir, strconv.FormatInt(conversationID, 10))
+}
+
+func deleteConversationImages(conversationID int64) {
+	if err := os.RemoveAll(conversationImageDir(conversationID)); err != nil {
+		log.Printf("Failed to delete images of conversation %d: %v", conversationID, err)
+	}
+}
@@ -0,0 +1,91 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// AgentPolicy limits what the AI may do on one agent
+type AgentPolicy struct {
+	AgentToken    string    `json:"agent_token"`
+	AllowedURLs   []string  `json:"allowed_urls"`   // navigate may only go here; empty allows all
+	BlockedURLs   []string  `json:"blocked_urls"`   // navigate may never go here
+	DisabledTools []string  `json:"disabled_tools"` // Tools the AI doesn't get
+	MaxActions    int       `json:"max_actions"`    // Browser actions per task, 0 for no limit
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// GetAgentPolicy returns the policy of an agent, or nil if it has none
+func GetAgentPolicy(agentToken string) (*AgentPolicy, error) {
+	p := AgentPolicy{AgentToken: agentToken}
+	var allowed, blocked, disabled string
+	var updatedAt sql.NullTime
+	err := DB.QueryRow(
+		"SELECT allowed_urls, blocked_urls, disabled_tools, max_actions, updated_at FROM agent_policies WHERE agent_token = ?",
+		agentToken,
+	).Scan(&allowed, &blocked, &disabled, &p.MaxActions, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range []struct {
+		raw  string
+		list *[]string
+	}{{allowed, &p.AllowedURLs}, {blocked, &p.BlockedURLs}, {disabled, &p.DisabledTools}} {
+		if err := json.Unmarshal([]byte(field.raw), field.list); err != nil {
+			return nil, err
+		}
+	}
+	if updatedAt.Valid {
+		p.UpdatedAt = updatedAt.Time
+	}
+	return &p, nil
+}
+
+// SaveAgentPolicy stores the policy of one of the user's agents, replacing
+// the previous one. Returns false if the agent doesn't belong to the user.
+func SaveAgentPolicy(userID int64, p AgentPolicy) (bool, error) {
+	var owner int64
+	err := DB.QueryRow("SELECT user_id FROM agents WHERE agent_token = ?", p.AgentToken).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if owner != userID {
+		return false, nil
+	}
+
+	lists := make([]string, 0, 3)
+	for _, list := range [][]string{p.AllowedURLs, p.BlockedURLs, p.DisabledTools} {
+		if list == nil {
+			list = []string{}
+		}
+		data, err := json.Marshal(list)
+		if err != nil {
+			return false, err
+		}
+		lists = append(lists, string(data))
+	}
+
+	_, err = DB.Exec(
+		"INSERT INTO agent_policies (agent_token, user_id, allowed_urls, blocked_urls, disabled_tools, max_actions, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(agent_token) DO UPDATE SET allowed_urls = excluded.allowed_urls, blocked_urls = excluded.blocked_urls, disabled_tools = excluded.disabled_tools, max_actions = excluded.max_actions, updated_at = excluded.updated_at",
+		p.AgentToken, userID, lists[0], lists[1], lists[2], p.MaxActions, time.Now().UTC(),
+	)
+	return err == nil, err
+}
+
+// DeleteAgentPolicy removes the policy of one of the user's agents, so the
+// AI may use it without limits again
+func DeleteAgentPolicy(userID int64, agentToken string) error {
+	_, err := DB.Exec(
+		"DELETE FROM agent_policies WHERE user_id = ? AND agent_token = ?",
+		userID, agentToken,
+	)
+	return err
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// PromptTemplate is a user's system prompt settings. An empty AgentToken
+// applies to all of the user's agents; empty fields fall back to the
+// user-wide template and then to the built-in defaults.
+type PromptTemplate struct {
+	AgentToken string    `json:"agent_token"`
+	Locale     string    `json:"locale"`
+	TimeZone   string    `json:"timezone"`
+	Content    string    `json:"content"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// GetPromptTemplate returns the template stored for exactly this scope, or
+// nil if there is none
+func GetPromptTemplate(userID int64, agentToken string) (*PromptTemplate, error) {
+	t := PromptTemplate{AgentToken: agentToken}
+	var updatedAt sql.NullTime
+	err := DB.QueryRow(
+		"SELECT locale, timezone, content, updated_at FROM prompt_templates WHERE user_id = ? AND agent_token = ?",
+		userID, agentToken,
+	).Scan(&t.Locale, &t.TimeZone, &t.Content, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		t.UpdatedAt = updatedAt.Time
+	}
+	return &t, nil
+}
+
+// GetEffectivePromptTemplate merges the agent's template over the user's.
+// Fields neither of them sets are left empty.
+func GetEffectivePromptTemplate(userID int64, agentToken string) (PromptTemplate, error) {
+	var effective PromptTemplate
+	scopes := []string{""}
+	if agentToken != "" {
+		scopes = append(scopes, agentToken)
+	}
+
+	for _, scope := range scopes {
+		t, err := GetPromptTemplate(userID, scope)
+		if err != nil {
+			return PromptTemplate{}, err
+		}
+		if t == nil {
+			continue
+		}
+		effective.AgentToken = t.AgentToken
+		if t.Locale != "" {
+			effective.Locale = t.Locale
+		}
+		if t.TimeZone != "" {
+			effective.TimeZone = t.TimeZone
+		}
+		if t.Content != "" {
+			effective.Content = t.Content
+		}
+		if t.UpdatedAt.After(effective.UpdatedAt) {
+			effective.UpdatedAt = t.UpdatedAt
+		}
+	}
+	return effective, nil
+}
+
+// SavePromptTemplate stores a user's template for t.AgentToken, replacing
+// the previous one. Returns false if the agent doesn't belong to the user.
+func SavePromptTemplate(userID int64, t PromptTemplate) (bool, error) {
+	if t.AgentToken != "" {
+		var owner int64
+		err := DB.QueryRow("SELECT user_id FROM agents WHERE agent_token = ?", t.AgentToken).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if owner != userID {
+			return false, nil
+		}
+	}
+
+	_, err := DB.Exec(
+		"INSERT INTO prompt_templates (user_id, agent_token, locale, timezone, content, updated_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT(user_id, agent_token) DO UPDATE SET locale = excluded.locale, timezone = excluded.timezone, content = excluded.content, updated_at = excluded.updated_at",
+		userID, t.AgentToken, t.Locale, t.TimeZone, t.Content, time.Now().UTC(),
+	)
+	return err == nil, err
+}
+
+// DeletePromptTemplate removes a user's template for one scope, so it falls
+// back to the user-wide template or the built-in default
+func DeletePromptTemplate(userID int64, agentToken string) error {
+	_, err := DB.Exec(
+		"DELETE FROM prompt_templates WHERE user_id = ? AND agent_token = ?",
+		userID, agentToken,
+	)
+	return err
+}
@@ -0,0 +1,74 @@
+package models
+
+import "database/sql"
+
+// GetLLMProvider returns the provider configured for a user's agent.
+// The agent setting takes precedence over the user's; an empty string
+// means neither is set and the server default applies.
+func GetLLMProvider(userID int64, agentToken string) string {
+	var agentProvider, userProvider sql.NullString
+	DB.QueryRow(
+		"SELECT llm_provider FROM agents WHERE agent_token = ? AND user_id = ?",
+		agentToken, userID,
+	).Scan(&agentProvider)
+	if agentProvider.String != "" {
+		return agentProvider.String
+	}
+
+	DB.QueryRow("SELECT llm_provider FROM users WHERE id = ?", userID).Scan(&userProvider)
+	return userProvider.String
+}
+
+// GetUserLLMProvider returns the provider a user has chosen for all their agents
+func GetUserLLMProvider(userID int64) (string, error) {
+	var provider sql.NullString
+	err := DB.QueryRow("SELECT llm_provider FROM users WHERE id = ?", userID).Scan(&provider)
+	return provider.String, err
+}
+
+// SetUserLLMProvider sets the provider for all of a user's agents.
+// An empty provider clears the setting.
+func SetUserLLMProvider(userID int64, provider string) error {
+	_, err := DB.Exec("UPDATE users SET llm_provider = ? WHERE id = ?", provider, userID)
+	return err
+}
+
+// SetAgentLLMProvider sets the provider for one agent, overriding the user's
+// setting. An empty provider clears it. Returns false if the agent doesn't
+// belong to the user.
+func SetAgentLLMProvider(userID int64, agentToken, provider string) (bool, error) {
+	result, err := DB.Exec(
+		"UPDATE agents SET llm_provider = ? WHERE agent_token = ? AND user_id = ?",
+		provider, agentToken, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetAgentToolMode returns the tool mode set for a user's agent, or an
+// empty string if none is set
+func GetAgentToolMode(userID int64, agentToken string) string {
+	var mode sql.NullString
+	DB.QueryRow(
+		"SELECT tool_mode FROM agents WHERE agent_token = ? AND user_id = ?",
+		agentToken, userID,
+	).Scan(&mode)
+	return mode.String
+}
+
+// SetAgentToolMode sets the tool mode of one agent; an empty mode clears
+// it. Returns false if the agent doesn't belong to the user.
+func SetAgentToolMode(userID int64, agentToken, mode string) (bool, error) {
+	result, err := DB.Exec(
+		"UPDATE agents SET tool_mode = ? WHERE agent_token = ? AND user_id = ?",
+		mode, agentToken, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrSecretsDisabled is returned when SECRETS_KEY is not set
+var ErrSecretsDisabled = errors.New("SECRETS_KEY is not set")
+
+// Secret is a stored credential without its value. An empty AgentToken
+// makes it available on all of the user's agents.
+type Secret struct {
+	AgentToken string    `json:"agent_token"`
+	Name       string    `json:"name"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// SecretsEnabled reports whether secrets can be stored
+func SecretsEnabled() bool {
+	return os.Getenv("SECRETS_KEY") != ""
+}
+
+// secretsCipher returns the AEAD that encrypts secret values, keyed by
+// the SECRETS_KEY environment variable
+func secretsCipher() (cipher.AEAD, error) {
+	key := os.Getenv("SECRETS_KEY")
+	if key == "" {
+		return nil, ErrSecretsDisabled
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretAD binds a ciphertext to its row, so values can't be moved to
+// another user, agent or name in the database
+func secretAD(userID int64, agentToken, name string) []byte {
+	return []byte(fmt.Sprintf("%d\x00%s\x00%s", userID, agentToken, name))
+}
+
+func encryptSecret(userID int64, agentToken, name, value string) (string, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), secretAD(userID, agentToken, name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(userID int64, agentToken, name, ciphertext string) (string, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("secret ciphertext is too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, sealed, secretAD(userID, agentToken, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret %q: %w", name, err)
+	}
+	return string(value), nil
+}
+
+// ListSecrets returns the secrets stored for exactly this scope
+func ListSecrets(userID int64, agentToken string) ([]Secret, error) {
+	rows, err := DB.Query(
+		"SELECT name, updated_at FROM secrets WHERE user_id = ? AND agent_token = ? ORDER BY name",
+		userID, agentToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []Secret{}
+	for rows.Next() {
+		s := Secret{AgentToken: agentToken}
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&s.Name, &updatedAt); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			s.UpdatedAt = updatedAt.Time
+		}
+		secrets = append(secrets, s)
+	}
+	return secrets, rows.Err()
+}
+
+// GetSecretNames returns the names of the secrets usable on a user's agent
+func GetSecretNames(userID int64, agentToken string) ([]string, error) {
+	rows, err := DB.Query(
+		"SELECT DISTINCT name FROM secrets WHERE user_id = ? AND agent_token IN ('', ?) ORDER BY name",
+		userID, agentToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetAgentSecrets decrypts the secrets usable on a user's agent. The
+// agent's own secrets take precedence over user-wide ones of the same name.
+func GetAgentSecrets(userID int64, agentToken string) (map[string]string, error) {
+	rows, err := DB.Query(
+		// User-wide rows sort first so the agent's rows overwrite them
+		"SELECT agent_token, name, ciphertext FROM secrets WHERE user_id = ? AND agent_token IN ('', ?) ORDER BY agent_token",
+		userID, agentToken,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := make(map[string]string)
+	for rows.Next() {
+		var scope, name, ciphertext string
+		if err := rows.Scan(&scope, &name, &ciphertext); err != nil {
+			return nil, err
+		}
+		value, err := decryptSecret(userID, scope, name, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		secrets[name] = value
+	}
+	return secrets, rows.Err()
+}
+
+// SaveSecret encrypts and stores a secret, replacing one of the same name.
+// Returns false if the agent doesn't belong to the user.
+func SaveSecret(userID int64, agentToken, name, value string) (bool, error) {
+	if agentToken != "" {
+		var owner int64
+		err := DB.QueryRow("SELECT user_id FROM agents WHERE agent_token = ?", agentToken).Scan(&owner)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if owner != userID {
+			return false, nil
+		}
+	}
+
+	ciphertext, err := encryptSecret(userID, agentToken, name, value)
+	if err != nil {
+		return false, err
+	}
+	_, err = DB.Exec(
+		"INSERT INTO secrets (user_id, agent_token, name, ciphertext, updated_at) VALUES (?, ?, ?, ?, ?) ON CONFLICT(user_id, agent_token, name) DO UPDATE SET ciphertext = excluded.ciphertext, updated_at = excluded.updated_at",
+		userID, agentToken, name, ciphertext, time.Now().UTC(),
+	)
+	return err == nil, err
+}
+
+// DeleteSecret removes one of a user's secrets
+func DeleteSecret(userID int64, agentToken, name string) error {
+	_, err := DB.Exec(
+		"DELETE FROM secrets WHERE user_id = ? AND agent_token = ? AND name = ?",
+		userID, agentToken, name,
+	)
+	return err
+}
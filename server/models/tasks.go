@@ -0,0 +1,142 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+// States of a chat task
+const (
+	TaskRunning        = "running"
+	TaskWaitingForUser = "waiting_for_user" // Waiting for the user to approve a tool call
+	TaskSucceeded      = "succeeded"
+	TaskFailed         = "failed"
+	TaskCancelled      = "cancelled"
+	TaskBudgetExceeded = "budget_exceeded"
+)
+
+// TaskFinished reports whether status is a final state
+func TaskFinished(status string) bool {
+	switch status {
+	case TaskSucceeded, TaskFailed, TaskCancelled, TaskBudgetExceeded:
+		return true
+	}
+	return false
+}
+
+// Task is one run of the AI loop for a chat message
+type Task struct {
+	ID             int64      `json:"id"`
+	UserID         int64      `json:"-"`
+	AgentToken     string     `json:"agent_token"`
+	ConversationID int64      `json:"conversation_id,omitempty"`
+	Message        string     `json:"message"`
+	Status         string     `json:"status"`
+	Steps          int        `json:"steps"`   // Model responses
+	Actions        int        `json:"actions"` // Tool calls
+	InputTokens    int        `json:"input_tokens"`
+	OutputTokens   int        `json:"output_tokens"`
+	Summary        string     `json:"summary,omitempty"` // The model's last reply
+	Error          string     `json:"error,omitempty"`   // Why the task didn't succeed
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// CreateTask stores a new running task and sets its ID
+func CreateTask(t *Task) error {
+	t.Status = TaskRunning
+	t.StartedAt = time.Now().UTC()
+
+	var conversationID interface{}
+	if t.ConversationID != 0 {
+		conversationID = t.ConversationID
+	}
+	res, err := DB.Exec(
+		"INSERT INTO tasks (user_id, agent_token, conversation_id, message, status, started_at) VALUES (?, ?, ?, ?, ?, ?)",
+		t.UserID, t.AgentToken, conversationID, t.Message, t.Status, t.StartedAt,
+	)
+	if err != nil {
+		return err
+	}
+	t.ID, err = res.LastInsertId()
+	return err
+}
+
+// UpdateTaskStatus changes the state of a task that is still open
+func UpdateTaskStatus(id int64, status string) error {
+	_, err := DB.Exec("UPDATE tasks SET status = ? WHERE id = ?", status, id)
+	return err
+}
+
+// FinishTask stores the final state and stats of a task
+func FinishTask(t *Task) error {
+	now := time.Now().UTC()
+	t.FinishedAt = &now
+	_, err := DB.Exec(
+		"UPDATE tasks SET status = ?, steps = ?, actions = ?, input_tokens = ?, output_tokens = ?, summary = ?, error = ?, finished_at = ? WHERE id = ?",
+		t.Status, t.Steps, t.Actions, t.InputTokens, t.OutputTokens, t.Summary, t.Error, now, t.ID,
+	)
+	return err
+}
+
+const taskColumns = "id, user_id, agent_token, conversation_id, message, status, steps, actions, input_tokens, output_tokens, summary, error, started_at, finished_at"
+
+// ListTasks returns a user's latest tasks, newest first. An empty
+// agentToken lists the tasks of all agents.
+func ListTasks(userID int64, agentToken string, limit int) ([]Task, error) {
+	query := "SELECT " + taskColumns + " FROM tasks WHERE user_id = ?"
+	args := []interface{}{userID}
+	if agentToken != "" {
+		query += " AND agent_token = ?"
+		args = append(args, agentToken)
+	}
+	query += " ORDER BY started_at DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, *t)
+	}
+	return tasks, rows.Err()
+}
+
+// GetTask returns a task if it belongs to the user. Returns sql.ErrNoRows
+// otherwise.
+func GetTask(userID, id int64) (*Task, error) {
+	return scanTask(DB.QueryRow("SELECT "+taskColumns+" FROM tasks WHERE id = ? AND user_id = ?", id, userID))
+}
+
+func scanTask(row interface{ Scan(...interface{}) error }) (*Task, error) {
+	var t Task
+	var conversationID sql.NullInt64
+	var finishedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.UserID, &t.AgentToken, &conversationID, &t.Message, &t.Status,
+		&t.Steps, &t.Actions, &t.InputTokens, &t.OutputTokens, &t.Summary, &t.Error, &t.StartedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.ConversationID = conversationID.Int64
+	if finishedAt.Valid {
+		t.FinishedAt = &finishedAt.Time
+	}
+	return &t, nil
+}
+
+// failOpenTasks marks tasks that never finished as failed
+func failOpenTasks() error {
+	_, err := DB.Exec(
+		"UPDATE tasks SET status = ?, error = ?, finished_at = ? WHERE status IN (?, ?)",
+		TaskFailed, "server restarted", time.Now().UTC(), TaskRunning, TaskWaitingForUser,
+	)
+	return err
+}
@@ -0,0 +1,301 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultModelRates are the prices (USD per million tokens) seeded into
+// model_rates. Rates are matched by exact model name first, then by the
+// longest name that is a prefix of the model.
+var defaultModelRates = []ModelRate{
+	{Model: "claude-opus-4", InputPerMTok: 15, OutputPerMTok: 75, CacheReadPerMTok: 1.5, CacheWritePerMTok: 18.75},
+	{Model: "claude-sonnet-4", InputPerMTok: 3, OutputPerMTok: 15, CacheReadPerMTok: 0.3, CacheWritePerMTok: 3.75},
+	{Model: "claude-3-7-sonnet", InputPerMTok: 3, OutputPerMTok: 15, CacheReadPerMTok: 0.3, CacheWritePerMTok: 3.75},
+	{Model: "claude-3-5-sonnet", InputPerMTok: 3, OutputPerMTok: 15, CacheReadPerMTok: 0.3, CacheWritePerMTok: 3.75},
+	{Model: "claude-3-5-haiku", InputPerMTok: 0.8, OutputPerMTok: 4, CacheReadPerMTok: 0.08, CacheWritePerMTok: 1},
+	{Model: "gpt-4o-mini", InputPerMTok: 0.15, OutputPerMTok: 0.6, CacheReadPerMTok: 0.075},
+	{Model: "gpt-4o", InputPerMTok: 2.5, OutputPerMTok: 10, CacheReadPerMTok: 1.25},
+}
+
+type ModelRate struct {
+	Model             string  `json:"model"`
+	InputPerMTok      float64 `json:"input_per_mtok"`
+	OutputPerMTok     float64 `json:"output_per_mtok"`
+	CacheReadPerMTok  float64 `json:"cache_read_per_mtok"`
+	CacheWritePerMTok float64 `json:"cache_write_per_mtok"`
+}
+
+type UsageRecord struct {
+	UserID         int64
+	AgentToken     string
+	ConversationID int64
+	Provider       string
+	Model          string
+	InputTokens    int
+	OutputTokens   int
+	CacheRead      int // Input tokens read from the prompt cache
+	CacheCreation  int // Input tokens written to the prompt cache
+	PrunedImages   int // Screenshots replaced by placeholders before the request
+	Cost           float64
+	CreatedAt      time.Time
+}
+
+type UsageTotals struct {
+	Requests      int     `json:"requests"`
+	InputTokens   int     `json:"input_tokens"`
+	OutputTokens  int     `json:"output_tokens"`
+	CacheRead     int     `json:"cache_read_tokens"`
+	CacheCreation int     `json:"cache_creation_tokens"`
+	PrunedImages  int     `json:"pruned_images"`
+	Cost          float64 `json:"cost"`
+}
+
+type Budget struct {
+	DailyLimit   float64 `json:"daily_limit"`   // USD, 0 means no limit
+	MonthlyLimit float64 `json:"monthly_limit"` // USD, 0 means no limit
+}
+
+// seedModelRates inserts the default rates that aren't configured yet, then
+// applies overrides from MODEL_RATES ("model=input/output[/cache read/cache
+// write],...", USD per million tokens)
+func seedModelRates() error {
+	for _, r := range defaultModelRates {
+		if _, err := DB.Exec(
+			"INSERT OR IGNORE INTO model_rates (model, input_per_mtok, output_per_mtok, cache_read_per_mtok, cache_write_per_mtok) VALUES (?, ?, ?, ?, ?)",
+			r.Model, r.InputPerMTok, r.OutputPerMTok, r.CacheReadPerMTok, r.CacheWritePerMTok,
+		); err != nil {
+			return err
+		}
+		// Rates seeded before cache pricing existed
+		if _, err := DB.Exec(
+			"UPDATE model_rates SET cache_read_per_mtok = ?, cache_write_per_mtok = ? WHERE model = ? AND cache_read_per_mtok = 0 AND cache_write_per_mtok = 0",
+			r.CacheReadPerMTok, r.CacheWritePerMTok, r.Model,
+		); err != nil {
+			return err
+		}
+	}
+
+	overrides := os.Getenv("MODEL_RATES")
+	if overrides == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(overrides, ",") {
+		rate, err := parseModelRate(strings.TrimSpace(entry))
+		if err != nil {
+			log.Printf("Ignoring MODEL_RATES entry %q: %v", entry, err)
+			continue
+		}
+		if err := SetModelRate(rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseModelRate(entry string) (ModelRate, error) {
+	model, prices, ok := strings.Cut(entry, "=")
+	parts := strings.Split(prices, "/")
+	if !ok || model == "" || (len(parts) != 2 && len(parts) != 4) {
+		return ModelRate{}, fmt.Errorf("expected model=input/output[/cache read/cache write]")
+	}
+
+	values := make([]float64, 4)
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return ModelRate{}, err
+		}
+		values[i] = v
+	}
+	return ModelRate{
+		Model:             model,
+		InputPerMTok:      values[0],
+		OutputPerMTok:     values[1],
+		CacheReadPerMTok:  values[2],
+		CacheWritePerMTok: values[3],
+	}, nil
+}
+
+// SetModelRate adds or replaces the price of a model
+func SetModelRate(rate ModelRate) error {
+	_, err := DB.Exec(
+		"INSERT INTO model_rates (model, input_per_mtok, output_per_mtok, cache_read_per_mtok, cache_write_per_mtok) VALUES (?, ?, ?, ?, ?) ON CONFLICT(model) DO UPDATE SET input_per_mtok = excluded.input_per_mtok, output_per_mtok = excluded.output_per_mtok, cache_read_per_mtok = excluded.cache_read_per_mtok, cache_write_per_mtok = excluded.cache_write_per_mtok",
+		rate.Model, rate.InputPerMTok, rate.OutputPerMTok, rate.CacheReadPerMTok, rate.CacheWritePerMTok,
+	)
+	return err
+}
+
+// GetModelRates returns all configured model prices
+func GetModelRates() ([]ModelRate, error) {
+	rows, err := DB.Query("SELECT model, input_per_mtok, output_per_mtok, cache_read_per_mtok, cache_write_per_mtok FROM model_rates ORDER BY model")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []ModelRate
+	for rows.Next() {
+		var r ModelRate
+		if err := rows.Scan(&r.Model, &r.InputPerMTok, &r.OutputPerMTok, &r.CacheReadPerMTok, &r.CacheWritePerMTok); err != nil {
+			continue
+		}
+		rates = append(rates, r)
+	}
+	return rates, rows.Err()
+}
+
+// findModelRate returns the rate for a model. Returns false if the model has no price.
+func findModelRate(model string) (ModelRate, bool) {
+	rates, err := GetModelRates()
+	if err != nil {
+		return ModelRate{}, false
+	}
+
+	var best ModelRate
+	found := false
+	for _, r := range rates {
+		if r.Model == model {
+			return r, true
+		}
+		if strings.HasPrefix(model, r.Model) && len(r.Model) > len(best.Model) {
+			best = r
+			found = true
+		}
+	}
+	return best, found
+}
+
+// RecordUsage prices a model request and stores it. Returns the cost in USD.
+func RecordUsage(rec UsageRecord) (float64, error) {
+	if rate, ok := findModelRate(rec.Model); ok {
+		rec.Cost = (float64(rec.InputTokens)*rate.InputPerMTok +
+			float64(rec.OutputTokens)*rate.OutputPerMTok +
+			float64(rec.CacheRead)*rate.CacheReadPerMTok +
+			float64(rec.CacheCreation)*rate.CacheWritePerMTok) / 1e6
+	} else {
+		log.Printf("No rate configured for model %q, recording usage without cost", rec.Model)
+	}
+
+	var conversationID interface{}
+	if rec.ConversationID != 0 {
+		conversationID = rec.ConversationID
+	}
+	_, err := DB.Exec(
+		"INSERT INTO usage_records (user_id, agent_token, conversation_id, provider, model, input_tokens, output_tokens, cache_read_tokens, cache_creation_tokens, pruned_images, cost, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		rec.UserID, rec.AgentToken, conversationID, rec.Provider, rec.Model, rec.InputTokens, rec.OutputTokens, rec.CacheRead, rec.CacheCreation, rec.PrunedImages, rec.Cost, time.Now().UTC(),
+	)
+	return rec.Cost, err
+}
+
+// GetUsageTotals sums a user's usage since the given time
+func GetUsageTotals(userID int64, since time.Time) (UsageTotals, error) {
+	var t UsageTotals
+	err := DB.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(input_tokens), 0), COALESCE(SUM(output_tokens), 0), COALESCE(SUM(cache_read_tokens), 0), COALESCE(SUM(cache_creation_tokens), 0), COALESCE(SUM(pruned_images), 0), COALESCE(SUM(cost), 0) FROM usage_records WHERE user_id = ? AND created_at >= ?",
+		userID, since.UTC(),
+	).Scan(&t.Requests, &t.InputTokens, &t.OutputTokens, &t.CacheRead, &t.CacheCreation, &t.PrunedImages, &t.Cost)
+	return t, err
+}
+
+// GetUsageByModel sums a user's usage since the given time per model
+func GetUsageByModel(userID int64, since time.Time) (map[string]UsageTotals, error) {
+	return groupUsage("model", userID, since)
+}
+
+// GetUsageByAgent sums a user's usage since the given time per agent
+func GetUsageByAgent(userID int64, since time.Time) (map[string]UsageTotals, error) {
+	return groupUsage("agent_token", userID, since)
+}
+
+// groupUsage sums usage per value of column, which must be a trusted column name
+func groupUsage(column string, userID int64, since time.Time) (map[string]UsageTotals, error) {
+	rows, err := DB.Query(
+		"SELECT "+column+", COUNT(*), SUM(input_tokens), SUM(output_tokens), SUM(cache_read_tokens), SUM(cache_creation_tokens), SUM(pruned_images), SUM(cost) FROM usage_records WHERE user_id = ? AND created_at >= ? GROUP BY "+column,
+		userID, since.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]UsageTotals)
+	for rows.Next() {
+		var key string
+		var t UsageTotals
+		if err := rows.Scan(&key, &t.Requests, &t.InputTokens, &t.OutputTokens, &t.CacheRead, &t.CacheCreation, &t.PrunedImages, &t.Cost); err != nil {
+			continue
+		}
+		totals[key] = t
+	}
+	return totals, rows.Err()
+}
+
+// GetBudget returns a user's spending limits
+func GetBudget(userID int64) (Budget, error) {
+	var b Budget
+	err := DB.QueryRow(
+		"SELECT daily_limit, monthly_limit FROM user_budgets WHERE user_id = ?",
+		userID,
+	).Scan(&b.DailyLimit, &b.MonthlyLimit)
+	if err == sql.ErrNoRows {
+		return Budget{}, nil
+	}
+	return b, err
+}
+
+// SetBudget sets a user's spending limits
+func SetBudget(userID int64, b Budget) error {
+	_, err := DB.Exec(
+		"INSERT INTO user_budgets (user_id, daily_limit, monthly_limit) VALUES (?, ?, ?) ON CONFLICT(user_id) DO UPDATE SET daily_limit = excluded.daily_limit, monthly_limit = excluded.monthly_limit",
+		userID, b.DailyLimit, b.MonthlyLimit,
+	)
+	return err
+}
+
+// StartOfDay returns midnight of t's day in server local time
+func StartOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// StartOfMonth returns midnight of the first of t's month in server local time
+func StartOfMonth(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// CheckBudget reports whether a user has reached their daily or monthly
+// limit. reason describes the limit that was reached.
+func CheckBudget(userID int64) (exceeded bool, reason string, err error) {
+	b, err := GetBudget(userID)
+	if err != nil {
+		return false, "", err
+	}
+
+	now := time.Now()
+	if b.DailyLimit > 0 {
+		today, err := GetUsageTotals(userID, StartOfDay(now))
+		if err != nil {
+			return false, "", err
+		}
+		if today.Cost >= b.DailyLimit {
+			return true, fmt.Sprintf("已達每日用量上限 (US$%.2f / US$%.2f)", today.Cost, b.DailyLimit), nil
+		}
+	}
+	if b.MonthlyLimit > 0 {
+		month, err := GetUsageTotals(userID, StartOfMonth(now))
+		if err != nil {
+			return false, "", err
+		}
+		if month.Cost >= b.MonthlyLimit {
+			return true, fmt.Sprintf("已達每月用量上限 (US$%.2f / US$%.2f)", month.Cost, b.MonthlyLimit), nil
+		}
+	}
+	return false, "", nil
+}
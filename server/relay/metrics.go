@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"fmt"
+	"strconv"
+
+	"weekend-chart/server/metrics"
+)
+
+func init() {
+	metrics.NewGaugeFunc(
+		"weekend_chart_connected_agents",
+		"Agents currently connected to the relay.",
+		nil,
+		func(emit func(float64, ...string)) {
+			GlobalHub.mu.RLock()
+			defer GlobalHub.mu.RUnlock()
+			emit(float64(len(GlobalHub.agents)))
+		},
+	)
+
+	metrics.NewGaugeFunc(
+		"weekend_chart_connected_users",
+		"User WebSocket connections currently open.",
+		nil,
+		func(emit func(float64, ...string)) {
+			GlobalHub.mu.RLock()
+			defer GlobalHub.mu.RUnlock()
+			count := 0
+			for _, conns := range GlobalHub.users {
+				count += len(conns)
+			}
+			emit(float64(count))
+		},
+	)
+
+	metrics.NewGaugeFunc(
+		"weekend_chart_send_queue_depth",
+		"Messages waiting in each connection's send channel.",
+		[]string{"kind", "id"},
+		func(emit func(float64, ...string)) {
+			GlobalHub.mu.RLock()
+			defer GlobalHub.mu.RUnlock()
+			// Agents are labeled by their ID, never by token. Unpaired
+			// agents have none, so they share one series.
+			unpaired, anyUnpaired := 0, false
+			for _, ac := range GlobalHub.agents {
+				if ac.AgentID == 0 {
+					unpaired += len(ac.Send)
+					anyUnpaired = true
+					continue
+				}
+				emit(float64(len(ac.Send)), "agent", strconv.FormatInt(ac.AgentID, 10))
+			}
+			if anyUnpaired {
+				emit(float64(unpaired), "agent", "unpaired")
+			}
+			for userID, conns := range GlobalHub.users {
+				i := 0
+				for uc := range conns {
+					emit(float64(len(uc.Send)), "user", fmt.Sprintf("%d#%d", userID, i))
+					i++
+				}
+			}
+		},
+	)
+}
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"weekend-chart/server/metrics"
+	"weekend-chart/server/models"
+)
+
+func TestQueueDepthNotLabeledWithTokens(t *testing.T) {
+	res, err := models.DB.Exec("INSERT INTO users (username, password_hash) VALUES ('metrics', '')")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	userID, _ := res.LastInsertId()
+	const paired, unpaired = "Qx7pairedTokenValue", "Zk3unpairedTokenValue"
+	if err := models.PairAgent(userID, paired, "Test"); err != nil {
+		t.Fatalf("pair agent: %v", err)
+	}
+	agent, err := models.GetAgentByToken(paired)
+	if err != nil {
+		t.Fatalf("get agent: %v", err)
+	}
+
+	GlobalHub.RegisterAgent(paired, nil, ProtocolVersion, "test", nil)
+	defer GlobalHub.UnregisterAgent(paired)
+	GlobalHub.RegisterAgent(unpaired, nil, ProtocolVersion, "test", nil)
+	defer GlobalHub.UnregisterAgent(unpaired)
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, token := range []string{paired, unpaired} {
+		if strings.Contains(body, token[:6]) {
+			t.Errorf("metrics contain part of the token %q", token)
+		}
+	}
+	for _, want := range []string{
+		fmt.Sprintf(`weekend_chart_send_queue_depth{kind="agent",id="%d"} 0`, agent.ID),
+		`weekend_chart_send_queue_depth{kind="agent",id="unpaired"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s:\n%s", want, body)
+		}
+	}
+}
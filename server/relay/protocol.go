@@ -0,0 +1,58 @@
+package relay
+
+// ProtocolVersion is the agent protocol version spoken by this server
+const ProtocolVersion = 1
+
+// MinAgentProtocolVersion is the oldest agent protocol version that is fully supported.
+// Older agents can still connect, but users are warned to update them.
+const MinAgentProtocolVersion = 1
+
+// Agent capabilities advertised in the auth handshake
+const (
+	CapNavigate     = "navigate"
+	CapClick        = "click"
+	CapClickXY      = "click_xy"
+	CapInput        = "input"
+	CapKey          = "key"
+	CapScroll       = "scroll"
+	CapScreenshot   = "request_screenshot"
+	CapSelectAll    = "select_all"
+	CapPageState    = "get_page_state"
+	CapSelectOption = "select_option"
+	CapRunActions   = "run_actions"
+	CapElementRefs  = "element_refs"
+)
+
+// legacyCapabilities is what an agent that predates the handshake
+// (protocol version 0) is assumed to support.
+var legacyCapabilities = []string{
+	CapNavigate,
+	CapClick,
+	CapClickXY,
+	CapInput,
+	CapKey,
+	CapScroll,
+	CapScreenshot,
+	CapSelectAll,
+	CapPageState,
+	CapSelectOption,
+}
+
+// HasCapability reports whether the agent advertised the given capability
+func (ac *AgentConn) HasCapability(capability string) bool {
+	_, ok := ac.Capabilities[capability]
+	return ok
+}
+
+// IsOutdated reports whether the agent speaks an older protocol than the server supports
+func (ac *AgentConn) IsOutdated() bool {
+	return ac.ProtocolVersion < MinAgentProtocolVersion
+}
+
+func capabilitySet(capabilities []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(capabilities))
+	for _, c := range capabilities {
+		set[c] = struct{}{}
+	}
+	return set
+}
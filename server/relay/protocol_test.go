@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"weekend-chart/server/models"
+)
+
+// TestMain opens a database in a temporary directory for all tests
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "relay-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := models.InitDB(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+
+	models.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// baselineAgentCommands are the commands the agent handled before it sent
+// a protocol version, so every agent already deployed runs them
+var baselineAgentCommands = []string{
+	"navigate",
+	"click",
+	"click_xy",
+	"input",
+	"key",
+	"select_all",
+	"get_page_state",
+	"request_screenshot",
+	"scroll",
+	"select_option",
+}
+
+func TestLegacyAgentCapabilities(t *testing.T) {
+	hub := &Hub{agents: make(map[string]*AgentConn)}
+	ac := hub.RegisterAgent("legacy-agent", nil, 0, "", nil)
+
+	for _, command := range baselineAgentCommands {
+		if !ac.HasCapability(command) {
+			t.Errorf("protocol 0 agent lacks %s, which it handles", command)
+		}
+	}
+	if len(ac.Capabilities) != len(baselineAgentCommands) {
+		t.Errorf("protocol 0 agent has %d capabilities, want the %d it handles: %v",
+			len(ac.Capabilities), len(baselineAgentCommands), ac.Capabilities)
+	}
+	if !ac.IsOutdated() {
+		t.Errorf("protocol 0 agent is not reported as outdated")
+	}
+
+	// An agent that sends its capabilities gets exactly those
+	ac = hub.RegisterAgent("current-agent", nil, ProtocolVersion, "test", []string{CapNavigate, CapRunActions})
+	if !ac.HasCapability(CapRunActions) || ac.HasCapability(CapPageState) {
+		t.Errorf("capabilities = %v, want the advertised ones", ac.Capabilities)
+	}
+}
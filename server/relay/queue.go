@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"encoding/json"
+	"log"
+	"weekend-chart/server/models"
+)
+
+// CommandStatusMessage builds the message that tells a user about a queued command
+func CommandStatusMessage(id int64, commandType, status string) []byte {
+	msg, _ := json.Marshal(map[string]interface{}{
+		"type":         "command_status",
+		"id":           id,
+		"command_type": commandType,
+		"status":       status,
+	})
+	return msg
+}
+
+// DeliverQueuedCommands sends the commands queued while the agent was
+// offline, in order. write must send a message to the agent synchronously;
+// a command only counts as delivered once write succeeded.
+func (h *Hub) DeliverQueuedCommands(ac *AgentConn, write func([]byte) error) {
+	commands, err := models.GetPendingCommands(ac.Token)
+	if err != nil {
+		log.Printf("Failed to load queued commands for agent %s: %v", shortToken(ac.Token), err)
+		return
+	}
+
+	for _, c := range commands {
+		// The user may have cancelled it while earlier ones were sent
+		if current, err := models.GetCommandStatus(c.ID); err != nil || current != models.CommandPending {
+			continue
+		}
+
+		status := models.CommandDelivered
+		if !ac.HasCapability(c.CommandType) {
+			status = models.CommandFailed
+		} else if err := write([]byte(c.Payload)); err != nil {
+			// Agent went away again; leave the rest pending for the next connection
+			log.Printf("Failed to deliver queued command %d to agent %s: %v", c.ID, shortToken(ac.Token), err)
+			return
+		}
+
+		if err := models.UpdateCommandStatus(c.ID, status); err != nil {
+			log.Printf("Failed to update queued command %d: %v", c.ID, err)
+		}
+		h.SendToUser(c.UserID, CommandStatusMessage(c.ID, c.CommandType, status))
+		log.Printf("Queued command %d (%s) for agent %s: %s", c.ID, c.CommandType, shortToken(ac.Token), status)
+	}
+}
+
+// shortToken truncates an agent token for logs
+func shortToken(token string) string {
+	if len(token) > 10 {
+		return token[:10]
+	}
+	return token
+}
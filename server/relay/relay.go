@@ -1,11 +1,14 @@
 package relay
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
+	"weekend-chart/server/metrics"
 	"weekend-chart/server/models"
 
 	"github.com/gorilla/websocket"
@@ -42,15 +45,35 @@ type Hub struct {
 	// Page state request channels (key: request_id)
 	pageStateRequests map[string]chan json.RawMessage
 
+	// run_actions request channels (key: request_id)
+	actionsRequests map[string]chan json.RawMessage
+
+	// Closed on shutdown to stop background goroutines
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// Set by Shutdown once every Send channel is closed
+	closed bool
+
 	mu sync.RWMutex
 }
 
 // ScreenshotCache stores the latest screenshot for an agent
 type ScreenshotCache struct {
 	Data      string
+	Page      ScreenshotPage
 	UpdatedAt time.Time
 }
 
+// ScreenshotPage describes the page shown in a screenshot, as far as the
+// agent reported it
+type ScreenshotPage struct {
+	URL    string
+	Title  string
+	Width  int
+	Height int
+}
+
 // PageStateCache stores the latest page state for an agent
 type PageStateCache struct {
 	Data      json.RawMessage
@@ -58,10 +81,16 @@ type PageStateCache struct {
 }
 
 type AgentConn struct {
-	Token  string
-	UserID int64
-	Conn   *websocket.Conn
-	Send   chan []byte
+	Token   string
+	AgentID int64 // 0 until the agent is paired
+	UserID  int64
+	Conn    *websocket.Conn
+	Send    chan []byte
+
+	// Negotiated during the auth handshake
+	ProtocolVersion int
+	AgentVersion    string
+	Capabilities    map[string]struct{}
 }
 
 type UserConn struct {
@@ -78,32 +107,51 @@ var GlobalHub = &Hub{
 	screenshotRequests: make(map[string]chan string),
 	pageStateCache:     make(map[string]*PageStateCache),
 	pageStateRequests:  make(map[string]chan json.RawMessage),
+	actionsRequests:    make(map[string]chan json.RawMessage),
+	done:               make(chan struct{}),
 }
 
 // Agent methods
-func (h *Hub) RegisterAgent(token string, conn *websocket.Conn) *AgentConn {
+func (h *Hub) RegisterAgent(token string, conn *websocket.Conn, protocolVersion int, agentVersion string, capabilities []string) *AgentConn {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	// Check if agent is already paired
 	agent, err := models.GetAgentByToken(token)
-	var userID int64
+	var agentID, userID int64
 	if err == nil && agent != nil {
-		userID = agent.UserID
+		agentID, userID = agent.ID, agent.UserID
+	}
+
+	// Agents that predate the handshake don't send a capability list
+	if protocolVersion == 0 && len(capabilities) == 0 {
+		capabilities = legacyCapabilities
 	}
 
 	ac := &AgentConn{
-		Token:  token,
-		UserID: userID,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
+		Token:           token,
+		AgentID:         agentID,
+		UserID:          userID,
+		Conn:            conn,
+		Send:            make(chan []byte, 256),
+		ProtocolVersion: protocolVersion,
+		AgentVersion:    agentVersion,
+		Capabilities:    capabilitySet(capabilities),
 	}
 	h.agents[token] = ac
 
-	log.Printf("Agent registered: %s (user: %d)", token, userID)
+	log.Printf("Agent registered: %s (user: %d, protocol: %d, version: %q)", token, userID, protocolVersion, agentVersion)
 	return ac
 }
 
+// GetAgent returns the connection of an online agent
+func (h *Hub) GetAgent(token string) (*AgentConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ac, ok := h.agents[token]
+	return ac, ok
+}
+
 func (h *Hub) UnregisterAgent(token string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -123,10 +171,16 @@ func (h *Hub) IsAgentOnline(token string) bool {
 }
 
 func (h *Hub) UpdateAgentUserID(token string, userID int64) {
+	var agentID int64
+	if agent, err := models.GetAgentByToken(token); err == nil {
+		agentID = agent.ID
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
 	if ac, ok := h.agents[token]; ok {
+		ac.AgentID = agentID
 		ac.UserID = userID
 	}
 }
@@ -190,12 +244,33 @@ func (h *Hub) SendToAgent(agentToken string, msg []byte) bool {
 		case ac.Send <- msg:
 			return true
 		default:
+			metrics.DroppedMessages.Inc("agent")
 			return false
 		}
 	}
 	return false
 }
 
+// SendToAgentConn queues a message for one agent connection. Unlike a
+// plain send on ac.Send it can't panic once the connection was closed by
+// UnregisterAgent or Shutdown; it returns false instead.
+func (h *Hub) SendToAgentConn(ac *AgentConn, msg []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// Send is only closed with the hub locked, after removing the connection
+	if h.closed || h.agents[ac.Token] != ac {
+		return false
+	}
+	select {
+	case ac.Send <- msg:
+		return true
+	default:
+		metrics.DroppedMessages.Inc("agent")
+		return false
+	}
+}
+
 func (h *Hub) SendToUser(userID int64, msg []byte) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
@@ -205,6 +280,7 @@ func (h *Hub) SendToUser(userID int64, msg []byte) {
 			select {
 			case uc.Send <- msg:
 			default:
+				metrics.DroppedMessages.Inc("user")
 			}
 		}
 	}
@@ -223,6 +299,7 @@ func (h *Hub) BroadcastToAgentUsers(agentToken string, msg []byte) {
 					select {
 					case uc.Send <- msg:
 					default:
+						metrics.DroppedMessages.Inc("user")
 					}
 				}
 			}
@@ -234,25 +311,93 @@ func (h *Hub) BroadcastToAgentUsers(agentToken string, msg []byte) {
 func (h *Hub) StartHeartbeat() {
 	ticker := time.NewTicker(30 * time.Second)
 	go func() {
-		for range ticker.C {
-			h.mu.RLock()
-			for token := range h.agents {
-				models.UpdateAgentLastSeen(token)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.mu.RLock()
+				for token := range h.agents {
+					models.UpdateAgentLastSeen(token)
+				}
+				h.mu.RUnlock()
+			case <-h.done:
+				return
 			}
-			h.mu.RUnlock()
 		}
 	}()
 }
 
+// Shutdown tells every agent and user to reconnect after the given delay,
+// then closes all connections and stops the heartbeat.
+func (h *Hub) Shutdown(reconnectAfter time.Duration) {
+	h.doneOnce.Do(func() { close(h.done) })
+
+	notice, _ := json.Marshal(map[string]interface{}{
+		"type": "server_shutdown",
+		"data": map[string]int{
+			"reconnect_after": int(reconnectAfter.Seconds()),
+		},
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+
+	// The write pumps flush the notice, then send a close frame once Send is closed
+	for token, ac := range h.agents {
+		models.UpdateAgentLastSeen(token)
+		select {
+		case ac.Send <- notice:
+		default:
+		}
+		close(ac.Send)
+		delete(h.agents, token)
+	}
+	for userID, conns := range h.users {
+		for uc := range conns {
+			select {
+			case uc.Send <- notice:
+			default:
+			}
+			close(uc.Send)
+		}
+		delete(h.users, userID)
+		delete(h.userViewingAgent, userID)
+	}
+
+	log.Printf("Relay hub shut down")
+}
+
 // Screenshot cache methods
 
-// UpdateScreenshotCache updates the cached screenshot for an agent
+// UpdateScreenshotCache updates the cached screenshot for an agent. The page
+// URL and title are kept if the image is the one already cached.
 func (h *Hub) UpdateScreenshotCache(agentToken string, data string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	var page ScreenshotPage
+	if cache, ok := h.screenshotCache[agentToken]; ok && cache.Data == data {
+		page = cache.Page
+	}
+	h.cacheScreenshot(agentToken, data, page)
+}
+
+// UpdateScreenshotPage updates the cached screenshot for an agent together
+// with the page it shows
+func (h *Hub) UpdateScreenshotPage(agentToken, data string, page ScreenshotPage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cacheScreenshot(agentToken, data, page)
+}
+
+// cacheScreenshot stores a screenshot and passes it to pending requests.
+// h.mu must be held.
+func (h *Hub) cacheScreenshot(agentToken, data string, page ScreenshotPage) {
 	h.screenshotCache[agentToken] = &ScreenshotCache{
 		Data:      data,
+		Page:      page,
 		UpdatedAt: time.Now(),
 	}
 
@@ -280,11 +425,37 @@ func (h *Hub) GetCachedScreenshot(agentToken string) (string, time.Time, bool) {
 	return "", time.Time{}, false
 }
 
+// GetScreenshotPage returns the page shown in a screenshot, if it is the one
+// cached for the agent
+func (h *Hub) GetScreenshotPage(agentToken, data string) (ScreenshotPage, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if cache, ok := h.screenshotCache[agentToken]; ok && cache.Data == data {
+		return cache.Page, true
+	}
+	return ScreenshotPage{}, false
+}
+
+// GetViewport returns the size of the agent's latest screenshot
+func (h *Hub) GetViewport(agentToken string) (width, height int, ok bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if cache, found := h.screenshotCache[agentToken]; found && cache.Page.Width > 0 {
+		return cache.Page.Width, cache.Page.Height, true
+	}
+	return 0, 0, false
+}
+
 // RequestScreenshotSync requests a screenshot and waits for the response
-func (h *Hub) RequestScreenshotSync(agentToken string, timeout time.Duration) (string, error) {
+func (h *Hub) RequestScreenshotSync(ctx context.Context, agentToken string, timeout time.Duration) (string, error) {
+	start := time.Now()
+
 	// First check if we have a recent cached screenshot (within 3 seconds)
 	if data, updatedAt, ok := h.GetCachedScreenshot(agentToken); ok {
 		if time.Since(updatedAt) < 3*time.Second {
+			observeAgentRequest("screenshot", "cached", start)
 			return data, nil
 		}
 	}
@@ -308,14 +479,20 @@ func (h *Hub) RequestScreenshotSync(agentToken string, timeout time.Duration) (s
 	// Send screenshot request to agent
 	reqMsg, _ := json.Marshal(map[string]string{"type": "request_screenshot"})
 	if !h.SendToAgent(agentToken, reqMsg) {
+		observeAgentRequest("screenshot", "error", start)
 		return "", fmt.Errorf("agent not connected")
 	}
 
 	// Wait for response with timeout
 	select {
 	case screenshot := <-respChan:
+		observeAgentRequest("screenshot", "ok", start)
 		return screenshot, nil
+	case <-ctx.Done():
+		observeAgentRequest("screenshot", "cancelled", start)
+		return "", ctx.Err()
 	case <-time.After(timeout):
+		observeAgentRequest("screenshot", "timeout", start)
 		// Try to return cached screenshot if available
 		if data, _, ok := h.GetCachedScreenshot(agentToken); ok {
 			return data, nil
@@ -324,6 +501,10 @@ func (h *Hub) RequestScreenshotSync(agentToken string, timeout time.Duration) (s
 	}
 }
 
+func observeAgentRequest(request, result string, start time.Time) {
+	metrics.AgentRequestDuration.Observe(time.Since(start).Seconds(), request, result)
+}
+
 // ClearAgentScreenshotCache clears the screenshot cache for an agent
 func (h *Hub) ClearAgentScreenshotCache(agentToken string) {
 	h.mu.Lock()
@@ -367,7 +548,9 @@ func (h *Hub) GetCachedPageState(agentToken string) (json.RawMessage, time.Time,
 }
 
 // RequestPageStateSync requests page state and waits for the response
-func (h *Hub) RequestPageStateSync(agentToken string, timeout time.Duration) (json.RawMessage, error) {
+func (h *Hub) RequestPageStateSync(ctx context.Context, agentToken string, timeout time.Duration) (json.RawMessage, error) {
+	start := time.Now()
+
 	// Create a unique request ID
 	reqID := fmt.Sprintf("%s:%d", agentToken, time.Now().UnixNano())
 	respChan := make(chan json.RawMessage, 1)
@@ -387,14 +570,84 @@ func (h *Hub) RequestPageStateSync(agentToken string, timeout time.Duration) (js
 	// Send page state request to agent
 	reqMsg, _ := json.Marshal(map[string]string{"type": "get_page_state"})
 	if !h.SendToAgent(agentToken, reqMsg) {
+		observeAgentRequest("page_state", "error", start)
 		return nil, fmt.Errorf("agent not connected")
 	}
 
 	// Wait for response with timeout
 	select {
 	case pageState := <-respChan:
+		observeAgentRequest("page_state", "ok", start)
 		return pageState, nil
+	case <-ctx.Done():
+		observeAgentRequest("page_state", "cancelled", start)
+		return nil, ctx.Err()
 	case <-time.After(timeout):
+		observeAgentRequest("page_state", "timeout", start)
 		return nil, fmt.Errorf("page state request timed out")
 	}
 }
+
+// Batch action methods
+
+// RunActionsSync sends a batch of steps to the agent and waits for its
+// actions_result, which carries the request ID back
+func (h *Hub) RunActionsSync(ctx context.Context, agentToken string, steps interface{}, timeout time.Duration) (json.RawMessage, error) {
+	start := time.Now()
+
+	reqID := fmt.Sprintf("%s:%d", agentToken, time.Now().UnixNano())
+	respChan := make(chan json.RawMessage, 1)
+
+	h.mu.Lock()
+	h.actionsRequests[reqID] = respChan
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.actionsRequests, reqID)
+		h.mu.Unlock()
+	}()
+
+	reqMsg, err := json.Marshal(map[string]interface{}{
+		"type":       "run_actions",
+		"request_id": reqID,
+		"steps":      steps,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !h.SendToAgent(agentToken, reqMsg) {
+		observeAgentRequest("run_actions", "error", start)
+		return nil, fmt.Errorf("agent not connected")
+	}
+
+	select {
+	case result := <-respChan:
+		observeAgentRequest("run_actions", "ok", start)
+		return result, nil
+	case <-ctx.Done():
+		observeAgentRequest("run_actions", "cancelled", start)
+		return nil, ctx.Err()
+	case <-time.After(timeout):
+		observeAgentRequest("run_actions", "timeout", start)
+		return nil, fmt.Errorf("run_actions request timed out")
+	}
+}
+
+// DeliverActionsResult passes an agent's actions_result to the request
+// waiting for it. Results for unknown requests, or for requests sent to
+// another agent, are dropped.
+func (h *Hub) DeliverActionsResult(agentToken, requestID string, data json.RawMessage) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ch, ok := h.actionsRequests[requestID]
+	if !ok || !strings.HasPrefix(requestID, agentToken+":") {
+		return false
+	}
+	select {
+	case ch <- data:
+	default:
+	}
+	return true
+}
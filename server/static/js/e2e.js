@@ -0,0 +1,93 @@
+// End-to-end encryption between this device and an agent.
+// Mirrors agent/e2e/e2e.go: ECDH P-256 -> HKDF-SHA256 -> AES-256-GCM.
+// The server only relays public keys and ciphertext.
+const E2E = (function() {
+    const STORAGE_KEY = 'wc_e2e_device';
+    const HKDF_INFO = new TextEncoder().encode('weekend-chart e2e v1');
+    const CURVE = { name: 'ECDH', namedCurve: 'P-256' };
+
+    function toBase64(buf) {
+        const bytes = new Uint8Array(buf);
+        let s = '';
+        for (let i = 0; i < bytes.length; i++) s += String.fromCharCode(bytes[i]);
+        return btoa(s);
+    }
+
+    function fromBase64(s) {
+        const bin = atob(s);
+        const bytes = new Uint8Array(bin.length);
+        for (let i = 0; i < bin.length; i++) bytes[i] = bin.charCodeAt(i);
+        return bytes;
+    }
+
+    // getDevice returns this device's ID and key pair, creating them on first use
+    async function getDevice() {
+        const stored = localStorage.getItem(STORAGE_KEY);
+        if (stored) return JSON.parse(stored);
+
+        const pair = await crypto.subtle.generateKey(CURVE, true, ['deriveBits']);
+        const idBytes = crypto.getRandomValues(new Uint8Array(8));
+        const device = {
+            id: Array.from(idBytes, b => b.toString(16).padStart(2, '0')).join(''),
+            privateKey: await crypto.subtle.exportKey('jwk', pair.privateKey),
+            publicKey: toBase64(await crypto.subtle.exportKey('raw', pair.publicKey))
+        };
+        localStorage.setItem(STORAGE_KEY, JSON.stringify(device));
+        return device;
+    }
+
+    async function fingerprint(publicKey) {
+        const digest = await crypto.subtle.digest('SHA-256', new TextEncoder().encode(publicKey));
+        const hex = Array.from(new Uint8Array(digest).slice(0, 8), b => b.toString(16).padStart(2, '0')).join('');
+        return hex.slice(0, 4) + '-' + hex.slice(4, 8) + '-' + hex.slice(8, 12) + '-' + hex.slice(12, 16);
+    }
+
+    // sessionKey derives the AES key shared with the agent
+    async function sessionKey(agentPublicKey) {
+        const device = await getDevice();
+        const priv = await crypto.subtle.importKey('jwk', device.privateKey, CURVE, false, ['deriveBits']);
+        const pub = await crypto.subtle.importKey('raw', fromBase64(agentPublicKey), CURVE, false, []);
+        const secret = await crypto.subtle.deriveBits({ name: 'ECDH', public: pub }, priv, 256);
+        const hkdfKey = await crypto.subtle.importKey('raw', secret, 'HKDF', false, ['deriveKey']);
+        return crypto.subtle.deriveKey(
+            { name: 'HKDF', hash: 'SHA-256', salt: new Uint8Array(), info: HKDF_INFO },
+            hkdfKey,
+            { name: 'AES-GCM', length: 256 },
+            false,
+            ['encrypt', 'decrypt']
+        );
+    }
+
+    // encrypt wraps a message for the agent in an envelope the server can route.
+    // The send time lets the agent reject messages the server replays.
+    async function encrypt(key, msg) {
+        const device = await getDevice();
+        const nonce = crypto.getRandomValues(new Uint8Array(12));
+        const ciphertext = await crypto.subtle.encrypt(
+            { name: 'AES-GCM', iv: nonce, additionalData: new TextEncoder().encode('to-agent:' + device.id) },
+            key,
+            new TextEncoder().encode(JSON.stringify(Object.assign({}, msg, { sent_at: Date.now() })))
+        );
+        return {
+            type: 'e2e',
+            device_id: device.id,
+            nonce: toBase64(nonce),
+            ciphertext: toBase64(ciphertext)
+        };
+    }
+
+    // decrypt opens an envelope from the agent; returns null if it is for another device
+    async function decrypt(key, envelope) {
+        const device = await getDevice();
+        if (envelope.device_id !== device.id) return null;
+
+        const plaintext = await crypto.subtle.decrypt(
+            { name: 'AES-GCM', iv: fromBase64(envelope.nonce), additionalData: new TextEncoder().encode('to-device:' + device.id) },
+            key,
+            fromBase64(envelope.ciphertext)
+        );
+        return JSON.parse(new TextDecoder().decode(plaintext));
+    }
+
+    return { getDevice, fingerprint, sessionKey, encrypt, decrypt };
+})();